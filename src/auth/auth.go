@@ -1,27 +1,100 @@
 package auth
 
 import (
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	TokenLifetime         = 5 * time.Hour
+	ImpersonationLifetime = 15 * time.Minute
+)
+
+// Scopes restrict what API keys may be used for. Tokens of a login are not
+// restricted.
+const (
+	ScopeAccountRead   = "account:read"
+	ScopeAccountDelete = "account:delete"
+	ScopeKeysManage    = "keys:manage"
+	ScopeAdmin         = "admin"
+)
+
+var Scopes = []string{ScopeAccountRead, ScopeAccountDelete, ScopeKeysManage, ScopeAdmin}
+
+func IsValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Actor identifies the party acting on behalf of the subject of a token, see
+// the "act" claim of RFC 8693.
+type Actor struct {
+	Subject  string `json:"sub"`
+	Username string `json:"username,omitempty"`
+}
+
 type JwtClaims struct {
 	UserId   int    `json:"userId"`
 	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+	// EmailVerified uses the name of the OpenID Connect claim
+	EmailVerified bool   `json:"email_verified"`
+	Actor         *Actor `json:"act,omitempty"`
+	// SessionId links the token to the session of the login, using the name
+	// of the OpenID Connect claim
+	SessionId int `json:"sid,omitempty"`
 	jwt.StandardClaims
 }
 
-func GenerateToken(id int, username string, signingMethod jwt.SigningMethod, key interface{}) (string, error) {
-	claims := JwtClaims{
+func NewClaims(id int, username string) JwtClaims {
+	return JwtClaims{
 		UserId:   id,
 		Username: username,
 		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(5 * time.Hour).Unix(),
+			Subject:   strconv.Itoa(id),
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(TokenLifetime).Unix(),
 		},
 	}
+}
 
+// NewImpersonationClaims creates short-lived claims for the given account,
+// which carry the acting admin in the "act" claim.
+func NewImpersonationClaims(id int, username string, actorId int, actorUsername string) JwtClaims {
+	claims := NewClaims(id, username)
+	claims.ExpiresAt = time.Now().Add(ImpersonationLifetime).Unix()
+	claims.Actor = &Actor{
+		Subject:  strconv.Itoa(actorId),
+		Username: actorUsername,
+	}
+
+	return claims
+}
+
+func (claims JwtClaims) IsImpersonation() bool {
+	return claims.Actor != nil
+}
+
+func GenerateToken(id int, username string, signingMethod jwt.SigningMethod, key interface{}) (string, error) {
+	return GenerateTokenWithClaims(NewClaims(id, username), signingMethod, key, "")
+}
+
+// GenerateTokenWithClaims signs the given claims. If keyId is set, it is
+// written to the "kid" header, so verifiers can pick the matching public key.
+func GenerateTokenWithClaims(claims JwtClaims, signingMethod jwt.SigningMethod, key interface{}, keyId string) (string, error) {
 	token := jwt.NewWithClaims(signingMethod, claims)
+
+	if keyId != "" {
+		token.Header["kid"] = keyId
+	}
+
 	signedToken, err := token.SignedString(key)
 	return signedToken, err
 }
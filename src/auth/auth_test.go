@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
@@ -25,3 +28,86 @@ func TestGenerateToken(t *testing.T) {
 	assert.Equal(t, 0.0, claims["userId"])
 	assert.Equal(t, "test", claims["username"])
 }
+
+func TestGenerateTokenWithKeyId(t *testing.T) {
+	claims := NewClaims(1, "test")
+	claims.Issuer = "login-service"
+
+	tokenString, err := GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsignkey"), "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &JwtClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return []byte("supersecretsignkey"), nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsedClaims := token.Claims.(*JwtClaims)
+
+	assert.Equal(t, "key-1", token.Header["kid"])
+	assert.Equal(t, 1, parsedClaims.UserId)
+	assert.Equal(t, "login-service", parsedClaims.Issuer)
+}
+
+func TestJSONWebKeyRoundTrip(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := JSONWebKeySet{Keys: []JSONWebKey{NewRSAJSONWebKey("key-1", "RS256", &privateKey.PublicKey)}}
+
+	key, ok := set.Find("key-1")
+	if !ok {
+		t.Fatal("Key not found")
+	}
+
+	publicKey, err := key.RSAPublicKey()
+
+	assert.Nil(t, err)
+	assert.True(t, privateKey.PublicKey.Equal(publicKey))
+
+	_, ok = set.Find("key-2")
+	assert.False(t, ok)
+}
+
+func TestJSONWebKeyWrongType(t *testing.T) {
+	_, err := JSONWebKey{Kty: "EC"}.RSAPublicKey()
+	assert.NotNil(t, err)
+}
+
+func TestImpersonationClaims(t *testing.T) {
+	claims := NewImpersonationClaims(2, "test", 1, "admin")
+
+	tokenString, err := GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsignkey"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+		return []byte("supersecretsignkey"), nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapClaims := token.Claims.(jwt.MapClaims)
+	actor := mapClaims["act"].(map[string]interface{})
+
+	assert.True(t, claims.IsImpersonation())
+	assert.False(t, NewClaims(2, "test").IsImpersonation())
+	assert.Equal(t, "2", mapClaims["sub"])
+	assert.Equal(t, "1", actor["sub"])
+	assert.Equal(t, "admin", actor["username"])
+	assert.True(t, claims.ExpiresAt <= time.Now().Add(ImpersonationLifetime).Unix())
+}
+
+func TestIsValidScope(t *testing.T) {
+	assert.True(t, IsValidScope(ScopeAccountRead))
+	assert.False(t, IsValidScope("account:everything"))
+}
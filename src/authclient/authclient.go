@@ -0,0 +1,207 @@
+// Package authclient verifies tokens issued by the login service without
+// calling back into it for every request. Other application manager services
+// use it to protect their own routes.
+package authclient
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"flhansen/application-manager/login-service/src/auth"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	ErrMissingToken    = errors.New("missing token")
+	ErrInvalidIssuer   = errors.New("invalid token issuer")
+	ErrInvalidAudience = errors.New("invalid token audience")
+	// ErrMissingExpiration rejects tokens without "exp", which would never
+	// expire
+	ErrMissingExpiration = errors.New("token has no expiration")
+)
+
+// Principal is the authenticated user of a request. Claims is nil, if the
+// user authenticated with an API key instead of a token.
+type Principal struct {
+	UserId   int
+	Username string
+	Claims   *auth.JwtClaims
+	ApiKeyId int
+	// Scopes is nil for tokens, which grant every scope.
+	Scopes []string
+}
+
+func (principal *Principal) HasScope(scope string) bool {
+	if principal.Scopes == nil {
+		return true
+	}
+
+	for _, s := range principal.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (principal *Principal) IsImpersonation() bool {
+	return principal.Claims != nil && principal.Claims.IsImpersonation()
+}
+
+type principalKey struct{}
+
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
+
+type Verifier struct {
+	Keys     KeySource
+	Issuer   string
+	Audience string
+	// Methods lists the accepted "alg" values. If empty, every algorithm of
+	// the same family as the key returned by Keys is accepted.
+	Methods []string
+}
+
+func NewVerifier(keys KeySource, issuer string, audience string) *Verifier {
+	return &Verifier{
+		Keys:     keys,
+		Issuer:   issuer,
+		Audience: audience,
+	}
+}
+
+func (v *Verifier) Verify(ctx context.Context, tokenString string) (*auth.JwtClaims, error) {
+	if tokenString == "" {
+		return nil, ErrMissingToken
+	}
+
+	claims := &auth.JwtClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if !v.acceptsMethod(token.Method) {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		keyId, _ := token.Header["kid"].(string)
+		key, err := v.Keys.Key(ctx, keyId)
+		if err != nil {
+			return nil, err
+		}
+
+		if !methodMatchesKey(token.Method, key) {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		return key, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ExpiresAt == 0 {
+		return nil, ErrMissingExpiration
+	}
+
+	if v.Issuer != "" && !claims.VerifyIssuer(v.Issuer, true) {
+		return nil, ErrInvalidIssuer
+	}
+
+	if v.Audience != "" && !claims.VerifyAudience(v.Audience, true) {
+		return nil, ErrInvalidAudience
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) acceptsMethod(method jwt.SigningMethod) bool {
+	if len(v.Methods) == 0 {
+		return true
+	}
+
+	for _, alg := range v.Methods {
+		if method.Alg() == alg {
+			return true
+		}
+	}
+
+	return false
+}
+
+func methodMatchesKey(method jwt.SigningMethod, key interface{}) bool {
+	switch method.(type) {
+	case *jwt.SigningMethodHMAC:
+		_, ok := key.([]byte)
+		return ok
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		_, ok := key.(*rsa.PublicKey)
+		return ok
+	}
+
+	return false
+}
+
+// TokenFromRequest reads the token from the Authorization header. The
+// "Bearer" scheme is optional.
+func TokenFromRequest(r *http.Request) string {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+
+	return header
+}
+
+// problem mirrors the error responses (RFC 7807) of the login service.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// Middleware rejects requests without a valid token and stores the principal
+// of valid ones in the request context.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.Verify(r.Context(), TokenFromRequest(r))
+
+		if err != nil {
+			// Same problem (RFC 7807) the login service answers with
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(problem{
+				Type:     "urn:appman:problem:unauthenticated",
+				Title:    http.StatusText(http.StatusUnauthorized),
+				Status:   http.StatusUnauthorized,
+				Detail:   "You are not allowed",
+				Instance: r.URL.Path,
+				Code:     "unauthenticated",
+			})
+			return
+		}
+
+		principal := &Principal{
+			UserId:   claims.UserId,
+			Username: claims.Username,
+			Claims:   claims,
+		}
+
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
+	})
+}
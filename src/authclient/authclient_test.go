@@ -0,0 +1,278 @@
+package authclient
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/auth"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyHmacToken(t *testing.T) {
+	tokenString, err := auth.GenerateToken(1, "testuser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(StaticKey{Value: []byte("supersecretsigningkey")}, "", "")
+	claims, err := verifier.Verify(context.Background(), tokenString)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, claims.UserId)
+	assert.Equal(t, "testuser", claims.Username)
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	tokenString, err := auth.GenerateToken(1, "testuser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(StaticKey{Value: []byte("wrongkey")}, "", "")
+	_, err = verifier.Verify(context.Background(), tokenString)
+
+	assert.NotNil(t, err)
+}
+
+func TestVerifyWrongSigningMethod(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tokenString, err := auth.GenerateToken(1, "testuser", jwt.SigningMethodRS256, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(StaticKey{Value: []byte("supersecretsigningkey")}, "", "")
+	_, err = verifier.Verify(context.Background(), tokenString)
+
+	assert.NotNil(t, err)
+}
+
+func TestVerifyIssuerAndAudience(t *testing.T) {
+	claims := auth.NewClaims(1, "testuser")
+	claims.Issuer = "login-service"
+	claims.Audience = "application-service"
+
+	tokenString, err := auth.GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsigningkey"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := StaticKey{Value: []byte("supersecretsigningkey")}
+
+	_, err = NewVerifier(key, "login-service", "application-service").Verify(context.Background(), tokenString)
+	assert.Nil(t, err)
+
+	_, err = NewVerifier(key, "other-service", "").Verify(context.Background(), tokenString)
+	assert.Equal(t, ErrInvalidIssuer, err)
+
+	_, err = NewVerifier(key, "", "other-service").Verify(context.Background(), tokenString)
+	assert.Equal(t, ErrInvalidAudience, err)
+}
+
+func TestVerifyMissingExpiration(t *testing.T) {
+	claims := auth.NewClaims(1, "testuser")
+	claims.ExpiresAt = 0
+
+	tokenString, err := auth.GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsigningkey"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(StaticKey{Value: []byte("supersecretsigningkey")}, "", "")
+	_, err = verifier.Verify(context.Background(), tokenString)
+
+	assert.Equal(t, ErrMissingExpiration, err)
+}
+
+func TestVerifyMissingToken(t *testing.T) {
+	verifier := NewVerifier(StaticKey{Value: []byte("supersecretsigningkey")}, "", "")
+	_, err := verifier.Verify(context.Background(), "")
+
+	assert.Equal(t, ErrMissingToken, err)
+}
+
+func TestRemoteKeySet(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(auth.JSONWebKeySet{
+			Keys: []auth.JSONWebKey{auth.NewRSAJSONWebKey("key-1", "RS256", &privateKey.PublicKey)},
+		})
+	}))
+
+	defer server.Close()
+
+	tokenString, err := auth.GenerateTokenWithClaims(auth.NewClaims(1, "testuser"), jwt.SigningMethodRS256, privateKey, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(NewRemoteKeySet(server.URL), "", "")
+
+	for i := 0; i < 3; i++ {
+		claims, err := verifier.Verify(context.Background(), tokenString)
+
+		assert.Nil(t, err)
+		assert.Equal(t, "testuser", claims.Username)
+	}
+
+	assert.Equal(t, 1, requests)
+}
+
+func TestRemoteKeySetUnknownKey(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		json.NewEncoder(w).Encode(auth.JSONWebKeySet{
+			Keys: []auth.JSONWebKey{auth.NewRSAJSONWebKey("key-1", "RS256", &privateKey.PublicKey)},
+		})
+	}))
+
+	defer server.Close()
+
+	tokenString, err := auth.GenerateTokenWithClaims(auth.NewClaims(1, "testuser"), jwt.SigningMethodRS256, privateKey, "key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := NewRemoteKeySet(server.URL)
+	keys.MinRefreshInterval = time.Hour
+	verifier := NewVerifier(keys, "", "")
+
+	_, err = verifier.Verify(context.Background(), tokenString)
+	assert.NotNil(t, err)
+
+	_, err = verifier.Verify(context.Background(), tokenString)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, 1, requests)
+}
+
+func TestRemoteKeySetConcurrentRefresh(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var requests int32
+	release := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the requests after the first one are slow
+		if atomic.AddInt32(&requests, 1) > 1 {
+			<-release
+		}
+
+		json.NewEncoder(w).Encode(auth.JSONWebKeySet{
+			Keys: []auth.JSONWebKey{auth.NewRSAJSONWebKey("key-1", "RS256", &privateKey.PublicKey)},
+		})
+	}))
+
+	defer server.Close()
+
+	keys := NewRemoteKeySet(server.URL)
+	keys.MinRefreshInterval = 0
+
+	if _, err := keys.Key(context.Background(), "key-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An unknown key starts a slow refresh, which cached keys don't wait for
+	refreshed := make(chan error)
+	go func() {
+		_, err := keys.Key(context.Background(), "key-2")
+		refreshed <- err
+	}()
+
+	for atomic.LoadInt32(&requests) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := keys.Key(context.Background(), "key-1")
+	assert.Nil(t, err)
+
+	// Callers missing the key wait for the running refresh instead of
+	// fetching again
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key(context.Background(), "key-2")
+			assert.Equal(t, ErrUnknownKey, err)
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, ErrUnknownKey, <-refreshed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestMiddleware(t *testing.T) {
+	tokenString, err := auth.GenerateToken(1, "testuser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewVerifier(StaticKey{Value: []byte("supersecretsigningkey")}, "", "")
+
+	var principal *Principal
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = FromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotNil(t, principal)
+	assert.Equal(t, 1, principal.UserId)
+	assert.Equal(t, "testuser", principal.Username)
+}
+
+func TestMiddlewareUnauthorized(t *testing.T) {
+	verifier := NewVerifier(StaticKey{Value: []byte("supersecretsigningkey")}, "", "")
+
+	called := false
+	handler := verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "invalid")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var res map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&res)
+
+	assert.False(t, called)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, "unauthenticated", res["code"])
+}
+
+func TestPrincipalScopes(t *testing.T) {
+	tokenPrincipal := &Principal{UserId: 1, Claims: &auth.JwtClaims{}}
+	keyPrincipal := &Principal{UserId: 1, ApiKeyId: 1, Scopes: []string{auth.ScopeAccountRead}}
+
+	assert.True(t, tokenPrincipal.HasScope(auth.ScopeAdmin))
+	assert.True(t, keyPrincipal.HasScope(auth.ScopeAccountRead))
+	assert.False(t, keyPrincipal.HasScope(auth.ScopeAdmin))
+	assert.False(t, keyPrincipal.IsImpersonation())
+}
@@ -0,0 +1,148 @@
+package authclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flhansen/application-manager/login-service/src/auth"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type KeySource interface {
+	Key(ctx context.Context, keyId string) (interface{}, error)
+}
+
+// StaticKey always returns the same key, e.g. the shared secret of HMAC
+// signed tokens or a public key distributed with the configuration.
+type StaticKey struct {
+	Value interface{}
+}
+
+func (key StaticKey) Key(ctx context.Context, keyId string) (interface{}, error) {
+	return key.Value, nil
+}
+
+// RemoteKeySet fetches the public keys from the JWKS endpoint of the login
+// service and caches them. Expired caches and unknown key ids trigger a
+// refresh, but at most once per MinRefreshInterval. Only one refresh runs at a
+// time, callers with a cached key don't wait for it.
+type RemoteKeySet struct {
+	URL                string
+	Client             *http.Client
+	TTL                time.Duration
+	MinRefreshInterval time.Duration
+
+	mu          sync.Mutex
+	keys        auth.JSONWebKeySet
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// refreshing is closed when the running refresh finished, refreshErr
+	// holds its result
+	refreshing chan struct{}
+	refreshErr error
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		URL:                url,
+		Client:             &http.Client{Timeout: 10 * time.Second},
+		TTL:                time.Hour,
+		MinRefreshInterval: 30 * time.Second,
+	}
+}
+
+func (set *RemoteKeySet) Key(ctx context.Context, keyId string) (interface{}, error) {
+	set.mu.Lock()
+	expired := time.Since(set.fetchedAt) > set.TTL
+	canRefresh := time.Since(set.attemptedAt) > set.MinRefreshInterval
+	key, found := set.keys.Find(keyId)
+	done := set.refreshing
+	start := done == nil && canRefresh && (expired || !found)
+
+	if start {
+		done = make(chan struct{})
+		set.refreshing = done
+		set.attemptedAt = time.Now()
+	}
+	set.mu.Unlock()
+
+	// Callers without a cached key wait for the running refresh
+	wait := done != nil && !found && !start
+
+	if start {
+		set.refresh(ctx, done)
+	} else if wait {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if start || wait {
+		set.mu.Lock()
+		err := set.refreshErr
+		if err == nil {
+			key, found = set.keys.Find(keyId)
+		}
+		set.mu.Unlock()
+
+		// Keep serving cached keys if the login service is unreachable
+		if err != nil && !found {
+			return nil, err
+		}
+	}
+
+	if !found {
+		return nil, ErrUnknownKey
+	}
+
+	return key.RSAPublicKey()
+}
+
+// refresh fetches the keys without holding the lock, so callers with cached
+// keys aren't blocked by a slow login service.
+func (set *RemoteKeySet) refresh(ctx context.Context, done chan struct{}) {
+	keys, err := set.fetch(ctx)
+
+	set.mu.Lock()
+	if err == nil {
+		set.keys = keys
+		set.fetchedAt = time.Now()
+	}
+	set.refreshErr = err
+	set.refreshing = nil
+	set.mu.Unlock()
+
+	close(done)
+}
+
+func (set *RemoteKeySet) fetch(ctx context.Context) (auth.JSONWebKeySet, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, set.URL, nil)
+	if err != nil {
+		return auth.JSONWebKeySet{}, err
+	}
+
+	resp, err := set.Client.Do(req)
+	if err != nil {
+		return auth.JSONWebKeySet{}, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return auth.JSONWebKeySet{}, fmt.Errorf("could not fetch keys: unexpected status %d", resp.StatusCode)
+	}
+
+	var keys auth.JSONWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return auth.JSONWebKeySet{}, err
+	}
+
+	return keys, nil
+}
@@ -4,21 +4,50 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"flhansen/application-manager/login-service/src/metrics"
 	"flhansen/application-manager/login-service/src/security"
+	"flhansen/application-manager/login-service/src/tracing"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
 	"gopkg.in/yaml.v3"
 )
 
+// ErrAccountExists is returned when the username or email is already taken.
+var ErrAccountExists = errors.New("account already exists")
+
+// uniqueViolation is the Postgres error code of violated unique constraints.
+const uniqueViolation = "23505"
+
 type PostgresContext struct {
 	Host     string `yaml:"host"`
 	Port     int    `yaml:"port"`
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
 	Database string `yaml:"database"`
+
+	Logger *slog.Logger `yaml:"-"`
+
+	pool         *connectionPool
+	queryContext context.Context
+	tx           pgx.Tx
+}
+
+// connectionPool is shared by all copies of a context. The pool is reopened
+// when the connection settings of the context change.
+type connectionPool struct {
+	mu         sync.Mutex
+	pool       *pgxpool.Pool
+	connString string
 }
 
 func NewContext(host string, port int, username string, password string, database string) *PostgresContext {
@@ -28,9 +57,85 @@ func NewContext(host string, port int, username string, password string, databas
 		Username: username,
 		Password: password,
 		Database: database,
+		Logger:   slog.Default(),
+		pool:     &connectionPool{},
+	}
+}
+
+// WithContext returns a copy of the context, whose queries run with the given
+// request context. The copy shares the connection pool.
+func (ctx PostgresContext) WithContext(queryContext context.Context) *PostgresContext {
+	ctx.queryContext = queryContext
+	return &ctx
+}
+
+func (ctx PostgresContext) requestContext() context.Context {
+	if ctx.queryContext == nil {
+		return context.Background()
+	}
+
+	return ctx.queryContext
+}
+
+func (ctx PostgresContext) logger() *slog.Logger {
+	if ctx.Logger == nil {
+		return slog.Default()
+	}
+
+	return ctx.Logger
+}
+
+// queryOperation returns the first keyword of the query like select.
+func queryOperation(query string) string {
+	if fields := strings.Fields(query); len(fields) > 0 {
+		return strings.ToLower(fields[0])
+	}
+
+	return "unknown"
+}
+
+// startQuery starts the span and the timer of a query. The returned function
+// has to be called with the result of the query.
+func (ctx PostgresContext) startQuery(query string) (context.Context, func(err error)) {
+	operation := queryOperation(query)
+	start := time.Now()
+
+	spanContext, span := tracing.Start(ctx.requestContext(), "db."+operation,
+		attribute.String("db.system", "postgresql"),
+		attribute.String("db.operation", operation),
+		attribute.String("db.statement", query))
+
+	return spanContext, func(err error) {
+		metrics.ObserveQuery(operation, start, err)
+		tracing.End(span, err)
 	}
 }
 
+// loggedRow logs errors, which only occur when scanning a row. The query only
+// completes when scanning, so its span and duration end there as well.
+type loggedRow struct {
+	pgx.Row
+	ctx    PostgresContext
+	query  string
+	finish func(err error)
+}
+
+func (row loggedRow) Scan(dest ...interface{}) error {
+	err := row.Row.Scan(dest...)
+
+	if err == pgx.ErrNoRows {
+		row.finish(nil)
+	} else {
+		row.finish(err)
+	}
+
+	if err != nil && err != pgx.ErrNoRows {
+		row.ctx.logger().ErrorContext(row.ctx.requestContext(), "query failed", "query", row.query, "error", err)
+	}
+
+	return err
+}
+
 func NewContextFromConfig(configPath string) (*PostgresContext, error) {
 	fileBytes, err := ioutil.ReadFile(configPath)
 
@@ -51,51 +156,546 @@ func (ctx PostgresContext) ConnectionString() string {
 	return fmt.Sprintf("postgres://%s:%s@%s:%d/%s", ctx.Username, ctx.Password, ctx.Host, ctx.Port, ctx.Database)
 }
 
-func (ctx PostgresContext) Query(query string, args ...interface{}) (pgx.Row, error) {
-	conn, err := pgx.Connect(context.Background(), ctx.ConnectionString())
+// Pool returns the connection pool of the context and connects on first use.
+func (ctx PostgresContext) Pool() (*pgxpool.Pool, error) {
+	if ctx.pool == nil {
+		return nil, errors.New("context has not been created using NewContext")
+	}
+
+	ctx.pool.mu.Lock()
+	defer ctx.pool.mu.Unlock()
+
+	connString := ctx.ConnectionString()
+
+	if ctx.pool.pool != nil && ctx.pool.connString == connString {
+		return ctx.pool.pool, nil
+	}
+
+	if ctx.pool.pool != nil {
+		ctx.pool.pool.Close()
+		ctx.pool.pool = nil
+	}
+
+	pool, err := pgxpool.Connect(ctx.requestContext(), connString)
 
 	if err != nil {
+		ctx.logger().ErrorContext(ctx.requestContext(), "could not connect to database", "host", ctx.Host, "port", ctx.Port, "database", ctx.Database, "error", err)
 		return nil, err
 	}
 
-	defer conn.Close(context.Background())
+	ctx.pool.pool = pool
+	ctx.pool.connString = connString
+	return pool, nil
+}
 
-	row := conn.QueryRow(context.Background(), query, args...)
-	return row, nil
+// Stat returns the statistics of the connection pool or nil, if the pool is
+// not connected yet.
+func (ctx PostgresContext) Stat() *pgxpool.Stat {
+	if ctx.pool == nil {
+		return nil
+	}
+
+	ctx.pool.mu.Lock()
+	defer ctx.pool.mu.Unlock()
+
+	if ctx.pool.pool == nil {
+		return nil
+	}
+
+	return ctx.pool.pool.Stat()
 }
 
-func (ctx PostgresContext) CreateSchema() error {
-	_, err := ctx.Query("DROP TABLE IF EXISTS account")
+// Close waits for all acquired connections to be released and closes the pool.
+func (ctx PostgresContext) Close() {
+	if ctx.pool == nil {
+		return
+	}
+
+	ctx.pool.mu.Lock()
+	defer ctx.pool.mu.Unlock()
+
+	if ctx.pool.pool != nil {
+		ctx.pool.pool.Close()
+		ctx.pool.pool = nil
+	}
+}
+
+// querier is implemented by the pool and by transactions.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// querier returns the transaction of the context or, outside of
+// transactions, the pool.
+func (ctx PostgresContext) querier() (querier, error) {
+	if ctx.tx != nil {
+		return ctx.tx, nil
+	}
+
+	pool, err := ctx.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	return pool, nil
+}
+
+// Transaction runs fn with a copy of the context, whose statements run in a
+// single transaction. The transaction is committed if fn returns nil and
+// rolled back otherwise. Transactions started within fn join the running one.
+func (ctx PostgresContext) Transaction(fn func(tx *PostgresContext) error) error {
+	if ctx.tx != nil {
+		return fn(&ctx)
+	}
+
+	pool, err := ctx.Pool()
+	if err != nil {
+		return err
+	}
+
+	return pool.BeginFunc(ctx.requestContext(), func(tx pgx.Tx) error {
+		ctx.tx = tx
+		return fn(&ctx)
+	})
+}
+
+// Query holds a connection of the pool until the row is scanned. Statements
+// without a result have to use Exec instead.
+func (ctx PostgresContext) Query(query string, args ...interface{}) (pgx.Row, error) {
+	pool, err := ctx.querier()
+
+	if err != nil {
+		return nil, err
+	}
+
+	queryContext, finish := ctx.startQuery(query)
+	row := pool.QueryRow(queryContext, query, args...)
+	return loggedRow{Row: row, ctx: ctx, query: query, finish: finish}, nil
+}
+
+func (ctx PostgresContext) Exec(query string, args ...interface{}) error {
+	pool, err := ctx.querier()
 
 	if err != nil {
 		return err
 	}
 
-	_, err = ctx.Query(
-		`CREATE TABLE account (
+	queryContext, finish := ctx.startQuery(query)
+	_, err = pool.Exec(queryContext, query, args...)
+	finish(err)
+
+	if err != nil {
+		ctx.logger().ErrorContext(ctx.requestContext(), "query failed", "query", query, "error", err)
+	}
+
+	return err
+}
+
+// SchemaVersion has to be increased whenever the schema changes, so instances
+// running against an outdated database are reported as not ready. Every
+// increase needs a migration as well.
+const SchemaVersion = 12
+
+// The statements are ordered, so that tables are dropped before the tables
+// they reference.
+var schema = []string{
+	"DROP TABLE IF EXISTS known_device",
+	"DROP TABLE IF EXISTS login_event",
+	"DROP TABLE IF EXISTS login_session",
+	"DROP TABLE IF EXISTS account_status_change",
+	"DROP TABLE IF EXISTS email_change",
+	"DROP TABLE IF EXISTS email_verification",
+	"DROP TABLE IF EXISTS password_reset",
+	"DROP TABLE IF EXISTS device_authorization",
+	"DROP TABLE IF EXISTS api_key",
+	"DROP TABLE IF EXISTS account",
+	`CREATE TABLE account (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(80) UNIQUE NOT NULL,
+		password VARCHAR(80) NOT NULL,
+		email VARCHAR(80) UNIQUE NOT NULL,
+		email_verified BOOLEAN NOT NULL DEFAULT false,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		status VARCHAR(20) NOT NULL DEFAULT 'active',
+		sessions_revoked_date TIMESTAMP WITH TIME ZONE,
+		last_login_date TIMESTAMP WITH TIME ZONE,
+		verification_sent_date TIMESTAMP WITH TIME ZONE,
+		password_reset_sent_date TIMESTAMP WITH TIME ZONE,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	"DROP TABLE IF EXISTS audit_log",
+	`CREATE TABLE audit_log (
+		id SERIAL PRIMARY KEY,
+		actor_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL,
+		action VARCHAR(80) NOT NULL,
+		impersonation BOOLEAN NOT NULL DEFAULT false,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE api_key (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		name VARCHAR(80) NOT NULL,
+		prefix VARCHAR(20) UNIQUE NOT NULL,
+		hash VARCHAR(80) NOT NULL,
+		scopes VARCHAR(255) NOT NULL DEFAULT '',
+		expiration_date TIMESTAMP WITH TIME ZONE,
+		last_used_date TIMESTAMP WITH TIME ZONE,
+		revoked BOOLEAN NOT NULL DEFAULT false,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE device_authorization (
+		id SERIAL PRIMARY KEY,
+		device_code_hash VARCHAR(80) UNIQUE NOT NULL,
+		user_code VARCHAR(20) UNIQUE NOT NULL,
+		client_id VARCHAR(80) NOT NULL,
+		scope VARCHAR(255) NOT NULL DEFAULT '',
+		account_id INTEGER REFERENCES account(id) ON DELETE CASCADE,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		poll_interval INTEGER NOT NULL,
+		last_poll_date TIMESTAMP WITH TIME ZONE,
+		expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE password_reset (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		token_hash VARCHAR(80) UNIQUE NOT NULL,
+		expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		used_date TIMESTAMP WITH TIME ZONE,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE email_verification (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		email VARCHAR(80) NOT NULL,
+		token_hash VARCHAR(80) UNIQUE NOT NULL,
+		expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE email_change (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		old_email VARCHAR(80) NOT NULL,
+		new_email VARCHAR(80) NOT NULL,
+		token_hash VARCHAR(80) UNIQUE NOT NULL,
+		cancel_token_hash VARCHAR(80) UNIQUE NOT NULL,
+		expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		cancel_expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		confirmed_date TIMESTAMP WITH TIME ZONE,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE account_status_change (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		old_status VARCHAR(20) NOT NULL,
+		new_status VARCHAR(20) NOT NULL,
+		reason VARCHAR(255) NOT NULL,
+		actor_id INTEGER,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE login_session (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		user_agent VARCHAR(255) NOT NULL,
+		ip_address VARCHAR(45) NOT NULL,
+		expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_seen_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		revoked_date TIMESTAMP WITH TIME ZONE,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE login_event (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		outcome VARCHAR(20) NOT NULL,
+		failure_reason VARCHAR(40) NOT NULL DEFAULT '',
+		ip_address VARCHAR(45) NOT NULL,
+		user_agent VARCHAR(255) NOT NULL,
+		new_device BOOLEAN NOT NULL DEFAULT false,
+		creation_date TIMESTAMP WITH TIME ZONE NOT NULL
+	)`,
+	"CREATE INDEX login_event_account ON login_event (account_id, creation_date)",
+	"CREATE INDEX login_event_creation ON login_event (creation_date)",
+	`CREATE TABLE known_device (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		fingerprint VARCHAR(64) NOT NULL,
+		description VARCHAR(80) NOT NULL,
+		ip_prefix VARCHAR(50) NOT NULL,
+		report_token_hash VARCHAR(80) UNIQUE NOT NULL,
+		report_expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		last_seen_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now(),
+		UNIQUE (account_id, fingerprint)
+	)`,
+	"DROP TABLE IF EXISTS schema_version",
+	"CREATE TABLE schema_version (version INTEGER NOT NULL)",
+	fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%d)", SchemaVersion),
+}
+
+// migrations upgrade the schema of the previous version to the version they
+// are keyed by. They must never change once released, since databases may
+// have been migrated already.
+var migrations = map[int][]string{
+	2: {
+		"ALTER TABLE account ADD COLUMN sessions_revoked_date TIMESTAMP WITH TIME ZONE",
+		`CREATE TABLE password_reset (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			token_hash VARCHAR(80) UNIQUE NOT NULL,
+			expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			used_date TIMESTAMP WITH TIME ZONE,
+			creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+		)`,
+	},
+	3: {
+		"ALTER TABLE account ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT false",
+		// Accounts registered before verification existed must not be locked
+		// out, if verification is required
+		"UPDATE account SET email_verified = true",
+		`CREATE TABLE email_verification (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			email VARCHAR(80) NOT NULL,
+			token_hash VARCHAR(80) UNIQUE NOT NULL,
+			expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+		)`,
+	},
+	4: {
+		`CREATE TABLE email_change (
 			id SERIAL PRIMARY KEY,
-			username VARCHAR(80) UNIQUE NOT NULL,
-			password VARCHAR(80) NOT NULL,
-			email VARCHAR(80) UNIQUE NOT NULL,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			old_email VARCHAR(80) NOT NULL,
+			new_email VARCHAR(80) NOT NULL,
+			token_hash VARCHAR(80) UNIQUE NOT NULL,
+			cancel_token_hash VARCHAR(80) UNIQUE NOT NULL,
+			expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			cancel_expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			confirmed_date TIMESTAMP WITH TIME ZONE,
 			creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
-		)`)
+		)`,
+	},
+	5: {
+		"ALTER TABLE account ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'active'",
+	},
+	6: {
+		`CREATE TABLE account_status_change (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			old_status VARCHAR(20) NOT NULL,
+			new_status VARCHAR(20) NOT NULL,
+			reason VARCHAR(255) NOT NULL,
+			actor_id INTEGER,
+			creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+		)`,
+	},
+	7: {
+		`CREATE TABLE login_session (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			user_agent VARCHAR(255) NOT NULL,
+			ip_address VARCHAR(45) NOT NULL,
+			expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			last_seen_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			revoked_date TIMESTAMP WITH TIME ZONE,
+			creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+		)`,
+	},
+	8: {
+		"ALTER TABLE account ADD COLUMN last_login_date TIMESTAMP WITH TIME ZONE",
+		`CREATE TABLE login_event (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			outcome VARCHAR(20) NOT NULL,
+			failure_reason VARCHAR(40) NOT NULL DEFAULT '',
+			ip_address VARCHAR(45) NOT NULL,
+			user_agent VARCHAR(255) NOT NULL,
+			creation_date TIMESTAMP WITH TIME ZONE NOT NULL
+		)`,
+		"CREATE INDEX login_event_account ON login_event (account_id, creation_date)",
+		"CREATE INDEX login_event_creation ON login_event (creation_date)",
+	},
+	9: {
+		"ALTER TABLE login_event ADD COLUMN new_device BOOLEAN NOT NULL DEFAULT false",
+		`CREATE TABLE known_device (
+			id SERIAL PRIMARY KEY,
+			account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+			fingerprint VARCHAR(64) NOT NULL,
+			description VARCHAR(80) NOT NULL,
+			ip_prefix VARCHAR(50) NOT NULL,
+			report_token_hash VARCHAR(80) UNIQUE NOT NULL,
+			report_expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			last_seen_date TIMESTAMP WITH TIME ZONE NOT NULL,
+			creation_date TIMESTAMP WITH TIME ZONE DEFAULT now(),
+			UNIQUE (account_id, fingerprint)
+		)`,
+	},
+	10: {
+		"ALTER TABLE account ADD COLUMN verification_sent_date TIMESTAMP WITH TIME ZONE",
+	},
+	11: {
+		"ALTER TABLE account ADD COLUMN password_reset_sent_date TIMESTAMP WITH TIME ZONE",
+	},
+	// Emails are stored lower-cased from now on. Accounts whose emails only
+	// differ in case make the migration fail and have to be merged first.
+	12: {
+		"UPDATE account SET email = lower(email) WHERE email <> lower(email)",
+		"UPDATE email_verification SET email = lower(email) WHERE email <> lower(email)",
+		"UPDATE email_change SET old_email = lower(old_email), new_email = lower(new_email)",
+	},
+}
+
+// QueryAll runs the query and calls scan for every resulting row.
+func (ctx PostgresContext) QueryAll(scan func(rows pgx.Rows) error, query string, args ...interface{}) error {
+	pool, err := ctx.querier()
+
+	if err != nil {
+		return err
+	}
+
+	queryContext, finish := ctx.startQuery(query)
+	rows, err := pool.Query(queryContext, query, args...)
+
+	if err == nil {
+		defer rows.Close()
+
+		for rows.Next() && err == nil {
+			err = scan(rows)
+		}
+
+		if err == nil {
+			err = rows.Err()
+		}
+	}
+
+	finish(err)
+
+	if err != nil {
+		ctx.logger().ErrorContext(ctx.requestContext(), "query failed", "query", query, "error", err)
+	}
 
 	return err
 }
 
-func (ctx PostgresContext) InsertAccount(username string, password string, email string, creationDate time.Time) (int, error) {
+func (ctx PostgresContext) CreateSchema() error {
+	for _, statement := range schema {
+		if err := ctx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Migrate creates the schema in an empty database and upgrades the schema of
+// older versions otherwise. All migrations run in one transaction, which locks
+// the version, so concurrent migrations wait for each other.
+func (ctx PostgresContext) Migrate() error {
+	row, err := ctx.Query("SELECT to_regclass('schema_version') IS NOT NULL, to_regclass('account') IS NOT NULL")
+	if err != nil {
+		return err
+	}
+
+	var versioned, populated bool
+	if err := row.Scan(&versioned, &populated); err != nil {
+		return err
+	}
+
+	if !versioned {
+		// Tables of unknown versions must not be dropped by CreateSchema
+		if populated {
+			return errors.New("the database has no schema version")
+		}
+
+		return ctx.CreateSchema()
+	}
+
+	return ctx.Transaction(func(tx *PostgresContext) error {
+		if err := tx.Exec("LOCK TABLE schema_version IN EXCLUSIVE MODE"); err != nil {
+			return err
+		}
+
+		version, err := tx.GetSchemaVersion()
+		if err != nil {
+			return err
+		}
+
+		if version > SchemaVersion {
+			return fmt.Errorf("schema version %d is newer than %d", version, SchemaVersion)
+		}
+
+		for version < SchemaVersion {
+			version++
+
+			statements, ok := migrations[version]
+			if !ok {
+				return fmt.Errorf("no migration to schema version %d", version)
+			}
+
+			for _, statement := range statements {
+				if err := tx.Exec(statement); err != nil {
+					return err
+				}
+			}
+
+			tx.logger().InfoContext(tx.requestContext(), "schema migrated", "version", version)
+		}
+
+		return tx.Exec("UPDATE schema_version SET version = $1", version)
+	})
+}
+
+// Ping checks that a connection to the database can be established.
+func (ctx PostgresContext) Ping() error {
+	pool, err := ctx.Pool()
+
+	if err != nil {
+		return err
+	}
+
+	return pool.Ping(ctx.requestContext())
+}
+
+func (ctx PostgresContext) GetSchemaVersion() (int, error) {
+	row, err := ctx.Query("SELECT version FROM schema_version")
+
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = row.Scan(&version)
+	return version, err
+}
+
+func (ctx PostgresContext) hashPassword(password string) (string, error) {
 	rng := security.RandomGenerator{Reader: rand.Reader}
 	salt, err := rng.GenerateSalt(16)
 
 	if err != nil {
-		return -1, err
+		return "", err
 	}
 
-	passwordHash := security.CreatePasswordHash(password, salt)
-	passwordHashString := base64.StdEncoding.EncodeToString(passwordHash)
+	passwordHash := security.CreatePasswordHashContext(ctx.requestContext(), password, salt)
+	return base64.StdEncoding.EncodeToString(passwordHash), nil
+}
 
-	row, err := ctx.Query("INSERT INTO account (username, password, email, creation_date) VALUES ($1, $2, $3, $4) RETURNING id",
-		username, passwordHashString, email, creationDate)
+func (ctx PostgresContext) InsertAccount(username string, password string, email string, creationDate time.Time) (int, error) {
+	return ctx.InsertAccountWithStatus(username, password, email, AccountActive, creationDate)
+}
+
+func (ctx PostgresContext) InsertAccountWithStatus(username string, password string, email string, status string, creationDate time.Time) (int, error) {
+	passwordHashString, err := ctx.hashPassword(password)
+
+	if err != nil {
+		return -1, err
+	}
+
+	row, err := ctx.Query("INSERT INTO account (username, password, email, status, creation_date) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		username, passwordHashString, email, status, creationDate)
 
 	if err != nil {
 		return -1, err
@@ -103,28 +703,627 @@ func (ctx PostgresContext) InsertAccount(username string, password string, email
 
 	id := -1
 	err = row.Scan(&id)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return -1, ErrAccountExists
+	}
+
 	return id, err
 }
 
 func (ctx PostgresContext) DeleteAccount(accountId int) error {
-	_, err := ctx.Query("DELETE FROM account WHERE id = $1", accountId)
-	return err
+	return ctx.Exec("DELETE FROM account WHERE id = $1", accountId)
 }
 
 func (ctx PostgresContext) DeleteAccountByUsername(username string) error {
-	_, err := ctx.Query("DELETE FROM account WHERE username = $1", username)
-	return err
+	return ctx.Exec("DELETE FROM account WHERE username = $1", username)
+}
+
+const accountColumns = "id, username, password, email, email_verified, role, status, sessions_revoked_date, last_login_date, creation_date"
+
+func scanAccount(row pgx.Row) (Account, error) {
+	var account Account
+	err := row.Scan(&account.Id, &account.Username, &account.Password, &account.Email, &account.EmailVerified, &account.Role,
+		&account.Status, &account.SessionsRevokedDate, &account.LastLoginDate, &account.CreationDate)
+
+	return account, err
 }
 
 func (ctx PostgresContext) GetAccountByUsername(username string) (Account, error) {
-	row, err := ctx.Query("SELECT id, username, password, email, creation_date FROM account WHERE username = $1", username)
+	row, err := ctx.Query("SELECT "+accountColumns+" FROM account WHERE username = $1", username)
 
 	if err != nil {
 		return Account{}, err
 	}
 
-	var account Account
-	err = row.Scan(&account.Id, &account.Username, &account.Password, &account.Email, &account.CreationDate)
+	return scanAccount(row)
+}
 
-	return account, err
+func (ctx PostgresContext) GetAccountByEmail(email string) (Account, error) {
+	row, err := ctx.Query("SELECT "+accountColumns+" FROM account WHERE email = $1", email)
+
+	if err != nil {
+		return Account{}, err
+	}
+
+	return scanAccount(row)
+}
+
+// GetAccountByEmailWithStatus only returns the account of the email, if it has
+// one of the statuses.
+func (ctx PostgresContext) GetAccountByEmailWithStatus(email string, statuses []string) (Account, error) {
+	row, err := ctx.Query("SELECT "+accountColumns+" FROM account WHERE email = $1 AND status = ANY($2)", email, statuses)
+
+	if err != nil {
+		return Account{}, err
+	}
+
+	return scanAccount(row)
+}
+
+func (ctx PostgresContext) GetAccountById(accountId int) (Account, error) {
+	row, err := ctx.Query("SELECT "+accountColumns+" FROM account WHERE id = $1", accountId)
+
+	if err != nil {
+		return Account{}, err
+	}
+
+	return scanAccount(row)
+}
+
+// GetAccounts returns the accounts matching the filter ordered by id. It
+// starts after the id AfterId, so the last id of a page is the cursor of the
+// next one.
+func (ctx PostgresContext) GetAccounts(filter AccountFilter) ([]Account, error) {
+	conditions := []string{"id > $1"}
+	args := []interface{}{filter.AfterId}
+
+	addCondition := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.Search != "" {
+		addCondition("(lower(username) LIKE $%[1]d OR lower(email) LIKE $%[1]d)", likePrefix(strings.ToLower(filter.Search)))
+	}
+
+	if filter.Status != "" {
+		addCondition("status = $%d", filter.Status)
+	}
+
+	if filter.CreatedFrom != nil {
+		addCondition("creation_date >= $%d", *filter.CreatedFrom)
+	}
+
+	if filter.CreatedTo != nil {
+		addCondition("creation_date < $%d", *filter.CreatedTo)
+	}
+
+	args = append(args, filter.Limit)
+	query := fmt.Sprintf("SELECT %s FROM account WHERE %s ORDER BY id LIMIT $%d", accountColumns, strings.Join(conditions, " AND "), len(args))
+
+	accounts := []Account{}
+
+	err := ctx.QueryAll(func(rows pgx.Rows) error {
+		account, err := scanAccount(rows)
+		accounts = append(accounts, account)
+		return err
+	}, query, args...)
+
+	return accounts, err
+}
+
+// likePrefix escapes the wildcards of LIKE, so the value only matches as
+// prefix.
+func likePrefix(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value) + "%"
+}
+
+func (ctx PostgresContext) SetAccountRole(accountId int, role string) error {
+	return ctx.Exec("UPDATE account SET role = $2 WHERE id = $1", accountId, role)
+}
+
+// TransitionAccountStatus changes the status of the account and records the
+// change. It only succeeds if the account still has the status change.OldStatus,
+// so concurrent changes can't skip the check of the transition. Callers check
+// the transition using CanTransition.
+func (ctx PostgresContext) TransitionAccountStatus(change AccountStatusChange) (bool, error) {
+	row, err := ctx.Query(`WITH updated AS (UPDATE account SET status = $3 WHERE id = $1 AND status = $2 RETURNING id)
+		INSERT INTO account_status_change (account_id, old_status, new_status, reason, actor_id)
+		SELECT id, $2, $3, $4, NULLIF($5, 0) FROM updated RETURNING account_id`,
+		change.AccountId, change.OldStatus, change.NewStatus, change.Reason, change.ActorId)
+
+	return updatedRow(row, err)
+}
+
+// GetAccountStatusChanges returns the latest status changes of the account,
+// newest first.
+func (ctx PostgresContext) GetAccountStatusChanges(accountId int, limit int) ([]AccountStatusChange, error) {
+	changes := []AccountStatusChange{}
+
+	err := ctx.QueryAll(func(rows pgx.Rows) error {
+		var change AccountStatusChange
+		err := rows.Scan(&change.Id, &change.AccountId, &change.OldStatus, &change.NewStatus, &change.Reason, &change.ActorId, &change.CreationDate)
+		changes = append(changes, change)
+		return err
+	}, "SELECT id, account_id, old_status, new_status, reason, COALESCE(actor_id, 0), creation_date FROM account_status_change WHERE account_id = $1 ORDER BY id DESC LIMIT $2", accountId, limit)
+
+	return changes, err
+}
+
+func (ctx PostgresContext) UpdateAccountPassword(accountId int, password string) error {
+	passwordHashString, err := ctx.hashPassword(password)
+
+	if err != nil {
+		return err
+	}
+
+	return ctx.Exec("UPDATE account SET password = $2 WHERE id = $1", accountId, passwordHashString)
+}
+
+// RevokeSessions invalidates every token of the account issued before
+// revokedDate, including tokens without a session like impersonation tokens.
+func (ctx PostgresContext) RevokeSessions(accountId int, revokedDate time.Time) error {
+	return ctx.Exec(`WITH revoked AS (UPDATE login_session SET revoked_date = $2 WHERE account_id = $1 AND revoked_date IS NULL)
+		UPDATE account SET sessions_revoked_date = $2 WHERE id = $1`, accountId, revokedDate)
+}
+
+// InsertLoginEvent records a login attempt. Successful logins update the last
+// login of the account as well.
+func (ctx PostgresContext) InsertLoginEvent(event LoginEvent) (int, error) {
+	row, err := ctx.Query(`WITH login AS (UPDATE account SET last_login_date = $7 WHERE id = $1 AND $2 = '`+LoginSucceeded+`')
+		INSERT INTO login_event (account_id, outcome, failure_reason, ip_address, user_agent, new_device, creation_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		event.AccountId, event.Outcome, event.FailureReason, event.IpAddress, event.UserAgent, event.NewDevice, event.CreationDate)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id := -1
+	err = row.Scan(&id)
+	return id, err
+}
+
+// GetLoginEvents returns the latest login attempts of the account, newest
+// first.
+func (ctx PostgresContext) GetLoginEvents(accountId int, limit int) ([]LoginEvent, error) {
+	events := []LoginEvent{}
+
+	err := ctx.QueryAll(func(rows pgx.Rows) error {
+		var event LoginEvent
+		err := rows.Scan(&event.Id, &event.AccountId, &event.Outcome, &event.FailureReason, &event.IpAddress, &event.UserAgent, &event.NewDevice, &event.CreationDate)
+		events = append(events, event)
+		return err
+	}, "SELECT id, account_id, outcome, failure_reason, ip_address, user_agent, new_device, creation_date FROM login_event WHERE account_id = $1 ORDER BY creation_date DESC, id DESC LIMIT $2", accountId, limit)
+
+	return events, err
+}
+
+// DeleteLoginEventsBefore prunes the login history and returns the number of
+// deleted events.
+func (ctx PostgresContext) DeleteLoginEventsBefore(before time.Time) (int, error) {
+	row, err := ctx.Query("WITH deleted AS (DELETE FROM login_event WHERE creation_date < $1 RETURNING id) SELECT count(*) FROM deleted", before)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	err = row.Scan(&deleted)
+	return deleted, err
+}
+
+// RememberDevice records the device or updates its last use, if the account
+// knows it already. It returns true for devices, which are new to an account
+// knowing other devices, so the first login of an account isn't reported. The
+// report token is only stored for new devices.
+func (ctx PostgresContext) RememberDevice(device KnownDevice) (bool, error) {
+	row, err := ctx.Query(`WITH known AS (SELECT count(*) AS devices FROM known_device WHERE account_id = $1),
+		remembered AS (INSERT INTO known_device (account_id, fingerprint, description, ip_prefix, report_token_hash, report_expiration_date, last_seen_date)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (account_id, fingerprint) DO UPDATE SET last_seen_date = EXCLUDED.last_seen_date
+			RETURNING xmax = 0 AS inserted)
+		SELECT remembered.inserted AND known.devices > 0 FROM remembered, known`,
+		device.AccountId, device.Fingerprint, device.Description, device.IpPrefix, device.ReportTokenHash, device.ReportExpirationDate, device.LastSeenDate)
+
+	if err != nil {
+		return false, err
+	}
+
+	var newDevice bool
+	err = row.Scan(&newDevice)
+	return newDevice, err
+}
+
+// ForgetDevice deletes the device reported by the token and returns its
+// account. It returns pgx.ErrNoRows if the token is unknown or expired.
+func (ctx PostgresContext) ForgetDevice(reportTokenHash string, now time.Time) (int, error) {
+	row, err := ctx.Query("DELETE FROM known_device WHERE report_token_hash = $1 AND report_expiration_date > $2 RETURNING account_id", reportTokenHash, now)
+
+	if err != nil {
+		return -1, err
+	}
+
+	accountId := -1
+	err = row.Scan(&accountId)
+	return accountId, err
+}
+
+func (ctx PostgresContext) InsertSession(session Session) (int, error) {
+	row, err := ctx.Query("INSERT INTO login_session (account_id, user_agent, ip_address, expiration_date, last_seen_date, creation_date) VALUES ($1, $2, $3, $4, $5, $5) RETURNING id",
+		session.AccountId, session.UserAgent, session.IpAddress, session.ExpirationDate, session.CreationDate)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id := -1
+	err = row.Scan(&id)
+	return id, err
+}
+
+const sessionColumns = "id, account_id, user_agent, ip_address, expiration_date, last_seen_date, revoked_date, creation_date"
+
+func scanSession(row pgx.Row) (Session, error) {
+	var session Session
+	err := row.Scan(&session.Id, &session.AccountId, &session.UserAgent, &session.IpAddress,
+		&session.ExpirationDate, &session.LastSeenDate, &session.RevokedDate, &session.CreationDate)
+
+	return session, err
+}
+
+func (ctx PostgresContext) GetSessionById(id int) (Session, error) {
+	row, err := ctx.Query("SELECT "+sessionColumns+" FROM login_session WHERE id = $1", id)
+
+	if err != nil {
+		return Session{}, err
+	}
+
+	return scanSession(row)
+}
+
+// GetActiveSessions returns the sessions of the account, which are neither
+// revoked nor expired, most recently seen first.
+func (ctx PostgresContext) GetActiveSessions(accountId int, now time.Time) ([]Session, error) {
+	sessions := []Session{}
+
+	err := ctx.QueryAll(func(rows pgx.Rows) error {
+		session, err := scanSession(rows)
+		sessions = append(sessions, session)
+		return err
+	}, "SELECT "+sessionColumns+" FROM login_session WHERE account_id = $1 AND revoked_date IS NULL AND expiration_date > $2 ORDER BY last_seen_date DESC, id DESC", accountId, now)
+
+	return sessions, err
+}
+
+func (ctx PostgresContext) TouchSession(id int, lastSeenDate time.Time) error {
+	return ctx.Exec("UPDATE login_session SET last_seen_date = $2 WHERE id = $1", id, lastSeenDate)
+}
+
+// RevokeSession returns false if the account has no such active session.
+func (ctx PostgresContext) RevokeSession(accountId int, id int, revokedDate time.Time) (bool, error) {
+	row, err := ctx.Query("UPDATE login_session SET revoked_date = $3 WHERE id = $2 AND account_id = $1 AND revoked_date IS NULL RETURNING id",
+		accountId, id, revokedDate)
+
+	return updatedRow(row, err)
+}
+
+// RevokeOtherSessions revokes every session of the account except the given
+// one.
+func (ctx PostgresContext) RevokeOtherSessions(accountId int, exceptId int, revokedDate time.Time) error {
+	return ctx.Exec("UPDATE login_session SET revoked_date = $3 WHERE account_id = $1 AND id <> $2 AND revoked_date IS NULL",
+		accountId, exceptId, revokedDate)
+}
+
+func (ctx PostgresContext) InsertAuditEvent(event AuditEvent) error {
+	return ctx.Exec("INSERT INTO audit_log (actor_id, account_id, action, impersonation) VALUES ($1, $2, $3, $4)",
+		event.ActorId, event.AccountId, event.Action, event.Impersonation)
+}
+
+// GetAuditEventsByAccount returns the latest events concerning the account,
+// newest first.
+func (ctx PostgresContext) GetAuditEventsByAccount(accountId int, limit int) ([]AuditEvent, error) {
+	events := []AuditEvent{}
+
+	err := ctx.QueryAll(func(rows pgx.Rows) error {
+		var event AuditEvent
+		err := rows.Scan(&event.Id, &event.ActorId, &event.AccountId, &event.Action, &event.Impersonation, &event.CreationDate)
+		events = append(events, event)
+		return err
+	}, "SELECT id, actor_id, account_id, action, impersonation, creation_date FROM audit_log WHERE account_id = $1 ORDER BY id DESC LIMIT $2", accountId, limit)
+
+	return events, err
+}
+
+func (ctx PostgresContext) InsertApiKey(key ApiKey) (int, error) {
+	row, err := ctx.Query("INSERT INTO api_key (account_id, name, prefix, hash, scopes, expiration_date) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		key.AccountId, key.Name, key.Prefix, key.Hash, strings.Join(key.Scopes, " "), key.ExpirationDate)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id := -1
+	err = row.Scan(&id)
+	return id, err
+}
+
+func scanApiKey(row pgx.Row) (ApiKey, error) {
+	var key ApiKey
+	var scopes string
+
+	err := row.Scan(&key.Id, &key.AccountId, &key.Name, &key.Prefix, &key.Hash, &scopes,
+		&key.ExpirationDate, &key.LastUsedDate, &key.Revoked, &key.CreationDate)
+
+	key.Scopes = strings.Fields(scopes)
+	return key, err
+}
+
+func (ctx PostgresContext) GetApiKeyByPrefix(prefix string) (ApiKey, error) {
+	row, err := ctx.Query("SELECT id, account_id, name, prefix, hash, scopes, expiration_date, last_used_date, revoked, creation_date FROM api_key WHERE prefix = $1", prefix)
+
+	if err != nil {
+		return ApiKey{}, err
+	}
+
+	return scanApiKey(row)
+}
+
+func (ctx PostgresContext) GetApiKeysByAccount(accountId int) ([]ApiKey, error) {
+	keys := []ApiKey{}
+
+	err := ctx.QueryAll(func(rows pgx.Rows) error {
+		key, err := scanApiKey(rows)
+		keys = append(keys, key)
+		return err
+	}, "SELECT id, account_id, name, prefix, hash, scopes, expiration_date, last_used_date, revoked, creation_date FROM api_key WHERE account_id = $1 ORDER BY id", accountId)
+
+	return keys, err
+}
+
+func (ctx PostgresContext) RevokeApiKey(accountId int, keyId int) (bool, error) {
+	row, err := ctx.Query("UPDATE api_key SET revoked = true WHERE id = $1 AND account_id = $2 RETURNING id", keyId, accountId)
+
+	return updatedRow(row, err)
+}
+
+// RevokeApiKeys revokes every api key of the account. Keys are not bound to a
+// session, so they have to be revoked whenever the account may be compromised.
+func (ctx PostgresContext) RevokeApiKeys(accountId int) error {
+	return ctx.Exec("UPDATE api_key SET revoked = true WHERE account_id = $1 AND NOT revoked", accountId)
+}
+
+func (ctx PostgresContext) UpdateApiKeyLastUsed(keyId int, lastUsed time.Time) error {
+	return ctx.Exec("UPDATE api_key SET last_used_date = $2 WHERE id = $1", keyId, lastUsed)
+}
+
+func (ctx PostgresContext) InsertDeviceAuthorization(authorization DeviceAuthorization) (int, error) {
+	row, err := ctx.Query("INSERT INTO device_authorization (device_code_hash, user_code, client_id, scope, poll_interval, expiration_date) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		authorization.DeviceCodeHash, authorization.UserCode, authorization.ClientId, authorization.Scope, authorization.PollInterval, authorization.ExpirationDate)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id := -1
+	err = row.Scan(&id)
+	return id, err
+}
+
+func scanDeviceAuthorization(row pgx.Row) (DeviceAuthorization, error) {
+	var authorization DeviceAuthorization
+	var accountId *int
+
+	err := row.Scan(&authorization.Id, &authorization.DeviceCodeHash, &authorization.UserCode, &authorization.ClientId, &authorization.Scope,
+		&accountId, &authorization.Status, &authorization.PollInterval, &authorization.LastPollDate, &authorization.ExpirationDate, &authorization.CreationDate)
+
+	if accountId != nil {
+		authorization.AccountId = *accountId
+	}
+
+	return authorization, err
+}
+
+func (ctx PostgresContext) GetDeviceAuthorizationByDeviceCode(deviceCodeHash string) (DeviceAuthorization, error) {
+	row, err := ctx.Query("SELECT id, device_code_hash, user_code, client_id, scope, account_id, status, poll_interval, last_poll_date, expiration_date, creation_date FROM device_authorization WHERE device_code_hash = $1", deviceCodeHash)
+
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+
+	return scanDeviceAuthorization(row)
+}
+
+func (ctx PostgresContext) GetDeviceAuthorizationByUserCode(userCode string) (DeviceAuthorization, error) {
+	row, err := ctx.Query("SELECT id, device_code_hash, user_code, client_id, scope, account_id, status, poll_interval, last_poll_date, expiration_date, creation_date FROM device_authorization WHERE user_code = $1", userCode)
+
+	if err != nil {
+		return DeviceAuthorization{}, err
+	}
+
+	return scanDeviceAuthorization(row)
+}
+
+// DecideDeviceAuthorization approves or denies a pending authorization. It
+// returns false if the authorization was not pending anymore.
+func (ctx PostgresContext) DecideDeviceAuthorization(id int, accountId int, status string) (bool, error) {
+	row, err := ctx.Query("UPDATE device_authorization SET account_id = $2, status = $3 WHERE id = $1 AND status = 'pending' RETURNING id", id, accountId, status)
+
+	return updatedRow(row, err)
+}
+
+func (ctx PostgresContext) UpdateDeviceAuthorizationPoll(id int, lastPoll time.Time, pollInterval int) error {
+	return ctx.Exec("UPDATE device_authorization SET last_poll_date = $2, poll_interval = $3 WHERE id = $1", id, lastPoll, pollInterval)
+}
+
+// RedeemDeviceAuthorization makes sure an approved authorization is exchanged
+// for a token only once.
+func (ctx PostgresContext) RedeemDeviceAuthorization(id int) (bool, error) {
+	row, err := ctx.Query("UPDATE device_authorization SET status = 'redeemed' WHERE id = $1 AND status = 'approved' RETURNING id", id)
+
+	return updatedRow(row, err)
+}
+
+// InsertPasswordReset stores the reset, unless the last one of the account was
+// sent after sentBefore. Like InsertEmailVerification, it returns whether it
+// was stored.
+func (ctx PostgresContext) InsertPasswordReset(reset PasswordReset, now time.Time, sentBefore time.Time) (bool, error) {
+	row, err := ctx.Query(`WITH throttle AS (
+			UPDATE account SET password_reset_sent_date = $4
+			WHERE id = $1 AND (password_reset_sent_date IS NULL OR password_reset_sent_date <= $5)
+			RETURNING id)
+		INSERT INTO password_reset (account_id, token_hash, expiration_date)
+		SELECT id, $2, $3 FROM throttle RETURNING id`,
+		reset.AccountId, reset.TokenHash, reset.ExpirationDate, now, sentBefore)
+
+	return updatedRow(row, err)
+}
+
+// RedeemPasswordReset marks an unused and unexpired reset as used and returns
+// its account. Invalid tokens result in pgx.ErrNoRows.
+func (ctx PostgresContext) RedeemPasswordReset(tokenHash string, usedDate time.Time) (int, error) {
+	row, err := ctx.Query("UPDATE password_reset SET used_date = $2 WHERE token_hash = $1 AND used_date IS NULL AND expiration_date > $2 RETURNING account_id", tokenHash, usedDate)
+
+	if err != nil {
+		return -1, err
+	}
+
+	accountId := -1
+	err = row.Scan(&accountId)
+	return accountId, err
+}
+
+// DeletePasswordResets removes the resets of the account, so links sent
+// before a successful reset can't be used anymore.
+func (ctx PostgresContext) DeletePasswordResets(accountId int) error {
+	return ctx.Exec("DELETE FROM password_reset WHERE account_id = $1", accountId)
+}
+
+// DeleteEmailVerifications removes the pending verifications of the account.
+func (ctx PostgresContext) DeleteEmailVerifications(accountId int) error {
+	return ctx.Exec("DELETE FROM email_verification WHERE account_id = $1", accountId)
+}
+
+// InsertEmailVerification stores the verification, unless the last one of the
+// account was sent after sentBefore. It returns whether it was stored. The date
+// of the last one is kept in the account, whose row lock serializes concurrent
+// requests.
+func (ctx PostgresContext) InsertEmailVerification(verification EmailVerification, now time.Time, sentBefore time.Time) (bool, error) {
+	row, err := ctx.Query(`WITH throttle AS (
+			UPDATE account SET verification_sent_date = $5
+			WHERE id = $1 AND (verification_sent_date IS NULL OR verification_sent_date <= $6)
+			RETURNING id)
+		INSERT INTO email_verification (account_id, email, token_hash, expiration_date)
+		SELECT id, $2, $3, $4 FROM throttle RETURNING id`,
+		verification.AccountId, verification.Email, verification.TokenHash, verification.ExpirationDate, now, sentBefore)
+
+	return updatedRow(row, err)
+}
+
+// RedeemEmailVerification deletes the verification, so it can only be used
+// once. Invalid or expired tokens result in pgx.ErrNoRows.
+func (ctx PostgresContext) RedeemEmailVerification(tokenHash string, now time.Time) (EmailVerification, error) {
+	row, err := ctx.Query("DELETE FROM email_verification WHERE token_hash = $1 AND expiration_date > $2 RETURNING id, account_id, email, token_hash, expiration_date, creation_date", tokenHash, now)
+
+	if err != nil {
+		return EmailVerification{}, err
+	}
+
+	var verification EmailVerification
+	err = row.Scan(&verification.Id, &verification.AccountId, &verification.Email, &verification.TokenHash, &verification.ExpirationDate, &verification.CreationDate)
+
+	return verification, err
+}
+
+// VerifyEmail marks the email of the account as verified. It returns false if
+// the account has another email by now.
+func (ctx PostgresContext) VerifyEmail(accountId int, email string) (bool, error) {
+	row, err := ctx.Query("UPDATE account SET email_verified = true WHERE id = $1 AND email = $2 RETURNING id", accountId, email)
+
+	return updatedRow(row, err)
+}
+
+// InsertEmailChange replaces the unconfirmed change of the account, so only
+// the link sent last can be confirmed.
+func (ctx PostgresContext) InsertEmailChange(change EmailChange) (int, error) {
+	row, err := ctx.Query(`WITH pending AS (DELETE FROM email_change WHERE account_id = $1 AND confirmed_date IS NULL)
+		INSERT INTO email_change (account_id, old_email, new_email, token_hash, cancel_token_hash, expiration_date, cancel_expiration_date)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		change.AccountId, change.OldEmail, change.NewEmail, change.TokenHash, change.CancelTokenHash, change.ExpirationDate, change.CancelExpirationDate)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id := -1
+	err = row.Scan(&id)
+	return id, err
+}
+
+// ConfirmEmailChange sets the new email of the account, which is verified by
+// the confirmation. The change is kept, so it can still be cancelled.
+// Invalid tokens and accounts whose email changed in the meantime result in
+// pgx.ErrNoRows, emails taken by another account in ErrAccountExists. Either
+// way the token stays unused.
+func (ctx PostgresContext) ConfirmEmailChange(tokenHash string, now time.Time) (int, error) {
+	row, err := ctx.Query(`WITH change AS (
+			UPDATE email_change SET confirmed_date = $2
+			WHERE token_hash = $1 AND confirmed_date IS NULL AND expiration_date > $2
+				AND EXISTS (SELECT 1 FROM account WHERE account.id = email_change.account_id AND account.email = email_change.old_email)
+			RETURNING account_id, old_email, new_email)
+		UPDATE account SET email = change.new_email, email_verified = true FROM change
+		WHERE account.id = change.account_id AND account.email = change.old_email
+		RETURNING account.id`, tokenHash, now)
+
+	return scanEmailChangeAccount(row, err)
+}
+
+// CancelEmailChange deletes the change and restores the old email, if the
+// change was confirmed already. It returns the account of the change or
+// pgx.ErrNoRows, if the token is invalid.
+func (ctx PostgresContext) CancelEmailChange(cancelTokenHash string, now time.Time) (int, error) {
+	row, err := ctx.Query(`WITH change AS (
+			DELETE FROM email_change
+			WHERE cancel_token_hash = $1 AND cancel_expiration_date > $2
+			RETURNING account_id, old_email, new_email, confirmed_date),
+		restored AS (
+			UPDATE account SET email = change.old_email, email_verified = true FROM change
+			WHERE account.id = change.account_id AND change.confirmed_date IS NOT NULL AND account.email = change.new_email
+			RETURNING account.id)
+		SELECT account_id FROM change`, cancelTokenHash, now)
+
+	return scanEmailChangeAccount(row, err)
+}
+
+func scanEmailChangeAccount(row pgx.Row, err error) (int, error) {
+	if err != nil {
+		return -1, err
+	}
+
+	accountId := -1
+	err = row.Scan(&accountId)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return -1, ErrAccountExists
+	}
+
+	return accountId, err
+}
+
+func updatedRow(row pgx.Row, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+
+	var id int
+	if err := row.Scan(&id); err == pgx.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
@@ -3,9 +3,11 @@ package database
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -37,6 +39,173 @@ func TestDatabaseCreateSchema(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestDatabaseSchemaVersion(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+	version, err := db.GetSchemaVersion()
+
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, version)
+}
+
+// schemaVersion1 is the first versioned schema, which all migrations start
+// from.
+var schemaVersion1 = []string{
+	`CREATE TABLE account (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(80) UNIQUE NOT NULL,
+		password VARCHAR(80) NOT NULL,
+		email VARCHAR(80) UNIQUE NOT NULL,
+		role VARCHAR(20) NOT NULL DEFAULT 'user',
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE audit_log (
+		id SERIAL PRIMARY KEY,
+		actor_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL,
+		action VARCHAR(80) NOT NULL,
+		impersonation BOOLEAN NOT NULL DEFAULT false,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE api_key (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+		name VARCHAR(80) NOT NULL,
+		prefix VARCHAR(20) UNIQUE NOT NULL,
+		hash VARCHAR(80) NOT NULL,
+		scopes VARCHAR(255) NOT NULL DEFAULT '',
+		expiration_date TIMESTAMP WITH TIME ZONE,
+		last_used_date TIMESTAMP WITH TIME ZONE,
+		revoked BOOLEAN NOT NULL DEFAULT false,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	`CREATE TABLE device_authorization (
+		id SERIAL PRIMARY KEY,
+		device_code_hash VARCHAR(80) UNIQUE NOT NULL,
+		user_code VARCHAR(20) UNIQUE NOT NULL,
+		client_id VARCHAR(80) NOT NULL,
+		scope VARCHAR(255) NOT NULL DEFAULT '',
+		account_id INTEGER REFERENCES account(id) ON DELETE CASCADE,
+		status VARCHAR(20) NOT NULL DEFAULT 'pending',
+		poll_interval INTEGER NOT NULL,
+		last_poll_date TIMESTAMP WITH TIME ZONE,
+		expiration_date TIMESTAMP WITH TIME ZONE NOT NULL,
+		creation_date TIMESTAMP WITH TIME ZONE DEFAULT now()
+	)`,
+	"CREATE TABLE schema_version (version INTEGER NOT NULL)",
+	"INSERT INTO schema_version (version) VALUES (1)",
+}
+
+// dropSchema drops every table of the schema, so a schema can be created from
+// scratch.
+func dropSchema(t *testing.T, db *PostgresContext) {
+	for _, statement := range schema {
+		if strings.HasPrefix(statement, "DROP TABLE") {
+			if err := db.Exec(statement); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// schemaColumns describes the columns of all tables like account.id integer.
+func schemaColumns(t *testing.T, db *PostgresContext) []string {
+	var columns []string
+
+	err := db.QueryAll(func(rows pgx.Rows) error {
+		var table, column, dataType, nullable string
+		var defaultValue *string
+
+		if err := rows.Scan(&table, &column, &dataType, &nullable, &defaultValue); err != nil {
+			return err
+		}
+
+		description := table + "." + column + " " + dataType + " " + nullable
+		if defaultValue != nil {
+			description += " " + *defaultValue
+		}
+
+		columns = append(columns, description)
+		return nil
+	}, `SELECT table_name, column_name, data_type, is_nullable, column_default FROM information_schema.columns
+		WHERE table_schema = 'public' ORDER BY table_name, column_name`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return columns
+}
+
+func TestDatabaseMigrate(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+	defer db.CreateSchema()
+
+	if err := db.CreateSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := schemaColumns(t, db)
+
+	// Migrating the current version changes nothing
+	assert.Nil(t, db.Migrate())
+	assert.Equal(t, expected, schemaColumns(t, db))
+
+	dropSchema(t, db)
+	for _, statement := range schemaVersion1 {
+		if err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Exec("INSERT INTO account (username, password, email) VALUES ('olduser', 'hash', 'OldUser@test.com')"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, db.Migrate())
+	assert.Equal(t, expected, schemaColumns(t, db))
+
+	version, err := db.GetSchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, version)
+
+	acc, err := db.GetAccountByUsername("olduser")
+	assert.Nil(t, err)
+	assert.Equal(t, AccountActive, acc.Status)
+	assert.True(t, acc.EmailVerified)
+	assert.Equal(t, "olduser@test.com", acc.Email)
+
+	// Empty databases get the current schema
+	dropSchema(t, db)
+	db.Exec("DROP TABLE IF EXISTS schema_version")
+
+	assert.Nil(t, db.Migrate())
+	assert.Equal(t, expected, schemaColumns(t, db))
+}
+
+func TestDatabaseMigrateUnversioned(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+	defer db.CreateSchema()
+
+	if err := db.Exec("DROP TABLE IF EXISTS schema_version"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tables are kept
+	assert.NotNil(t, db.Migrate())
+	assert.Nil(t, db.Exec("SELECT 1 FROM account"))
+}
+
+func TestDatabaseMigrationsComplete(t *testing.T) {
+	for version := 2; version <= SchemaVersion; version++ {
+		assert.NotEmpty(t, migrations[version], "no migration to version %d", version)
+	}
+}
+
+func TestDatabasePing(t *testing.T) {
+	assert.Nil(t, NewContext("localhost", 5432, "test", "test", "test").Ping())
+	assert.NotNil(t, NewContext("localhost", 5432, "test", "wrongpassword", "test").Ping())
+}
+
 func TestDatabaseQueryBadConnection(t *testing.T) {
 	db := NewContext("localhost", 5432, "test", "wrongpassword", "test")
 	_, err := db.Query("SELECT * FROM account")
@@ -134,6 +303,636 @@ func TestDatabaseGetAccountByUsername(t *testing.T) {
 	assert.True(t, acc.CreationDate.Before(time.Now()))
 }
 
+func TestDatabaseGetAccountById(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	id, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(id)
+
+	if err = db.SetAccountRole(id, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err := db.GetAccountById(id)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "testuser", acc.Username)
+	assert.Equal(t, RoleAdmin, acc.Role)
+}
+
+func TestDatabaseGetAccountByEmailWithStatus(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	id, err := db.InsertAccountWithStatus("testuser", "testpass", "testuser@test.com", AccountDisabled, time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(id)
+
+	acc, err := db.GetAccountByEmailWithStatus("testuser@test.com", []string{AccountActive, AccountDisabled})
+	assert.Nil(t, err)
+	assert.Equal(t, id, acc.Id)
+
+	_, err = db.GetAccountByEmailWithStatus("testuser@test.com", []string{AccountActive})
+	assert.Equal(t, pgx.ErrNoRows, err)
+}
+
+func TestDatabaseInsertAuditEvent(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+	err := db.InsertAuditEvent(AuditEvent{ActorId: 1, AccountId: 2, Action: "impersonate", Impersonation: true})
+
+	assert.Nil(t, err)
+}
+
+func TestDatabaseApiKeys(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	keyId, err := db.InsertApiKey(ApiKey{AccountId: accountId, Name: "ci", Prefix: "0123456789ab", Hash: "hash", Scopes: []string{"account:read", "admin"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.UpdateApiKeyLastUsed(keyId, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := db.GetApiKeyByPrefix("0123456789ab")
+
+	assert.Nil(t, err)
+	assert.Equal(t, keyId, key.Id)
+	assert.Equal(t, []string{"account:read", "admin"}, key.Scopes)
+	assert.Nil(t, key.ExpirationDate)
+	assert.NotNil(t, key.LastUsedDate)
+
+	revoked, err := db.RevokeApiKey(accountId+1, keyId)
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	revoked, err = db.RevokeApiKey(accountId, keyId)
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+
+	keys, err := db.GetApiKeysByAccount(accountId)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+	assert.True(t, keys[0].Revoked)
+
+	otherKeyId, err := db.InsertApiKey(ApiKey{AccountId: accountId, Name: "other", Prefix: "ba9876543210", Hash: "hash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, db.RevokeApiKeys(accountId))
+
+	key, err = db.GetApiKeyByPrefix("ba9876543210")
+
+	assert.Nil(t, err)
+	assert.Equal(t, otherKeyId, key.Id)
+	assert.True(t, key.Revoked)
+}
+
+func TestDatabaseDeviceAuthorization(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	id, err := db.InsertDeviceAuthorization(DeviceAuthorization{
+		DeviceCodeHash: "hash",
+		UserCode:       "BCDF-GHJK",
+		ClientId:       "cli",
+		PollInterval:   5,
+		ExpirationDate: time.Now().Add(time.Minute),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authorization, err := db.GetDeviceAuthorizationByUserCode("BCDF-GHJK")
+	assert.Nil(t, err)
+	assert.Equal(t, id, authorization.Id)
+	assert.Equal(t, DeviceAuthorizationPending, authorization.Status)
+	assert.Equal(t, 0, authorization.AccountId)
+
+	redeemed, err := db.RedeemDeviceAuthorization(id)
+	assert.Nil(t, err)
+	assert.False(t, redeemed)
+
+	decided, err := db.DecideDeviceAuthorization(id, accountId, DeviceAuthorizationApproved)
+	assert.Nil(t, err)
+	assert.True(t, decided)
+
+	decided, err = db.DecideDeviceAuthorization(id, accountId, DeviceAuthorizationDenied)
+	assert.Nil(t, err)
+	assert.False(t, decided)
+
+	redeemed, err = db.RedeemDeviceAuthorization(id)
+	assert.Nil(t, err)
+	assert.True(t, redeemed)
+
+	authorization, err = db.GetDeviceAuthorizationByDeviceCode("hash")
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, authorization.AccountId)
+	assert.Equal(t, DeviceAuthorizationRedeemed, authorization.Status)
+}
+
+func TestDatabasePasswordReset(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	account, err := db.GetAccountByEmail("testuser@test.com")
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, account.Id)
+	assert.Nil(t, account.SessionsRevokedDate)
+
+	stored, err := db.InsertPasswordReset(PasswordReset{AccountId: accountId, TokenHash: "expired", ExpirationDate: time.Now().Add(-time.Minute)}, time.Now(), time.Now())
+	assert.Nil(t, err)
+	assert.True(t, stored)
+	stored, err = db.InsertPasswordReset(PasswordReset{AccountId: accountId, TokenHash: "hash", ExpirationDate: time.Now().Add(time.Minute)}, time.Now(), time.Now())
+	assert.Nil(t, err)
+	assert.True(t, stored)
+
+	// Another reset within the interval is not stored
+	stored, err = db.InsertPasswordReset(PasswordReset{AccountId: accountId, TokenHash: "throttled", ExpirationDate: time.Now().Add(time.Minute)}, time.Now(), time.Now().Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, stored)
+
+	_, err = db.RedeemPasswordReset("expired", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+
+	redeemedId, err := db.RedeemPasswordReset("hash", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, redeemedId)
+
+	_, err = db.RedeemPasswordReset("hash", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+
+	assert.Nil(t, db.UpdateAccountPassword(accountId, "newpass"))
+	assert.Nil(t, db.RevokeSessions(accountId, time.Now()))
+	assert.Nil(t, db.DeletePasswordResets(accountId))
+
+	account, err = db.GetAccountById(accountId)
+	assert.Nil(t, err)
+	assert.NotNil(t, account.SessionsRevokedDate)
+}
+
+func TestDatabaseEmailVerification(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	now := time.Now()
+	stored, err := db.InsertEmailVerification(EmailVerification{AccountId: accountId, Email: "testuser@test.com", TokenHash: "hash", ExpirationDate: now.Add(time.Minute)}, now, now.Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, stored)
+
+	// Another verification within the interval is not stored
+	stored, err = db.InsertEmailVerification(EmailVerification{AccountId: accountId, Email: "testuser@test.com", TokenHash: "other", ExpirationDate: now.Add(time.Minute)}, now, now.Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, stored)
+
+	verification, err := db.RedeemEmailVerification("hash", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, verification.AccountId)
+	assert.Equal(t, "testuser@test.com", verification.Email)
+
+	_, err = db.RedeemEmailVerification("hash", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+
+	verified, err := db.VerifyEmail(accountId, "other@test.com")
+	assert.Nil(t, err)
+	assert.False(t, verified)
+
+	verified, err = db.VerifyEmail(accountId, "testuser@test.com")
+	assert.Nil(t, err)
+	assert.True(t, verified)
+
+	account, err := db.GetAccountById(accountId)
+	assert.Nil(t, err)
+	assert.True(t, account.EmailVerified)
+
+	stored, err = db.InsertEmailVerification(EmailVerification{AccountId: accountId, Email: "testuser@test.com", TokenHash: "hash", ExpirationDate: time.Now().Add(time.Minute)}, time.Now(), time.Now())
+	assert.Nil(t, err)
+	assert.True(t, stored)
+	assert.Nil(t, db.DeleteEmailVerifications(accountId))
+
+	_, err = db.RedeemEmailVerification("hash", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+}
+
+func TestDatabaseEmailChange(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	change := EmailChange{
+		AccountId:            accountId,
+		OldEmail:             "testuser@test.com",
+		NewEmail:             "new@test.com",
+		TokenHash:            "hash",
+		CancelTokenHash:      "cancelhash",
+		ExpirationDate:       time.Now().Add(time.Minute),
+		CancelExpirationDate: time.Now().Add(time.Hour),
+	}
+
+	_, err = db.InsertEmailChange(change)
+	assert.Nil(t, err)
+
+	confirmedId, err := db.ConfirmEmailChange("hash", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, confirmedId)
+
+	_, err = db.ConfirmEmailChange("hash", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+
+	account, _ := db.GetAccountById(accountId)
+	assert.Equal(t, "new@test.com", account.Email)
+	assert.True(t, account.EmailVerified)
+
+	cancelledId, err := db.CancelEmailChange("cancelhash", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, cancelledId)
+
+	account, _ = db.GetAccountById(accountId)
+	assert.Equal(t, "testuser@test.com", account.Email)
+
+	_, err = db.CancelEmailChange("cancelhash", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+}
+
+func TestDatabaseEmailChangeTaken(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	otherId, err := db.InsertAccount("otheruser", "otherpass", "other@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(otherId)
+
+	_, err = db.InsertEmailChange(EmailChange{
+		AccountId:            accountId,
+		OldEmail:             "testuser@test.com",
+		NewEmail:             "other@test.com",
+		TokenHash:            "hash",
+		CancelTokenHash:      "cancelhash",
+		ExpirationDate:       time.Now().Add(time.Minute),
+		CancelExpirationDate: time.Now().Add(time.Hour),
+	})
+	assert.Nil(t, err)
+
+	_, err = db.ConfirmEmailChange("hash", time.Now())
+	assert.Equal(t, ErrAccountExists, err)
+}
+
+func TestDatabaseEmailChangeStale(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	_, err = db.InsertEmailChange(EmailChange{
+		AccountId:            accountId,
+		OldEmail:             "previous@test.com",
+		NewEmail:             "new@test.com",
+		TokenHash:            "hash",
+		CancelTokenHash:      "cancelhash",
+		ExpirationDate:       time.Now().Add(time.Minute),
+		CancelExpirationDate: time.Now().Add(time.Hour),
+	})
+	assert.Nil(t, err)
+
+	// The email changed in the meantime, which doesn't spend the token
+	_, err = db.ConfirmEmailChange("hash", time.Now())
+	assert.Equal(t, pgx.ErrNoRows, err)
+
+	var confirmed bool
+	row, _ := db.Query("SELECT confirmed_date IS NOT NULL FROM email_change WHERE token_hash = $1", "hash")
+	assert.Nil(t, row.Scan(&confirmed))
+	assert.False(t, confirmed)
+}
+
+func TestDatabaseGetAccounts(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	var ids []int
+	for _, username := range []string{"listuser_a", "listuser_b", "listuserc"} {
+		id, err := db.InsertAccount(username, "testpass", username+"@test.com", time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer db.DeleteAccount(id)
+		ids = append(ids, id)
+	}
+
+	accounts, err := db.GetAccounts(AccountFilter{Search: "LISTUSER", Limit: 2})
+	assert.Nil(t, err)
+	assert.Len(t, accounts, 2)
+	assert.Equal(t, ids[0], accounts[0].Id)
+
+	accounts, _ = db.GetAccounts(AccountFilter{Search: "listuser", AfterId: accounts[1].Id, Limit: 2})
+	assert.Len(t, accounts, 1)
+	assert.Equal(t, ids[2], accounts[0].Id)
+
+	// The underscore is no wildcard
+	accounts, _ = db.GetAccounts(AccountFilter{Search: "listuser_", Limit: 10})
+	assert.Len(t, accounts, 2)
+
+	updated, err := db.TransitionAccountStatus(AccountStatusChange{AccountId: ids[1], OldStatus: AccountActive, NewStatus: AccountDisabled, Reason: "test"})
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	accounts, _ = db.GetAccounts(AccountFilter{Search: "listuser", Status: AccountDisabled, Limit: 10})
+	assert.Len(t, accounts, 1)
+	assert.Equal(t, AccountDisabled, accounts[0].Status)
+
+	tomorrow := time.Now().Add(24 * time.Hour)
+	accounts, _ = db.GetAccounts(AccountFilter{Search: "listuser", CreatedFrom: &tomorrow, Limit: 10})
+	assert.Len(t, accounts, 0)
+}
+
+func TestDatabaseTransitionAccountStatus(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccountWithStatus("statususer", "testpass", "statususer@test.com", AccountPending, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	acc, _ := db.GetAccountById(accountId)
+	assert.Equal(t, AccountPending, acc.Status)
+
+	updated, err := db.TransitionAccountStatus(AccountStatusChange{AccountId: accountId, OldStatus: AccountPending, NewStatus: AccountActive, Reason: "email verified"})
+	assert.Nil(t, err)
+	assert.True(t, updated)
+
+	// The account is no longer pending
+	updated, err = db.TransitionAccountStatus(AccountStatusChange{AccountId: accountId, OldStatus: AccountPending, NewStatus: AccountDisabled, Reason: "stale"})
+	assert.Nil(t, err)
+	assert.False(t, updated)
+
+	updated, _ = db.TransitionAccountStatus(AccountStatusChange{AccountId: accountId, OldStatus: AccountActive, NewStatus: AccountLocked, Reason: "suspicious", ActorId: accountId})
+	assert.True(t, updated)
+
+	changes, err := db.GetAccountStatusChanges(accountId, 10)
+	assert.Nil(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, AccountLocked, changes[0].NewStatus)
+	assert.Equal(t, "suspicious", changes[0].Reason)
+	assert.Equal(t, accountId, changes[0].ActorId)
+	assert.Equal(t, AccountPending, changes[1].OldStatus)
+	assert.Equal(t, 0, changes[1].ActorId)
+}
+
+func TestDatabaseSessions(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("sessionuser", "testpass", "sessionuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	now := time.Now()
+	session := Session{AccountId: accountId, UserAgent: "curl/8.0", IpAddress: "127.0.0.1", ExpirationDate: now.Add(time.Hour), CreationDate: now}
+
+	firstId, err := db.InsertSession(session)
+	assert.Nil(t, err)
+	secondId, _ := db.InsertSession(session)
+
+	session.ExpirationDate = now.Add(-time.Minute)
+	db.InsertSession(session)
+
+	sessions, err := db.GetActiveSessions(accountId, now)
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, "curl/8.0", sessions[0].UserAgent)
+
+	assert.Nil(t, db.TouchSession(firstId, now.Add(time.Minute)))
+	sessions, _ = db.GetActiveSessions(accountId, now)
+	assert.Equal(t, firstId, sessions[0].Id)
+
+	assert.Nil(t, db.RevokeOtherSessions(accountId, firstId, now))
+	sessions, _ = db.GetActiveSessions(accountId, now)
+	assert.Len(t, sessions, 1)
+
+	revoked, err := db.RevokeSession(accountId, secondId, now)
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	revoked, _ = db.RevokeSession(accountId+1, firstId, now)
+	assert.False(t, revoked)
+
+	assert.Nil(t, db.RevokeSessions(accountId, now))
+	revokedSession, _ := db.GetSessionById(firstId)
+	assert.NotNil(t, revokedSession.RevokedDate)
+}
+
+func TestDatabaseLoginEvents(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("historyuser", "testpass", "historyuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	now := time.Now()
+	_, err = db.InsertLoginEvent(LoginEvent{AccountId: accountId, Outcome: LoginFailed, FailureReason: "wrong_password", IpAddress: "127.0.0.1", CreationDate: now.Add(-time.Hour)})
+	assert.Nil(t, err)
+
+	acc, _ := db.GetAccountById(accountId)
+	assert.Nil(t, acc.LastLoginDate)
+
+	db.InsertLoginEvent(LoginEvent{AccountId: accountId, Outcome: LoginSucceeded, IpAddress: "127.0.0.1", CreationDate: now})
+
+	acc, _ = db.GetAccountById(accountId)
+	assert.NotNil(t, acc.LastLoginDate)
+
+	events, err := db.GetLoginEvents(accountId, 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	assert.Equal(t, LoginSucceeded, events[0].Outcome)
+	assert.Equal(t, "wrong_password", events[1].FailureReason)
+
+	deleted, err := db.DeleteLoginEventsBefore(now.Add(-time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestDatabaseKnownDevices(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("deviceuser", "testpass", "deviceuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	now := time.Now()
+	device := KnownDevice{AccountId: accountId, Fingerprint: "laptop", Description: "Firefox on Linux", IpPrefix: "127.0.0.0/24",
+		ReportTokenHash: "laptophash", ReportExpirationDate: now.Add(time.Hour), LastSeenDate: now}
+
+	// The first device is not new
+	newDevice, err := db.RememberDevice(device)
+	assert.Nil(t, err)
+	assert.False(t, newDevice)
+
+	device.ReportTokenHash = "laptophash2"
+	newDevice, _ = db.RememberDevice(device)
+	assert.False(t, newDevice)
+
+	device.Fingerprint = "phone"
+	device.ReportTokenHash = "phonehash"
+	newDevice, _ = db.RememberDevice(device)
+	assert.True(t, newDevice)
+
+	// Only the token of new devices is stored
+	_, err = db.ForgetDevice("laptophash2", now)
+	assert.Equal(t, pgx.ErrNoRows, err)
+
+	reportedId, err := db.ForgetDevice("phonehash", now)
+	assert.Nil(t, err)
+	assert.Equal(t, accountId, reportedId)
+
+	newDevice, _ = db.RememberDevice(device)
+	assert.True(t, newDevice)
+}
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, CanTransition(AccountPending, AccountActive))
+	assert.True(t, CanTransition(AccountLocked, AccountActive))
+	assert.False(t, CanTransition(AccountPending, AccountLocked))
+	assert.False(t, CanTransition(AccountActive, AccountActive))
+	assert.False(t, CanTransition(AccountDeleted, AccountActive))
+	assert.False(t, CanTransition("unknown", AccountActive))
+}
+
+func TestDatabaseInsertAccountExists(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	_, err = db.InsertAccount("testuser", "testpass", "other@test.com", time.Now())
+	assert.Equal(t, ErrAccountExists, err)
+}
+
+func TestDatabaseTransaction(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "test", "test")
+
+	accountId, err := db.InsertAccount("testuser", "testpass", "testuser@test.com", time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.DeleteAccount(accountId)
+
+	failure := errors.New("failure")
+	err = db.Transaction(func(tx *PostgresContext) error {
+		if err := tx.SetAccountRole(accountId, RoleAdmin); err != nil {
+			return err
+		}
+
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	account, err := db.GetAccountById(accountId)
+	assert.Nil(t, err)
+	assert.Equal(t, RoleUser, account.Role)
+
+	err = db.Transaction(func(tx *PostgresContext) error {
+		return tx.SetAccountRole(accountId, RoleAdmin)
+	})
+	assert.Nil(t, err)
+
+	account, err = db.GetAccountById(accountId)
+	assert.Nil(t, err)
+	assert.Equal(t, RoleAdmin, account.Role)
+}
+
+func TestDatabaseTransactionBadConnection(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "wrongpassword", "test")
+	err := db.Transaction(func(tx *PostgresContext) error {
+		return nil
+	})
+
+	assert.NotNil(t, err)
+}
+
+func TestDatabaseQueryAllBadConnection(t *testing.T) {
+	db := NewContext("localhost", 5432, "test", "wrongpassword", "test")
+	_, err := db.GetApiKeysByAccount(1)
+
+	assert.NotNil(t, err)
+}
+
 func TestDatabaseGetAccountByUsernameBadConnection(t *testing.T) {
 	db := NewContext("localhost", 5432, "test", "wrongpassword", "test")
 
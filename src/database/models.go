@@ -12,10 +12,206 @@ type DatabaseConfig struct {
 	Database string `yaml:"database"`
 }
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Only active accounts can log in. Pending accounts wait for their email to
+// be verified, locked ones are blocked temporarily, disabled ones until an
+// admin enables them again. Deleted accounts are kept, but can never be used
+// again.
+const (
+	AccountPending  = "pending"
+	AccountActive   = "active"
+	AccountLocked   = "locked"
+	AccountDisabled = "disabled"
+	AccountDeleted  = "deleted"
+)
+
+var AccountStatuses = []string{AccountPending, AccountActive, AccountLocked, AccountDisabled, AccountDeleted}
+
+// accountTransitions lists the statuses every status can change to.
+var accountTransitions = map[string][]string{
+	AccountPending:  {AccountActive, AccountDisabled, AccountDeleted},
+	AccountActive:   {AccountLocked, AccountDisabled, AccountDeleted},
+	AccountLocked:   {AccountActive, AccountDisabled, AccountDeleted},
+	AccountDisabled: {AccountActive, AccountDeleted},
+}
+
+// CanTransition tells whether an account may change from one status to the
+// other.
+func CanTransition(from string, to string) bool {
+	for _, status := range accountTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
 type Account struct {
+	Id       int
+	Username string
+	Password string
+	Email    string
+	// EmailVerified is set once the owner of Email confirmed it
+	EmailVerified bool
+	Role          string
+	// Status is one of the Account constants, only active accounts can log in
+	Status string
+	// SessionsRevokedDate invalidates all tokens issued before it
+	SessionsRevokedDate *time.Time
+	// LastLoginDate is nil until the first successful login
+	LastLoginDate *time.Time
+	CreationDate  time.Time
+}
+
+// AccountFilter selects accounts for GetAccounts. Empty fields don't filter.
+type AccountFilter struct {
+	// Search matches the beginning of the username or email, ignoring case
+	Search      string
+	Status      string
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	AfterId     int
+	Limit       int
+}
+
+// AccountStatusChange records a transition of the status of an account.
+// ActorId is 0 for changes made by the service itself.
+type AccountStatusChange struct {
 	Id           int
-	Username     string
-	Password     string
-	Email        string
+	AccountId    int
+	OldStatus    string
+	NewStatus    string
+	Reason       string
+	ActorId      int
+	CreationDate time.Time
+}
+
+const (
+	LoginSucceeded = "success"
+	LoginFailed    = "failure"
+)
+
+// LoginEvent is an attempt to log in to an existing account. FailureReason is
+// empty for successful logins.
+type LoginEvent struct {
+	Id            int
+	AccountId     int
+	Outcome       string
+	FailureReason string
+	IpAddress     string
+	UserAgent     string
+	// NewDevice marks successful logins from devices unknown to the account
+	NewDevice    bool
 	CreationDate time.Time
 }
+
+// KnownDevice is a device, which has been used to log in to the account. The
+// report token allows the owner to report a login from a new device, which
+// they didn't make.
+type KnownDevice struct {
+	Id                   int
+	AccountId            int
+	Fingerprint          string
+	Description          string
+	IpPrefix             string
+	ReportTokenHash      string
+	ReportExpirationDate time.Time
+	LastSeenDate         time.Time
+	CreationDate         time.Time
+}
+
+// Session is created by every login. Its tokens are rejected once it has been
+// revoked.
+type Session struct {
+	Id             int
+	AccountId      int
+	UserAgent      string
+	IpAddress      string
+	ExpirationDate time.Time
+	LastSeenDate   time.Time
+	RevokedDate    *time.Time
+	CreationDate   time.Time
+}
+
+type AuditEvent struct {
+	Id            int
+	ActorId       int
+	AccountId     int
+	Action        string
+	Impersonation bool
+	CreationDate  time.Time
+}
+
+type ApiKey struct {
+	Id             int
+	AccountId      int
+	Name           string
+	Prefix         string
+	Hash           string
+	Scopes         []string
+	ExpirationDate *time.Time
+	LastUsedDate   *time.Time
+	Revoked        bool
+	CreationDate   time.Time
+}
+
+// EmailVerification confirms that the account owns Email.
+type EmailVerification struct {
+	Id             int
+	AccountId      int
+	Email          string
+	TokenHash      string
+	ExpirationDate time.Time
+	CreationDate   time.Time
+}
+
+// EmailChange replaces OldEmail by NewEmail once confirmed using the token
+// sent to NewEmail. The owner of OldEmail can cancel it using the cancel token
+// until CancelExpirationDate, even after it has been confirmed.
+type EmailChange struct {
+	Id                   int
+	AccountId            int
+	OldEmail             string
+	NewEmail             string
+	TokenHash            string
+	CancelTokenHash      string
+	ExpirationDate       time.Time
+	CancelExpirationDate time.Time
+	ConfirmedDate        *time.Time
+	CreationDate         time.Time
+}
+
+type PasswordReset struct {
+	Id             int
+	AccountId      int
+	TokenHash      string
+	ExpirationDate time.Time
+	UsedDate       *time.Time
+	CreationDate   time.Time
+}
+
+const (
+	DeviceAuthorizationPending  = "pending"
+	DeviceAuthorizationApproved = "approved"
+	DeviceAuthorizationDenied   = "denied"
+	DeviceAuthorizationRedeemed = "redeemed"
+)
+
+type DeviceAuthorization struct {
+	Id             int
+	DeviceCodeHash string
+	UserCode       string
+	ClientId       string
+	Scope          string
+	AccountId      int
+	Status         string
+	PollInterval   int
+	LastPollDate   *time.Time
+	ExpirationDate time.Time
+	CreationDate   time.Time
+}
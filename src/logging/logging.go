@@ -0,0 +1,196 @@
+// Package logging configures the structured logger of the service and
+// correlates log lines of a request using its request id.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const RequestIdHeader = "X-Request-ID"
+
+type Config struct {
+	// Level is one of debug, info, warn or error and defaults to info
+	Level string `yaml:"level"`
+	// Format is either json or text and defaults to json
+	Format string `yaml:"format"`
+}
+
+func New(config Config, w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %s", config.Level)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+
+	switch strings.ToLower(config.Format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(w, options)
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	default:
+		return nil, fmt.Errorf("invalid log format %s", config.Format)
+	}
+
+	return slog.New(contextHandler{handler}), nil
+}
+
+// contextHandler adds the request id and the actor of the context to every
+// record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId := RequestId(ctx); requestId != "" {
+		record.AddAttrs(slog.String("requestId", requestId))
+	}
+
+	if actor := Actor(ctx); actor != "" {
+		record.AddAttrs(slog.String("actor", actor))
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIdKey struct{}
+
+func WithRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+func RequestId(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+// requestActor is shared by the contexts of a request. The actor is only known
+// once the token is verified, but the access log is written by Middleware,
+// which only sees the context it created.
+type requestActor struct {
+	subject string
+}
+
+type requestActorKey struct{}
+
+// SetActor records the subject acting on behalf of the user of the request,
+// like the admin using an impersonation token. Log lines written afterwards
+// and the access log of the request name the actor.
+func SetActor(ctx context.Context, subject string) {
+	if actor, ok := ctx.Value(requestActorKey{}).(*requestActor); ok {
+		actor.subject = subject
+	}
+}
+
+// Actor returns the subject set by SetActor or an empty string.
+func Actor(ctx context.Context) string {
+	if actor, ok := ctx.Value(requestActorKey{}).(*requestActor); ok {
+		return actor.subject
+	}
+
+	return ""
+}
+
+func newRequestId() string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// isValidRequestId only accepts ids, which are safe to put into logs and
+// headers.
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > 128 {
+		return false
+	}
+
+	for _, c := range requestId {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.bytes += n
+	return n, err
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// Middleware propagates the X-Request-ID header of the request or generates a
+// new id, returns it in the response and writes an access log line.
+func Middleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestId := r.Header.Get(RequestIdHeader)
+		if !isValidRequestId(requestId) {
+			requestId = newRequestId()
+		}
+
+		w.Header().Set(RequestIdHeader, requestId)
+		ctx := WithRequestId(r.Context(), requestId)
+		ctx = context.WithValue(ctx, requestActorKey{}, &requestActor{})
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		logger.InfoContext(ctx, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration", time.Since(start),
+			"remoteAddr", r.RemoteAddr,
+			"userAgent", r.UserAgent())
+	})
+}
@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewInvalidConfig(t *testing.T) {
+	_, err := New(Config{Level: "verbose"}, &bytes.Buffer{})
+	assert.NotNil(t, err)
+
+	_, err = New(Config{Format: "xml"}, &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
+
+func TestNewLevel(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := New(Config{Level: "warn", Format: "text"}, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Info("hidden")
+	logger.Warn("shown")
+
+	assert.NotContains(t, buffer.String(), "hidden")
+	assert.Contains(t, buffer.String(), "shown")
+}
+
+func TestLoggerAddsRequestId(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, err := New(Config{}, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.InfoContext(WithRequestId(context.Background(), "abc"), "message")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "abc", line["requestId"])
+	assert.Equal(t, "message", line["msg"])
+}
+
+func TestMiddlewarePropagatesRequestId(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, _ := New(Config{}, &buffer)
+
+	var requestId string
+	handler := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestId = RequestId(r.Context())
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/login", nil)
+	req.Header.Set(RequestIdHeader, "request-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "request-1", requestId)
+	assert.Equal(t, "request-1", rec.Header().Get(RequestIdHeader))
+	assert.Equal(t, "request-1", line["requestId"])
+	assert.Equal(t, float64(http.StatusTeapot), line["status"])
+	assert.Equal(t, "/api/auth/login", line["path"])
+}
+
+func TestMiddlewareGeneratesRequestId(t *testing.T) {
+	logger, _ := New(Config{}, &bytes.Buffer{})
+	handler := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIdHeader, "invalid id\n"+strings.Repeat("x", 200))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, 32, len(rec.Header().Get(RequestIdHeader)))
+}
+
+func TestMiddlewareLogsActor(t *testing.T) {
+	var buffer bytes.Buffer
+	logger, _ := New(Config{}, &buffer)
+
+	handler := Middleware(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Handlers set the actor on derived contexts
+		SetActor(context.WithValue(r.Context(), struct{}{}, "derived"), "42")
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/auth/me", nil))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buffer.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "42", line["actor"])
+	assert.Equal(t, "", Actor(context.Background()))
+}
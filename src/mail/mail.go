@@ -0,0 +1,256 @@
+// Package mail sends the emails of the login service, like password reset
+// links. SMTP is used in production and the file mailer makes the emails
+// visible during local development. The log mailer only logs that an email
+// was sent, since bodies contain tokens.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	// Body is sent as plain text
+	Body string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+type Config struct {
+	// Type is one of log, file or smtp and defaults to log
+	Type string `yaml:"type"`
+	From string `yaml:"from"`
+	// Directory is where the file mailer writes its emails
+	Directory string     `yaml:"directory"`
+	Smtp      SmtpConfig `yaml:"smtp"`
+}
+
+type SmtpConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Timeout is given in seconds and limits sending an email including
+	// connecting to the server
+	Timeout int `yaml:"timeout"`
+}
+
+const defaultSmtpTimeout = 30 * time.Second
+
+func New(config Config, logger *slog.Logger) (Mailer, error) {
+	from := config.From
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch strings.ToLower(config.Type) {
+	case "", "log":
+		return &LogMailer{From: from, Logger: logger}, nil
+	case "file":
+		if config.Directory == "" {
+			return nil, fmt.Errorf("the file mailer needs a directory")
+		}
+
+		return &FileMailer{From: from, Directory: config.Directory}, nil
+	case "smtp":
+		if config.Smtp.Host == "" {
+			return nil, fmt.Errorf("the smtp mailer needs a host")
+		}
+
+		port := config.Smtp.Port
+		if port == 0 {
+			port = 587
+		}
+
+		timeout := defaultSmtpTimeout
+		if config.Smtp.Timeout > 0 {
+			timeout = time.Duration(config.Smtp.Timeout) * time.Second
+		}
+
+		return &SmtpMailer{
+			From:     from,
+			Address:  net.JoinHostPort(config.Smtp.Host, strconv.Itoa(port)),
+			Username: config.Smtp.Username,
+			Password: config.Smtp.Password,
+			Timeout:  timeout,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid mailer type %s", config.Type)
+}
+
+// format renders the message as RFC 5322 email.
+func format(from string, message Message) []byte {
+	var buffer bytes.Buffer
+
+	fmt.Fprintf(&buffer, "From: %s\r\n", from)
+	fmt.Fprintf(&buffer, "To: %s\r\n", message.To)
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buffer.WriteString("MIME-Version: 1.0\r\n")
+	buffer.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buffer.WriteString("\r\n")
+	buffer.WriteString(strings.ReplaceAll(message.Body, "\n", "\r\n"))
+
+	return buffer.Bytes()
+}
+
+// validateHeaders prevents header injection through the recipient or subject.
+func validateHeaders(message Message) error {
+	if strings.ContainsAny(message.To, "\r\n") || strings.ContainsAny(message.Subject, "\r\n") {
+		return fmt.Errorf("invalid message headers")
+	}
+
+	return nil
+}
+
+// LogMailer only logs the recipient and subject of emails. The body is left
+// out, since it contains tokens like password reset links.
+type LogMailer struct {
+	From   string
+	Logger *slog.Logger
+}
+
+func (mailer *LogMailer) Send(ctx context.Context, message Message) error {
+	if err := validateHeaders(message); err != nil {
+		return err
+	}
+
+	logger := mailer.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.InfoContext(ctx, "email sent", "from", mailer.From, "to", message.To, "subject", message.Subject)
+	return nil
+}
+
+// FileMailer writes every email to its own .eml file in Directory.
+type FileMailer struct {
+	From      string
+	Directory string
+}
+
+func (mailer *FileMailer) Send(ctx context.Context, message Message) error {
+	if err := validateHeaders(message); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(mailer.Directory, 0700); err != nil {
+		return err
+	}
+
+	random := make([]byte, 4)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), hex.EncodeToString(random))
+	return ioutil.WriteFile(filepath.Join(mailer.Directory, name), format(mailer.From, message), 0600)
+}
+
+// SmtpMailer sends emails using STARTTLS, when the server supports it.
+// Credentials are only sent over TLS or to localhost.
+type SmtpMailer struct {
+	From     string
+	Address  string
+	Username string
+	Password string
+	// Timeout limits sending an email including connecting to the server, so
+	// unresponsive servers don't pile up background sends. Zero uses 30s.
+	Timeout time.Duration
+}
+
+func (mailer *SmtpMailer) Send(ctx context.Context, message Message) error {
+	if err := validateHeaders(message); err != nil {
+		return err
+	}
+
+	timeout := mailer.Timeout
+	if timeout <= 0 {
+		timeout = defaultSmtpTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", mailer.Address)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	// The deadline covers every command, smtp.Client has no timeouts itself
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(mailer.Address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+
+	defer client.Close()
+
+	return mailer.send(client, host, message)
+}
+
+// send follows smtp.SendMail, which can't be used since it dials itself.
+func (mailer *SmtpMailer) send(client *smtp.Client, host string, message Message) error {
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if mailer.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", mailer.Username, mailer.Password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(mailer.From); err != nil {
+		return err
+	}
+
+	if err := client.Rcpt(message.To); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := writer.Write(format(mailer.From, message)); err != nil {
+		return err
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,107 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	mailer, err := New(Config{}, nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &LogMailer{}, mailer)
+
+	mailer, err = New(Config{Type: "file", Directory: t.TempDir()}, nil)
+	assert.Nil(t, err)
+	assert.IsType(t, &FileMailer{}, mailer)
+
+	mailer, err = New(Config{Type: "smtp", Smtp: SmtpConfig{Host: "localhost"}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "localhost:587", mailer.(*SmtpMailer).Address)
+	assert.Equal(t, 30*time.Second, mailer.(*SmtpMailer).Timeout)
+
+	mailer, err = New(Config{Type: "smtp", Smtp: SmtpConfig{Host: "localhost", Timeout: 5}}, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, mailer.(*SmtpMailer).Timeout)
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	for _, config := range []Config{{Type: "pigeon"}, {Type: "file"}, {Type: "smtp"}} {
+		_, err := New(config, nil)
+		assert.NotNil(t, err, config.Type)
+	}
+}
+
+func TestLogMailer(t *testing.T) {
+	var buffer bytes.Buffer
+	mailer := &LogMailer{From: "no-reply@test.com", Logger: slog.New(slog.NewJSONHandler(&buffer, nil))}
+
+	err := mailer.Send(context.Background(), Message{To: "testuser@test.com", Subject: "Hello", Body: "Reset link"})
+
+	assert.Nil(t, err)
+	assert.Contains(t, buffer.String(), "testuser@test.com")
+	assert.Contains(t, buffer.String(), "Hello")
+	assert.NotContains(t, buffer.String(), "Reset link")
+}
+
+func TestFileMailer(t *testing.T) {
+	directory := t.TempDir()
+	mailer := &FileMailer{From: "no-reply@test.com", Directory: directory}
+
+	if err := mailer.Send(context.Background(), Message{To: "testuser@test.com", Subject: "Passwort zurücksetzen", Body: "Line 1\nLine 2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(directory, "*.eml"))
+	assert.Len(t, files, 1)
+
+	content, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, strings.HasPrefix(string(content), "From: no-reply@test.com\r\nTo: testuser@test.com\r\n"))
+	assert.Contains(t, string(content), "Subject: =?utf-8?q?")
+	assert.Contains(t, string(content), "\r\n\r\nLine 1\r\nLine 2")
+}
+
+func TestSmtpMailerTimeout(t *testing.T) {
+	// The server accepts connections, but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	mailer := &SmtpMailer{From: "no-reply@test.com", Address: listener.Addr().String(), Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	err = mailer.Send(context.Background(), Message{To: "testuser@test.com", Subject: "Hello"})
+
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestHeaderInjection(t *testing.T) {
+	mailer := &FileMailer{Directory: t.TempDir()}
+
+	err := mailer.Send(context.Background(), Message{To: "testuser@test.com\r\nBcc: evil@test.com", Subject: "Hello"})
+	assert.NotNil(t, err)
+}
@@ -1,57 +1,363 @@
 package main
 
 import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"flag"
 	"flhansen/application-manager/login-service/src/controller"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/logging"
+	"flhansen/application-manager/login-service/src/mail"
 	"flhansen/application-manager/login-service/src/service"
+	"flhansen/application-manager/login-service/src/tracing"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/golang-jwt/jwt"
 	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(runHealthcheck(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+
 	os.Exit(runApplication())
 }
 
-func runApplication() int {
-	configPath := flag.String("config", "", "Path to configuration file")
-	flag.Parse()
+// runHealthcheck requests the readiness endpoint of a running service and
+// exits with 0 if it is ready, so it can be used as a Docker HEALTHCHECK. The
+// address is taken from the configuration of the service. With TLS enabled,
+// the certificate is verified against the host of the public url, since the
+// service is reached using localhost.
+func runHealthcheck(args []string) int {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("APPMAN_CONFIG_FILE"), "Path to the configuration file of the service")
+	readyzUrl := flags.String("url", "", "Url of the readiness endpoint, taken from the configuration by default")
+	timeout := flags.Duration("timeout", 3*time.Second, "Maximum time to wait for the response")
+	insecure := flags.Bool("insecure", false, "Skip verification of the server certificate")
+	serverName := flags.String("server-name", "", "Name to verify the server certificate against, the host of the public url by default")
+	certFile := flags.String("cert", os.Getenv("APPMAN_HEALTHCHECK_CERT_FILE"), "PEM client certificate, if the service requires one")
+	keyFile := flags.String("key", os.Getenv("APPMAN_HEALTHCHECK_KEY_FILE"), "PEM private key of the client certificate")
 
-	var serviceConfig service.ServiceConfig
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: *insecure, ServerName: *serverName}
 
-	if *configPath != "" {
-		fileContent, err := ioutil.ReadFile(*configPath)
+	if *readyzUrl == "" {
+		serviceConfig, err := loadConfig(*configPath)
 		if err != nil {
-			fmt.Printf("An error occured while reading the configuration file %s: %v\n", *configPath, err)
+			fmt.Printf("Could not load the configuration: %v\n", err)
 			return 1
 		}
 
+		port := serviceConfig.Port
+		if port == 0 {
+			port = 7043
+		}
+
+		scheme := "http"
+		if serviceConfig.Tls.Enabled() {
+			scheme = "https"
+		}
+
+		*readyzUrl = fmt.Sprintf("%s://localhost:%d/readyz", scheme, port)
+
+		if publicUrl, err := url.Parse(serviceConfig.PublicUrl); err == nil && tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = publicUrl.Hostname()
+		}
+	}
+
+	if *certFile != "" || *keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			fmt.Printf("Could not load the client certificate: %v\n", err)
+			return 1
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}
+
+	resp, err := client.Get(*readyzUrl)
+	if err != nil {
+		fmt.Printf("Service is not reachable: %v\n", err)
+		return 1
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Printf("Service is not ready: %s\n", body)
+		return 1
+	}
+
+	return 0
+}
+
+// runMigrate creates the schema in an empty database or upgrades the schema of
+// an older version, so the service becomes ready.
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("APPMAN_CONFIG_FILE"), "Path to the configuration file of the service")
+
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+
+	serviceConfig, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("Could not load the configuration: %v\n", err)
+		return 1
+	}
+
+	logger, err := logging.New(serviceConfig.Log, os.Stdout)
+	if err != nil {
+		fmt.Printf("An error occured while configuring the logger: %v\n", err)
+		return 1
+	}
+
+	db := database.NewContext(
+		serviceConfig.Database.Host,
+		serviceConfig.Database.Port,
+		serviceConfig.Database.Username,
+		serviceConfig.Database.Password,
+		serviceConfig.Database.Database)
+	db.Logger = logger
+
+	defer db.Close()
+
+	if err := db.Migrate(); err != nil {
+		logger.Error("could not migrate the database", "error", err)
+		return 1
+	}
+
+	logger.Info("database migrated", "version", database.SchemaVersion)
+	return 0
+}
+
+// loadConfig reads the configuration file or the environment variables, if
+// there is no file.
+func loadConfig(configPath string) (service.ServiceConfig, error) {
+	var serviceConfig service.ServiceConfig
+
+	if configPath != "" {
+		fileContent, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return serviceConfig, fmt.Errorf("could not read %s: %w", configPath, err)
+		}
+
 		if err := yaml.Unmarshal(fileContent, &serviceConfig); err != nil {
-			fmt.Printf("An error occured while unmarshalling the configuration file content: %v\n", err)
+			return serviceConfig, fmt.Errorf("could not unmarshal %s: %w", configPath, err)
+		}
+
+		return serviceConfig, nil
+	}
+
+	serviceConfig.Host = os.Getenv("APPMAN_HOST")
+	serviceConfig.Port, _ = strconv.Atoi(os.Getenv("APPMAN_PORT"))
+	serviceConfig.PublicUrl = os.Getenv("APPMAN_PUBLIC_URL")
+	serviceConfig.Jwt = service.JwtConfig{}
+	serviceConfig.Jwt.SignKey = []byte(os.Getenv("APPMAN_JWT_SIGNKEY"))
+	serviceConfig.Jwt.PrivateKeyFile = os.Getenv("APPMAN_JWT_PRIVATE_KEY_FILE")
+	serviceConfig.Jwt.KeyId = os.Getenv("APPMAN_JWT_KEY_ID")
+	serviceConfig.Jwt.Issuer = os.Getenv("APPMAN_JWT_ISSUER")
+	serviceConfig.Jwt.Audience = os.Getenv("APPMAN_JWT_AUDIENCE")
+	serviceConfig.Device.VerificationUri = os.Getenv("APPMAN_DEVICE_VERIFICATION_URI")
+	serviceConfig.Server.ReadTimeout, _ = strconv.Atoi(os.Getenv("APPMAN_SERVER_READ_TIMEOUT"))
+	serviceConfig.Server.WriteTimeout, _ = strconv.Atoi(os.Getenv("APPMAN_SERVER_WRITE_TIMEOUT"))
+	serviceConfig.Server.IdleTimeout, _ = strconv.Atoi(os.Getenv("APPMAN_SERVER_IDLE_TIMEOUT"))
+	serviceConfig.Server.ShutdownTimeout, _ = strconv.Atoi(os.Getenv("APPMAN_SERVER_SHUTDOWN_TIMEOUT"))
+	serviceConfig.Server.MaxBodyBytes, _ = strconv.ParseInt(os.Getenv("APPMAN_SERVER_MAX_BODY_BYTES"), 10, 64)
+	serviceConfig.Tls.CertFile = os.Getenv("APPMAN_TLS_CERT_FILE")
+	serviceConfig.Tls.KeyFile = os.Getenv("APPMAN_TLS_KEY_FILE")
+	serviceConfig.Tls.MinVersion = os.Getenv("APPMAN_TLS_MIN_VERSION")
+	serviceConfig.Tls.ClientCaFile = os.Getenv("APPMAN_TLS_CLIENT_CA_FILE")
+	if cipherSuites := os.Getenv("APPMAN_TLS_CIPHER_SUITES"); cipherSuites != "" {
+		serviceConfig.Tls.CipherSuites = strings.Split(cipherSuites, ",")
+	}
+	serviceConfig.Log.Level = os.Getenv("APPMAN_LOG_LEVEL")
+	serviceConfig.Log.Format = os.Getenv("APPMAN_LOG_FORMAT")
+	serviceConfig.Tracing.Exporter = os.Getenv("APPMAN_TRACING_EXPORTER")
+	serviceConfig.Tracing.Endpoint = os.Getenv("APPMAN_TRACING_ENDPOINT")
+	serviceConfig.Tracing.Insecure, _ = strconv.ParseBool(os.Getenv("APPMAN_TRACING_INSECURE"))
+	serviceConfig.Metrics.Address = os.Getenv("APPMAN_METRICS_ADDRESS")
+	serviceConfig.Validation.UsernameMinLength, _ = strconv.Atoi(os.Getenv("APPMAN_USERNAME_MIN_LENGTH"))
+	serviceConfig.Validation.UsernameMaxLength, _ = strconv.Atoi(os.Getenv("APPMAN_USERNAME_MAX_LENGTH"))
+	serviceConfig.Validation.UsernamePattern = os.Getenv("APPMAN_USERNAME_PATTERN")
+	serviceConfig.Validation.PasswordMinLength, _ = strconv.Atoi(os.Getenv("APPMAN_PASSWORD_MIN_LENGTH"))
+	serviceConfig.Validation.PasswordMaxLength, _ = strconv.Atoi(os.Getenv("APPMAN_PASSWORD_MAX_LENGTH"))
+	if origins := os.Getenv("APPMAN_CORS_ALLOWED_ORIGINS"); origins != "" {
+		serviceConfig.Cors.AllowedOrigins = strings.Split(origins, ",")
+	}
+	if methods := os.Getenv("APPMAN_CORS_ALLOWED_METHODS"); methods != "" {
+		serviceConfig.Cors.AllowedMethods = strings.Split(methods, ",")
+	}
+	if headers := os.Getenv("APPMAN_CORS_ALLOWED_HEADERS"); headers != "" {
+		serviceConfig.Cors.AllowedHeaders = strings.Split(headers, ",")
+	}
+	serviceConfig.Cors.AllowCredentials, _ = strconv.ParseBool(os.Getenv("APPMAN_CORS_ALLOW_CREDENTIALS"))
+	serviceConfig.Cors.MaxAge, _ = strconv.Atoi(os.Getenv("APPMAN_CORS_MAX_AGE"))
+	serviceConfig.Mail.Type = os.Getenv("APPMAN_MAIL_TYPE")
+	serviceConfig.Mail.From = os.Getenv("APPMAN_MAIL_FROM")
+	serviceConfig.Mail.Directory = os.Getenv("APPMAN_MAIL_DIRECTORY")
+	serviceConfig.Mail.Smtp.Host = os.Getenv("APPMAN_SMTP_HOST")
+	serviceConfig.Mail.Smtp.Port, _ = strconv.Atoi(os.Getenv("APPMAN_SMTP_PORT"))
+	serviceConfig.Mail.Smtp.Username = os.Getenv("APPMAN_SMTP_USERNAME")
+	serviceConfig.Mail.Smtp.Password = os.Getenv("APPMAN_SMTP_PASSWORD")
+	serviceConfig.Mail.Smtp.Timeout, _ = strconv.Atoi(os.Getenv("APPMAN_SMTP_TIMEOUT"))
+	serviceConfig.PasswordReset.ResetUri = os.Getenv("APPMAN_PASSWORD_RESET_URI")
+	serviceConfig.PasswordReset.TokenLifetime, _ = strconv.Atoi(os.Getenv("APPMAN_PASSWORD_RESET_LIFETIME"))
+	serviceConfig.PasswordReset.ResendInterval, _ = strconv.Atoi(os.Getenv("APPMAN_PASSWORD_RESET_RESEND_INTERVAL"))
+	serviceConfig.EmailVerification.VerifyUri = os.Getenv("APPMAN_EMAIL_VERIFY_URI")
+	serviceConfig.EmailVerification.TokenLifetime, _ = strconv.Atoi(os.Getenv("APPMAN_EMAIL_VERIFICATION_LIFETIME"))
+	serviceConfig.EmailVerification.ResendInterval, _ = strconv.Atoi(os.Getenv("APPMAN_EMAIL_RESEND_INTERVAL"))
+	serviceConfig.EmailVerification.Required, _ = strconv.ParseBool(os.Getenv("APPMAN_EMAIL_VERIFICATION_REQUIRED"))
+	serviceConfig.EmailChange.ConfirmUri = os.Getenv("APPMAN_EMAIL_CHANGE_CONFIRM_URI")
+	serviceConfig.EmailChange.CancelUri = os.Getenv("APPMAN_EMAIL_CHANGE_CANCEL_URI")
+	serviceConfig.EmailChange.TokenLifetime, _ = strconv.Atoi(os.Getenv("APPMAN_EMAIL_CHANGE_LIFETIME"))
+	serviceConfig.EmailChange.CancelLifetime, _ = strconv.Atoi(os.Getenv("APPMAN_EMAIL_CHANGE_CANCEL_LIFETIME"))
+	serviceConfig.Availability.Requests, _ = strconv.Atoi(os.Getenv("APPMAN_AVAILABILITY_RATE_LIMIT"))
+	serviceConfig.Availability.Window, _ = strconv.Atoi(os.Getenv("APPMAN_AVAILABILITY_RATE_WINDOW"))
+	serviceConfig.LoginHistory.Retention, _ = strconv.Atoi(os.Getenv("APPMAN_LOGIN_HISTORY_RETENTION"))
+	serviceConfig.LoginHistory.PruneInterval, _ = strconv.Atoi(os.Getenv("APPMAN_LOGIN_HISTORY_PRUNE_INTERVAL"))
+	serviceConfig.NewDevice.ReportUri = os.Getenv("APPMAN_NEW_DEVICE_REPORT_URI")
+	serviceConfig.NewDevice.ReportLifetime, _ = strconv.Atoi(os.Getenv("APPMAN_NEW_DEVICE_REPORT_LIFETIME"))
+	serviceConfig.Database = controller.DbConfig{}
+	serviceConfig.Database.Host = os.Getenv("APPMAN_DATABASE_HOST")
+	serviceConfig.Database.Port, _ = strconv.Atoi(os.Getenv("APPMAN_DATABASE_PORT"))
+	serviceConfig.Database.Username = os.Getenv("APPMAN_DATABASE_USERNAME")
+	serviceConfig.Database.Password = os.Getenv("APPMAN_DATABASE_PASSWORD")
+	serviceConfig.Database.Database = os.Getenv("APPMAN_DATABASE_NAME")
+
+	return serviceConfig, nil
+}
+
+func runApplication() int {
+	configPath := flag.String("config", os.Getenv("APPMAN_CONFIG_FILE"), "Path to configuration file")
+	flag.Parse()
+
+	serviceConfig, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Printf("An error occured while loading the configuration: %v\n", err)
+		return 1
+	}
+	logger, err := logging.New(serviceConfig.Log, os.Stdout)
+	if err != nil {
+		fmt.Printf("An error occured while configuring the logger: %v\n", err)
+		return 1
+	}
+
+	slog.SetDefault(logger)
+
+	if err := service.ValidatePublicUrl(serviceConfig.PublicUrl); err != nil {
+		logger.Error("invalid public url", "error", err)
+		return 1
+	}
+
+	if _, err := service.NewRegistrationValidator(serviceConfig.Validation); err != nil {
+		logger.Error("invalid validation config", "error", err)
+		return 1
+	}
+
+	if _, err := mail.New(serviceConfig.Mail, logger); err != nil {
+		logger.Error("invalid mail config", "error", err)
+		return 1
+	}
+
+	if serviceConfig.Cors.Enabled() {
+		if _, err := service.NewCors(serviceConfig.Cors); err != nil {
+			logger.Error("invalid cors config", "error", err)
+			return 1
+		}
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), serviceConfig.Tracing, os.Stdout)
+	if err != nil {
+		logger.Error("could not set up tracing", "error", err)
+		return 1
+	}
+
+	// Flush pending spans after the service stopped, whatever the reason
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("could not flush spans", "error", err)
+		}
+	}()
+
+	if serviceConfig.Jwt.PrivateKeyFile != "" {
+		privateKey, err := loadPrivateKey(serviceConfig.Jwt.PrivateKeyFile)
+		if err != nil {
+			logger.Error("could not load private key", "path", serviceConfig.Jwt.PrivateKeyFile, "error", err)
 			return 1
 		}
-	} else {
-		serviceConfig.Host = os.Getenv("APPMAN_HOST")
-		serviceConfig.Port, _ = strconv.Atoi(os.Getenv("APPMAN_PORT"))
-		serviceConfig.Jwt = service.JwtConfig{}
-		serviceConfig.Jwt.SignKey = []byte(os.Getenv("APPMAN_JWT_SIGNKEY"))
-		serviceConfig.Database = controller.DbConfig{}
-		serviceConfig.Database.Host = os.Getenv("APPMAN_DATABASE_HOST")
-		serviceConfig.Database.Port, _ = strconv.Atoi(os.Getenv("APPMAN_DATABASE_PORT"))
-		serviceConfig.Database.Username = os.Getenv("APPMAN_DATABASE_USERNAME")
-		serviceConfig.Database.Password = os.Getenv("APPMAN_DATABASE_PASSWORD")
-		serviceConfig.Database.Database = os.Getenv("APPMAN_DATABASE_NAME")
+
+		serviceConfig.Jwt.SignKey = privateKey
 	}
 
 	s := service.New(serviceConfig)
 
-	if err := s.Start(); err != nil {
-		fmt.Printf("An error occured while starting the service: %v\n", err)
-		return 1
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	logger.Info("starting service", "address", s.Server.Addr, "tls", s.Tls.Enabled())
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Start()
+	}()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			logger.Error("could not start service", "error", err)
+			return 1
+		}
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig.String())
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+		defer cancel()
+
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Error("could not shut down service", "error", err)
+			return 1
+		}
 	}
 
 	return 0
 }
+
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	fileContent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.ParseRSAPrivateKeyFromPEM(fileContent)
+}
@@ -1,12 +1,28 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"flag"
 	"flhansen/application-manager/login-service/src/controller"
+	"flhansen/application-manager/login-service/src/logging"
+	"flhansen/application-manager/login-service/src/mail"
 	"flhansen/application-manager/login-service/src/service"
+	"flhansen/application-manager/login-service/src/tracing"
 	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
@@ -40,6 +56,7 @@ func setTestEnv(envs map[string]string) func() {
 
 func TestRunApplication(t *testing.T) {
 	config := service.ServiceConfig{
+		PublicUrl: "http://localhost:8080",
 		Jwt: service.JwtConfig{
 			SignKey: "supersecretsigningkey",
 		},
@@ -99,8 +116,9 @@ func TestRunApplicationInvalidConfig(t *testing.T) {
 
 func TestRunApplicationStartError(t *testing.T) {
 	config := service.ServiceConfig{
-		Host: "test",
-		Port: -1,
+		PublicUrl: "http://localhost:8080",
+		Host:      "test",
+		Port:      -1,
 		Jwt: service.JwtConfig{
 			SignKey: "supersecretsigningkey",
 		},
@@ -166,6 +184,267 @@ func TestInvalidConfigContent(t *testing.T) {
 		assert.Equal(t, 1, exitCode)
 	}
 }
+
+func TestRunApplicationInvalidPrivateKey(t *testing.T) {
+	config := service.ServiceConfig{
+		PublicUrl: "http://localhost:8080",
+		Jwt: service.JwtConfig{
+			PrivateKeyFile: "invalid/private/key.pem",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 1, exitCode)
+	}
+}
+
+func TestRunApplicationInvalidLogLevel(t *testing.T) {
+	config := service.ServiceConfig{
+		Log: logging.Config{
+			Level: "verbose",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 1, exitCode)
+	}
+}
+
+func TestRunApplicationInvalidTracingExporter(t *testing.T) {
+	config := service.ServiceConfig{
+		Tracing: tracing.Config{
+			Exporter: "zipkin",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 1, exitCode)
+	}
+}
+
+func TestRunApplicationInvalidUsernamePattern(t *testing.T) {
+	config := service.ServiceConfig{
+		PublicUrl: "http://localhost:8080",
+		Validation: service.ValidationConfig{
+			UsernamePattern: "[a-z",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 1, exitCode)
+	}
+}
+
+func TestRunApplicationInvalidMailer(t *testing.T) {
+	config := service.ServiceConfig{
+		PublicUrl: "http://localhost:8080",
+		Mail: mail.Config{
+			Type: "pigeon",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 1, exitCode)
+	}
+}
+
+func TestRunApplicationMissingPublicUrl(t *testing.T) {
+	config := service.ServiceConfig{
+		Jwt: service.JwtConfig{
+			SignKey: "supersecretsigningkey",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 1, exitCode)
+	}
+}
+
+func TestRunApplicationShutdown(t *testing.T) {
+	config := service.ServiceConfig{
+		PublicUrl: "http://localhost:8080",
+		Jwt: service.JwtConfig{
+			SignKey: "supersecretsigningkey",
+		},
+		Database: controller.DbConfig{
+			Host:     "localhost",
+			Port:     5432,
+			Username: "test",
+			Password: "test",
+			Database: "test",
+		},
+	}
+
+	configData, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(os.TempDir(), "test_config_shutdown.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(configPath)
+
+	done := make(chan int, 1)
+
+	go func() {
+		flag.CommandLine = flag.NewFlagSet("flags set", flag.ExitOnError)
+		os.Args = append([]string{"flags set"}, "-config="+configPath)
+		done <- runApplication()
+	}()
+
+	// Give the application time to register the signal handler
+	time.Sleep(300 * time.Millisecond)
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+
+	select {
+	case <-time.After(2 * time.Second):
+		t.Fatal("Application is not terminating")
+	case exitCode := <-done:
+		assert.Equal(t, 0, exitCode)
+	}
+}
+
 func TestRunApplicationUsingEnv(t *testing.T) {
 	oldArgs := os.Args
 	defer func() {
@@ -175,6 +454,7 @@ func TestRunApplicationUsingEnv(t *testing.T) {
 	testEnvCloser := setTestEnv(map[string]string{
 		"APPMAN_HOST":              "localhost",
 		"APPMAN_PORT":              "8080",
+		"APPMAN_PUBLIC_URL":        "http://localhost:8080",
 		"APPMAN_JWT_SIGNKEY":       "secret",
 		"APPMAN_DATABASE_HOST":     "localhost",
 		"APPMAN_DATABASE_PORT":     "5432",
@@ -199,3 +479,123 @@ func TestRunApplicationUsingEnv(t *testing.T) {
 		t.Fatalf("The application terminated with code %d\n", exitCode)
 	}
 }
+
+func TestRunHealthcheck(t *testing.T) {
+	ready := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	assert.Equal(t, 0, runHealthcheck([]string{"-url", server.URL + "/readyz"}))
+
+	ready = false
+	assert.Equal(t, 1, runHealthcheck([]string{"-url", server.URL + "/readyz"}))
+
+	server.Close()
+	assert.Equal(t, 1, runHealthcheck([]string{"-url", server.URL + "/readyz"}))
+	assert.Equal(t, 1, runHealthcheck([]string{"-unknown"}))
+}
+
+func TestRunHealthcheckConfig(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	serverUrl, _ := url.Parse(server.URL)
+	port, _ := strconv.Atoi(serverUrl.Port())
+
+	configData, err := yaml.Marshal(service.ServiceConfig{Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, runHealthcheck([]string{"-config", configPath}))
+	assert.Equal(t, 1, runHealthcheck([]string{"-config", filepath.Join(t.TempDir(), "missing.yml")}))
+}
+
+func writeClientCertificate(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "healthcheck"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestRunHealthcheckClientCertificate(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	certFile, keyFile := writeClientCertificate(t)
+
+	assert.Equal(t, 1, runHealthcheck([]string{"-url", server.URL + "/readyz", "-insecure"}))
+	assert.Equal(t, 0, runHealthcheck([]string{"-url", server.URL + "/readyz", "-insecure", "-cert", certFile, "-key", keyFile}))
+	assert.Equal(t, 1, runHealthcheck([]string{"-url", server.URL + "/readyz", "-insecure", "-cert", certFile}))
+
+	// The certificate of the test server is not trusted
+	assert.Equal(t, 1, runHealthcheck([]string{"-url", server.URL + "/readyz", "-cert", certFile, "-key", keyFile}))
+}
+
+func TestRunMigrate(t *testing.T) {
+	configData, err := yaml.Marshal(service.ServiceConfig{
+		Database: controller.DbConfig{
+			Host:     "localhost",
+			Port:     5432,
+			Username: "test",
+			Password: "test",
+			Database: "test",
+		},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "config.yml")
+	if err = ioutil.WriteFile(configPath, configData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 0, runMigrate([]string{"-config", configPath}))
+	assert.Equal(t, 1, runMigrate([]string{"-config", "invalid.yml"}))
+	assert.Equal(t, 1, runMigrate([]string{"-unknown"}))
+}
@@ -0,0 +1,207 @@
+// Package metrics defines the Prometheus metrics of the service. They are
+// registered to their own registry, so tests and embedding applications don't
+// collide with the default registry.
+package metrics
+
+import (
+	"flhansen/application-manager/login-service/src/logging"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "appman_login"
+
+type Config struct {
+	// Address is the host and port of the listener serving /metrics, like
+	// localhost:9090. The metrics are not served, if it is empty, since they
+	// must not be reachable from the public listener.
+	Address string `yaml:"address"`
+}
+
+var Registry = prometheus.NewRegistry()
+
+var (
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by outcome and reason of failures.",
+	}, []string{"outcome", "reason"})
+
+	Registrations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registrations_total",
+		Help:      "Registration attempts by outcome.",
+	}, []string{"outcome"})
+
+	Deletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deletions_total",
+		Help:      "Account deletions by outcome.",
+	}, []string{"outcome"})
+
+	TokenValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validations_total",
+		Help:      "Validations of bearer tokens and api keys by outcome.",
+	}, []string{"type", "outcome"})
+
+	ImpersonatedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "impersonated_requests_total",
+		Help:      "Requests made using impersonation tokens by route and method.",
+	}, []string{"route", "method"})
+
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the http handlers by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Duration of the database queries by operation and outcome.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "outcome"})
+
+	PasswordHashDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Duration of password hash computations.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25},
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Logins,
+		Registrations,
+		Deletions,
+		TokenValidations,
+		ImpersonatedRequests,
+		HandlerDuration,
+		QueryDuration,
+		PasswordHashDuration,
+	)
+}
+
+// Handler serves the metrics of the registry and the given collectors in the
+// Prometheus text format. Collectors bound to a single service instance, like
+// the pool statistics, are passed here instead of being registered globally.
+func Handler(instanceCollectors ...prometheus.Collector) http.Handler {
+	instance := prometheus.NewRegistry()
+	instance.MustRegister(instanceCollectors...)
+
+	return promhttp.HandlerFor(prometheus.Gatherers{Registry, instance}, promhttp.HandlerOpts{})
+}
+
+// Outcome is the outcome label of an operation returning err.
+func Outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+
+	return "success"
+}
+
+// ObserveQuery records the duration of a query. The operation is the first
+// keyword of the statement like select, so the label stays bounded.
+func ObserveQuery(operation string, start time.Time, err error) {
+	QueryDuration.WithLabelValues(operation, Outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument records the duration of the handler and counts requests of
+// impersonation tokens, whose actor is set using logging.SetActor. The route is
+// the pattern the handler is registered for, not the requested path, so path
+// parameters don't create new series.
+func Instrument(route string, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		handler(recorder, r, p)
+
+		HandlerDuration.WithLabelValues(route, r.Method, strconv.Itoa(recorder.status)).Observe(time.Since(start).Seconds())
+
+		if logging.Actor(r.Context()) != "" {
+			ImpersonatedRequests.WithLabelValues(route, r.Method).Inc()
+		}
+	}
+}
+
+// poolCollector reads the statistics of the connection pool on every scrape.
+type poolCollector struct {
+	stat func() *pgxpool.Stat
+
+	acquired     *prometheus.Desc
+	idle         *prometheus.Desc
+	total        *prometheus.Desc
+	max          *prometheus.Desc
+	acquires     *prometheus.Desc
+	acquireTime  *prometheus.Desc
+	emptyAcquire *prometheus.Desc
+}
+
+// NewPoolCollector creates a collector for the statistics returned by stat,
+// which returns nil as long as the pool is not connected.
+func NewPoolCollector(stat func() *pgxpool.Stat) prometheus.Collector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+
+	return &poolCollector{
+		stat:         stat,
+		acquired:     desc("acquired_connections", "Connections currently in use."),
+		idle:         desc("idle_connections", "Idle connections in the pool."),
+		total:        desc("total_connections", "Open connections in the pool."),
+		max:          desc("max_connections", "Maximum size of the pool."),
+		acquires:     desc("acquires_total", "Successful acquires of a connection."),
+		acquireTime:  desc("acquire_duration_seconds_total", "Total time spent waiting for a connection."),
+		emptyAcquire: desc("empty_acquires_total", "Acquires that had to wait for a connection."),
+	}
+}
+
+func (collector *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.acquired
+	ch <- collector.idle
+	ch <- collector.total
+	ch <- collector.max
+	ch <- collector.acquires
+	ch <- collector.acquireTime
+	ch <- collector.emptyAcquire
+}
+
+func (collector *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := collector.stat()
+	if stat == nil {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(collector.acquired, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(collector.idle, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(collector.total, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(collector.max, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(collector.acquires, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(collector.acquireTime, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(collector.emptyAcquire, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"errors"
+	"flhansen/application-manager/login-service/src/logging"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutcome(t *testing.T) {
+	assert.Equal(t, "success", Outcome(nil))
+	assert.Equal(t, "error", Outcome(errors.New("failed")))
+}
+
+func sampleCount(t *testing.T, histogram *prometheus.HistogramVec, labels ...string) uint64 {
+	observer, err := histogram.GetMetricWithLabelValues(labels...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metric dto.Metric
+	if err := observer.(prometheus.Metric).Write(&metric); err != nil {
+		t.Fatal(err)
+	}
+
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestObserveQuery(t *testing.T) {
+	selects := sampleCount(t, QueryDuration, "select", "success")
+	unknown := sampleCount(t, QueryDuration, "unknown", "error")
+
+	ObserveQuery("select", time.Now(), nil)
+	ObserveQuery("unknown", time.Now(), errors.New("failed"))
+
+	assert.Equal(t, selects+1, sampleCount(t, QueryDuration, "select", "success"))
+	assert.Equal(t, unknown+1, sampleCount(t, QueryDuration, "unknown", "error"))
+}
+
+func TestInstrumentUsesRoute(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/api/auth/keys/:id", Instrument("/api/auth/keys/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	before := sampleCount(t, HandlerDuration, "/api/auth/keys/:id", http.MethodGet, "404")
+
+	for _, id := range []string{"1", "2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/auth/keys/"+id, nil))
+	}
+
+	assert.Equal(t, before+2, sampleCount(t, HandlerDuration, "/api/auth/keys/:id", http.MethodGet, "404"))
+}
+
+func TestInstrumentCountsImpersonatedRequests(t *testing.T) {
+	router := httprouter.New()
+	router.GET("/api/auth/me", Instrument("/api/auth/me", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r.Header.Get("Authorization") != "" {
+			logging.SetActor(r.Context(), "1")
+		}
+	}))
+
+	logger := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	counter := ImpersonatedRequests.WithLabelValues("/api/auth/me", http.MethodGet)
+	before := testutil.ToFloat64(counter)
+
+	for _, token := range []string{"", "impersonation"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+		req.Header.Set("Authorization", token)
+		logging.Middleware(logger, router).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
+
+func TestHandlerWithoutConnectedPool(t *testing.T) {
+	handler := Handler(NewPoolCollector(func() *pgxpool.Stat { return nil }))
+	recorder := httptest.NewRecorder()
+
+	Logins.WithLabelValues("success", "").Inc()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Contains(t, string(body), "appman_login_logins_total")
+	assert.NotContains(t, string(body), "appman_login_db_pool_total_connections")
+}
@@ -1,13 +1,32 @@
 package security
 
 import (
+	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"flhansen/application-manager/login-service/src/metrics"
+	"flhansen/application-manager/login-service/src/tracing"
 	"io"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
+// API keys have the format amk_<prefix>_<secret>. The prefix is stored in
+// clear text to find the key, the whole key only as a hash.
+const (
+	ApiKeyMarker       = "amk_"
+	apiKeyPrefixLength = 12
+	apiKeySecretLength = 32
+)
+
+// User codes avoid vowels and ambiguous characters, so they neither form words
+// nor get mistyped (RFC 8628, section 6.1).
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
 type RandomGenerator struct {
 	Reader io.Reader
 }
@@ -23,16 +42,40 @@ func (rng RandomGenerator) GenerateSalt(length int) ([]byte, error) {
 }
 
 func CreatePasswordHash(password string, salt []byte) []byte {
+	return CreatePasswordHashContext(context.Background(), password, salt)
+}
+
+// CreatePasswordHashContext creates the hash within a span of the trace in ctx.
+func CreatePasswordHashContext(ctx context.Context, password string, salt []byte) []byte {
+	_, span := tracing.Start(ctx, "security.CreatePasswordHash")
+	defer span.End()
+
+	return createPasswordHash(password, salt)
+}
+
+func createPasswordHash(password string, salt []byte) []byte {
+	start := time.Now()
 	passwordHash := pbkdf2.Key([]byte(password), salt, 4096, 32, sha256.New)
+	metrics.PasswordHashDuration.Observe(time.Since(start).Seconds())
+
 	return append(salt, passwordHash...)
 }
 
 func ValidatePassword(input string, passwordHashBase64 string) bool {
+	return ValidatePasswordContext(context.Background(), input, passwordHashBase64)
+}
+
+// ValidatePasswordContext validates the password within a span of the trace in
+// ctx.
+func ValidatePasswordContext(ctx context.Context, input string, passwordHashBase64 string) bool {
+	_, span := tracing.Start(ctx, "security.ValidatePassword")
+	defer span.End()
+
 	decodedPasswordHash, _ := base64.StdEncoding.DecodeString(passwordHashBase64)
 	salt := make([]byte, 16)
 	copy(salt, decodedPasswordHash[:16])
 
-	hashedInput := CreatePasswordHash(input, salt)
+	hashedInput := createPasswordHash(input, salt)
 	areEqual := len(decodedPasswordHash) == len(hashedInput)
 
 	for i := 0; i < len(hashedInput) && areEqual; i++ {
@@ -41,3 +84,96 @@ func ValidatePassword(input string, passwordHashBase64 string) bool {
 
 	return areEqual
 }
+
+func (rng RandomGenerator) GenerateApiKey() (key string, prefix string, err error) {
+	random, err := rng.GenerateSalt(apiKeyPrefixLength/2 + apiKeySecretLength)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix = hex.EncodeToString(random[:apiKeyPrefixLength/2])
+	secret := hex.EncodeToString(random[apiKeyPrefixLength/2:])
+
+	return ApiKeyMarker + prefix + "_" + secret, prefix, nil
+}
+
+// ParseApiKeyPrefix returns the lookup prefix of an API key and whether the
+// given string has the format of an API key at all.
+func ParseApiKeyPrefix(key string) (string, bool) {
+	if !strings.HasPrefix(key, ApiKeyMarker) {
+		return "", false
+	}
+
+	rest := key[len(ApiKeyMarker):]
+
+	if len(rest) != apiKeyPrefixLength+1+2*apiKeySecretLength || rest[apiKeyPrefixLength] != '_' {
+		return "", false
+	}
+
+	return rest[:apiKeyPrefixLength], true
+}
+
+// HashToken uses a plain SHA-256, because generated tokens are random and
+// long enough to make key stretching unnecessary.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func HashApiKey(key string) string {
+	return HashToken(key)
+}
+
+func ValidateApiKey(key string, hashBase64 string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashApiKey(key)), []byte(hashBase64)) == 1
+}
+
+func (rng RandomGenerator) GenerateToken(length int) (string, error) {
+	random, err := rng.GenerateSalt(length)
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(random), nil
+}
+
+// GenerateUserCode creates a code of the form XXXX-XXXX.
+func (rng RandomGenerator) GenerateUserCode() (string, error) {
+	code := make([]byte, 0, 9)
+	buffer := make([]byte, 1)
+
+	for len(code) < 9 {
+		if len(code) == 4 {
+			code = append(code, '-')
+			continue
+		}
+
+		if _, err := rng.Reader.Read(buffer); err != nil {
+			return "", err
+		}
+
+		// Reject bytes above the largest multiple of the alphabet size to
+		// keep the distribution uniform
+		if int(buffer[0]) >= 256-256%len(userCodeAlphabet) {
+			continue
+		}
+
+		code = append(code, userCodeAlphabet[int(buffer[0])%len(userCodeAlphabet)])
+	}
+
+	return string(code), nil
+}
+
+// NormalizeUserCode accepts user codes typed in lower case or without the
+// dash.
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+
+	if len(code) != 8 {
+		return code
+	}
+
+	return code[:4] + "-" + code[4:]
+}
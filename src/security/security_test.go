@@ -40,3 +40,77 @@ func TestValidatePassword(t *testing.T) {
 	result := ValidatePassword("password", saltHashBase64)
 	assert.True(t, result)
 }
+
+func TestGenerateApiKey(t *testing.T) {
+	randomGenerator := RandomGenerator{Reader: rand.Reader}
+	key, prefix, err := randomGenerator.GenerateApiKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsedPrefix, ok := ParseApiKeyPrefix(key)
+
+	assert.True(t, ok)
+	assert.Equal(t, prefix, parsedPrefix)
+	assert.Equal(t, 12, len(prefix))
+}
+
+func TestGenerateApiKeyInvalidReader(t *testing.T) {
+	randomGenerator := RandomGenerator{Reader: iotest.ErrReader(errors.New("Invalid reader"))}
+	_, _, err := randomGenerator.GenerateApiKey()
+	assert.NotNil(t, err)
+}
+
+func TestParseApiKeyPrefixInvalid(t *testing.T) {
+	_, ok := ParseApiKeyPrefix("eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9")
+	assert.False(t, ok)
+
+	_, ok = ParseApiKeyPrefix("amk_tooshort")
+	assert.False(t, ok)
+}
+
+func TestValidateApiKey(t *testing.T) {
+	randomGenerator := RandomGenerator{Reader: rand.Reader}
+	key, _, err := randomGenerator.GenerateApiKey()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash := HashApiKey(key)
+
+	assert.True(t, ValidateApiKey(key, hash))
+	assert.False(t, ValidateApiKey(key+"0", hash))
+}
+
+func TestGenerateUserCode(t *testing.T) {
+	randomGenerator := RandomGenerator{Reader: rand.Reader}
+	code, err := randomGenerator.GenerateUserCode()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Regexp(t, "^[BCDFGHJKLMNPQRSTVWXZ]{4}-[BCDFGHJKLMNPQRSTVWXZ]{4}$", code)
+}
+
+func TestGenerateUserCodeInvalidReader(t *testing.T) {
+	randomGenerator := RandomGenerator{Reader: iotest.ErrReader(errors.New("Invalid reader"))}
+	_, err := randomGenerator.GenerateUserCode()
+	assert.NotNil(t, err)
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	assert.Equal(t, "BCDF-GHJK", NormalizeUserCode(" bcdfghjk "))
+	assert.Equal(t, "BCDF-GHJK", NormalizeUserCode("BCDF-GHJK"))
+	assert.Equal(t, "BCD", NormalizeUserCode("bcd"))
+}
+
+func TestGenerateToken(t *testing.T) {
+	randomGenerator := RandomGenerator{Reader: rand.Reader}
+	token, err := randomGenerator.GenerateToken(32)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 64, len(token))
+}
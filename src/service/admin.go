@@ -0,0 +1,335 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/metrics"
+	"flhansen/application-manager/login-service/src/security"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultAccountPageSize = 50
+	maxAccountPageSize     = 200
+	accountAuditEvents     = 50
+)
+
+// encodeCursor hides the id behind an opaque cursor, so clients don't start to
+// build cursors on their own.
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(decoded))
+}
+
+// parseAccountFilter reads the filter of the account list from the query.
+func parseAccountFilter(r *http.Request) (database.AccountFilter, []FieldError) {
+	query := r.URL.Query()
+	filter := database.AccountFilter{Search: query.Get("search"), Limit: defaultAccountPageSize}
+	var errs []FieldError
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		afterId, err := decodeCursor(cursor)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "cursor", Message: "is invalid"})
+		}
+
+		filter.AfterId = afterId
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		pageSize, err := strconv.Atoi(limit)
+		if err != nil || pageSize < 1 || pageSize > maxAccountPageSize {
+			errs = append(errs, FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxAccountPageSize)})
+		}
+
+		filter.Limit = pageSize
+	}
+
+	if status := query.Get("status"); status != "" {
+		if !containsString(database.AccountStatuses, status) {
+			errs = append(errs, FieldError{Field: "status", Message: "is no account status"})
+		}
+
+		filter.Status = status
+	}
+
+	for _, field := range []struct {
+		name  string
+		value **time.Time
+	}{{"createdFrom", &filter.CreatedFrom}, {"createdTo", &filter.CreatedTo}} {
+		if value := query.Get(field.name); value != "" {
+			date, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errs = append(errs, FieldError{Field: field.name, Message: "must be an RFC 3339 date"})
+			}
+
+			*field.value = &date
+		}
+	}
+
+	return filter, errs
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// accountParam loads the account of the id parameter. It answers the request
+// and returns false, if there is no such account.
+func (service *LoginService) accountParam(w http.ResponseWriter, r *http.Request, p httprouter.Params) (database.Account, bool) {
+	accountId, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "id", Message: "Invalid account id"})
+		return database.Account{}, false
+	}
+
+	acc, err := service.db(r).GetAccountById(accountId)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return database.Account{}, false
+	}
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the account")
+		return database.Account{}, false
+	}
+
+	return acc, true
+}
+
+// audited runs change and records it as action of the admin on the account in
+// one transaction, so no action happens without an audit record.
+func (service *LoginService) audited(r *http.Request, accountId int, action string, change func(tx *database.PostgresContext) error) error {
+	principal, _ := authclient.FromContext(r.Context())
+
+	event := database.AuditEvent{
+		ActorId:       principal.UserId,
+		AccountId:     accountId,
+		Action:        action,
+		Impersonation: principal.IsImpersonation(),
+	}
+
+	err := service.db(r).Transaction(func(tx *database.PostgresContext) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+
+		if err := tx.InsertAuditEvent(event); err != nil {
+			service.Logger.ErrorContext(r.Context(), "could not record audit event", "action", action, "error", err)
+			return err
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	service.Logger.WarnContext(r.Context(), "admin action", "action", action, "actorId", principal.UserId, "userId", accountId)
+	return nil
+}
+
+// notOwnAccount prevents admins from locking themselves out.
+func notOwnAccount(w http.ResponseWriter, r *http.Request, acc database.Account) bool {
+	principal, _ := authclient.FromContext(r.Context())
+
+	if acc.Id == principal.UserId {
+		writeError(w, r, http.StatusBadRequest, CodeOwnAccount, "Admins cannot do this to their own account")
+		return false
+	}
+
+	return true
+}
+
+func (service *LoginService) ListAccountsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter, errs := parseAccountFilter(r)
+	if len(errs) > 0 {
+		writeValidationError(w, r, "The request is invalid", errs...)
+		return
+	}
+
+	// One more account tells whether there is a next page
+	pageSize := filter.Limit
+	filter.Limit++
+
+	accounts, err := service.db(r).GetAccounts(filter)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the accounts")
+		return
+	}
+
+	response := map[string]interface{}{}
+
+	if len(accounts) > pageSize {
+		accounts = accounts[:pageSize]
+		response["nextCursor"] = encodeCursor(accounts[pageSize-1].Id)
+	}
+
+	accountResponses := make([]AccountResponse, 0, len(accounts))
+	for _, acc := range accounts {
+		accountResponses = append(accountResponses, NewAccountResponse(acc))
+	}
+
+	response["accounts"] = accountResponses
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Accounts loaded", response))
+}
+
+// GetAccountHandler returns the account including the latest audit events
+// and status changes concerning it.
+func (service *LoginService) GetAccountHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	acc, ok := service.accountParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	events, err := service.db(r).GetAuditEventsByAccount(acc.Id, accountAuditEvents)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the audit events")
+		return
+	}
+
+	auditEvents := make([]AuditEventResponse, 0, len(events))
+	for _, event := range events {
+		auditEvents = append(auditEvents, NewAuditEventResponse(event))
+	}
+
+	changes, err := service.db(r).GetAccountStatusChanges(acc.Id, accountStatusChanges)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the status changes")
+		return
+	}
+
+	statusChanges := make([]AccountStatusChangeResponse, 0, len(changes))
+	for _, change := range changes {
+		statusChanges = append(statusChanges, NewAccountStatusChangeResponse(change))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Account loaded", map[string]interface{}{
+		"account":       NewAccountResponse(acc),
+		"auditEvents":   auditEvents,
+		"statusChanges": statusChanges,
+	}))
+}
+
+// ForcePasswordResetHandler replaces the password by a random one, logs out
+// every session, revokes the api keys and sends a reset link, so the owner has to choose a new
+// password.
+func (service *LoginService) ForcePasswordResetHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	acc, ok := service.accountParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	password, err := rng.GenerateToken(32)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not reset the password")
+		return
+	}
+
+	var message mail.Message
+	err = service.audited(r, acc.Id, "force_password_reset", func(tx *database.PostgresContext) error {
+		if err := tx.UpdateAccountPassword(acc.Id, password); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeSessions(acc.Id, time.Now()); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeApiKeys(acc.Id); err != nil {
+			return err
+		}
+
+		// Admins always send a new link
+		message, _, err = service.insertPasswordReset(tx, acc, 0)
+		return err
+	})
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not force password reset", "userId", acc.Id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not reset the password")
+		return
+	}
+
+	service.sendMail(r.Context(), message)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Password reset, a reset link has been sent"))
+}
+
+func (service *LoginService) DisableAccountHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	acc, ok := service.accountParam(w, r, p)
+	if !ok || !notOwnAccount(w, r, acc) {
+		return
+	}
+
+	if !service.changeAccountStatus(w, r, acc, database.AccountDisabled, "disabled by admin", "disable") {
+		return
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Account disabled"))
+}
+
+// EnableAccountHandler activates disabled, locked and pending accounts.
+func (service *LoginService) EnableAccountHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	acc, ok := service.accountParam(w, r, p)
+	if !ok {
+		return
+	}
+
+	if !service.changeAccountStatus(w, r, acc, database.AccountActive, "enabled by admin", "enable") {
+		return
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Account enabled"))
+}
+
+// DeleteAccountHandler deletes the account of another user. Like every other
+// status change, the account is kept as deleted, so its history stays.
+func (service *LoginService) DeleteAccountHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	acc, ok := service.accountParam(w, r, p)
+	if !ok || !notOwnAccount(w, r, acc) {
+		return
+	}
+
+	err := service.audited(r, acc.Id, "delete", func(tx *database.PostgresContext) error {
+		return service.transitionAccount(r, tx, acc, database.AccountDeleted, "deleted by admin")
+	})
+
+	metrics.Deletions.WithLabelValues(metrics.Outcome(err)).Inc()
+
+	if err != nil {
+		writeTransitionError(w, r, acc, database.AccountDeleted, err)
+		return
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Account deleted"))
+}
@@ -0,0 +1,204 @@
+package service
+
+import (
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/database"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminToken(t *testing.T) (int, string) {
+	adminId, err := loginService.Database.InsertAccount("adminuser", "adminpass", "adminuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		loginService.Database.DeleteAccount(adminId)
+	})
+
+	loginService.Database.SetAccountRole(adminId, database.RoleAdmin)
+
+	token, _ := auth.GenerateToken(adminId, "adminuser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	return adminId, token
+}
+
+func createManagedAccount(t *testing.T, username string) int {
+	accountId, err := loginService.Database.InsertAccount(username, "managedpass", username+"@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		loginService.Database.DeleteAccount(accountId)
+	})
+
+	return accountId
+}
+
+func accountUrl(accountId int, action string) string {
+	return fmt.Sprintf("http://localhost:8080/api/auth/admin/accounts/%d%s", accountId, action)
+}
+
+func TestListAccounts(t *testing.T) {
+	_, token := adminToken(t)
+	for i := 0; i < 3; i++ {
+		createManagedAccount(t, fmt.Sprintf("managed%d", i))
+	}
+
+	var usernames []interface{}
+	url := "http://localhost:8080/api/auth/admin/accounts?search=MANAGED&limit=2"
+
+	for page := 0; page < 2; page++ {
+		resp, res := doRequest(t, http.MethodGet, url, token, nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		for _, account := range res["accounts"].([]interface{}) {
+			usernames = append(usernames, account.(map[string]interface{})["username"])
+		}
+
+		if res["nextCursor"] == nil {
+			break
+		}
+
+		url = fmt.Sprintf("http://localhost:8080/api/auth/admin/accounts?search=managed&limit=2&cursor=%v", res["nextCursor"])
+	}
+
+	assert.Equal(t, []interface{}{"managed0", "managed1", "managed2"}, usernames)
+}
+
+func TestListAccountsFilter(t *testing.T) {
+	_, token := adminToken(t)
+	accountId := createManagedAccount(t, "disableduser")
+	loginService.Database.TransitionAccountStatus(database.AccountStatusChange{AccountId: accountId, OldStatus: database.AccountActive, NewStatus: database.AccountDisabled, Reason: "test"})
+
+	_, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/admin/accounts?status=disabled", token, nil)
+	accounts := res["accounts"].([]interface{})
+
+	assert.Len(t, accounts, 1)
+	assert.Equal(t, "disableduser", accounts[0].(map[string]interface{})["username"])
+
+	from := time.Now().Add(time.Hour).Format(time.RFC3339)
+	_, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/admin/accounts?createdFrom="+from, token, nil)
+	assert.Len(t, res["accounts"], 0)
+
+	// Wildcards of LIKE are matched literally
+	_, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/admin/accounts?search=%25", token, nil)
+	assert.Len(t, res["accounts"], 0)
+}
+
+func TestListAccountsNotAdmin(t *testing.T) {
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/admin/accounts", testUserToken(t), nil)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeAdminRequired, res["code"])
+}
+
+func TestDisableAccount(t *testing.T) {
+	adminId, token := adminToken(t)
+	accountId := createManagedAccount(t, "manageduser")
+	userToken, _ := auth.GenerateToken(accountId, "manageduser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+
+	resp, _ := doRequest(t, http.MethodPost, accountUrl(accountId, "/disable"), token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "manageduser", Password: "managedpass"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeAccountDisabled, res["code"])
+
+	resp, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", userToken, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeAccountDisabled, res["code"])
+
+	resp, _ = doRequest(t, http.MethodPost, accountUrl(accountId, "/enable"), token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", userToken, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	_, res = doRequest(t, http.MethodGet, accountUrl(accountId, ""), token, nil)
+	events := res["auditEvents"].([]interface{})
+
+	assert.Len(t, events, 2)
+	assert.Equal(t, "enable", events[0].(map[string]interface{})["action"])
+	assert.Equal(t, "disable", events[1].(map[string]interface{})["action"])
+	assert.Equal(t, float64(adminId), events[1].(map[string]interface{})["actorId"])
+}
+
+func TestDisableOwnAccount(t *testing.T) {
+	adminId, token := adminToken(t)
+
+	resp, res := doRequest(t, http.MethodPost, accountUrl(adminId, "/disable"), token, nil)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeOwnAccount, res["code"])
+}
+
+func TestForcePasswordReset(t *testing.T) {
+	mailer := recordMails(t)
+	_, token := adminToken(t)
+	accountId := createManagedAccount(t, "manageduser")
+
+	resp, _ := doRequest(t, http.MethodPost, accountUrl(accountId, "/password-reset"), token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, "manageduser@test.com", mailer.receive(t).To)
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "manageduser", Password: "managedpass"})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestDeleteAccountAsAdmin(t *testing.T) {
+	_, token := adminToken(t)
+	accountId := createManagedAccount(t, "manageduser")
+
+	resp, _ := doRequest(t, http.MethodDelete, accountUrl(accountId, ""), token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The account is kept as deleted including its history
+	acc, _ := loginService.Database.GetAccountById(accountId)
+	assert.Equal(t, database.AccountDeleted, acc.Status)
+
+	changes, _ := loginService.Database.GetAccountStatusChanges(accountId, 10)
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "deleted by admin", changes[0].Reason)
+
+	events, _ := loginService.Database.GetAuditEventsByAccount(accountId, 10)
+	assert.Len(t, events, 1)
+
+	// Deleted accounts stay deleted
+	resp, res := doRequest(t, http.MethodDelete, accountUrl(accountId, ""), token, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, CodeInvalidStatusTransition, res["code"])
+}
+
+func TestParseAccountFilter(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/admin/accounts?search=max&status=active&createdFrom=2024-01-01T00:00:00Z&limit=10&cursor="+encodeCursor(42), nil)
+	filter, errs := parseAccountFilter(r)
+
+	assert.Empty(t, errs)
+	assert.Equal(t, "max", filter.Search)
+	assert.Equal(t, database.AccountActive, filter.Status)
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), filter.CreatedFrom.UTC())
+	assert.Nil(t, filter.CreatedTo)
+	assert.Equal(t, 10, filter.Limit)
+	assert.Equal(t, 42, filter.AfterId)
+}
+
+func TestParseAccountFilterInvalid(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/auth/admin/accounts?status=gone&createdTo=yesterday&limit=1000&cursor=***", nil)
+	_, errs := parseAccountFilter(r)
+
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+
+	assert.ElementsMatch(t, []string{"status", "createdTo", "limit", "cursor"}, fields)
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/security"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+var errInvalidApiKey = errors.New("invalid api key")
+
+func (service *LoginService) CreateApiKeyHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req CreateApiKeyRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	principal, _ := authclient.FromContext(r.Context())
+
+	if req.Name == "" || len(req.Name) > 80 {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "name", Message: "The name must have between 1 and 80 characters"})
+		return
+	}
+
+	// A key can never grant more than the credentials it was created with
+	for i, scope := range req.Scopes {
+		if !auth.IsValidScope(scope) || !principal.HasScope(scope) {
+			writeValidationError(w, r, "The request is invalid", FieldError{Field: fmt.Sprintf("scopes.%d", i), Message: fmt.Sprintf("Invalid scope %s", scope)})
+			return
+		}
+	}
+
+	if req.ExpirationDate != nil && req.ExpirationDate.Before(time.Now()) {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "expirationDate", Message: "The expiration date must be in the future"})
+		return
+	}
+
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	key, prefix, err := rng.GenerateApiKey()
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not create api key")
+		return
+	}
+
+	apiKey := database.ApiKey{
+		AccountId:      principal.UserId,
+		Name:           req.Name,
+		Prefix:         prefix,
+		Hash:           security.HashApiKey(key),
+		Scopes:         req.Scopes,
+		ExpirationDate: req.ExpirationDate,
+	}
+
+	id, err := service.db(r).InsertApiKey(apiKey)
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not create api key")
+		return
+	}
+
+	apiKey.Id = id
+
+	// This is the only time the key is shown, afterwards only its hash is known
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Api key created", map[string]interface{}{
+		"key":    key,
+		"apiKey": NewApiKeyResponse(apiKey),
+	}))
+}
+
+func (service *LoginService) ListApiKeysHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+	keys, err := service.db(r).GetApiKeysByAccount(principal.UserId)
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load api keys")
+		return
+	}
+
+	apiKeys := make([]ApiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		apiKeys = append(apiKeys, NewApiKeyResponse(key))
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Api keys loaded", map[string]interface{}{"apiKeys": apiKeys}))
+}
+
+func (service *LoginService) RevokeApiKeyHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+	keyId, err := strconv.Atoi(p.ByName("id"))
+
+	if err != nil {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "id", Message: "Invalid api key id"})
+		return
+	}
+
+	revoked, err := service.db(r).RevokeApiKey(principal.UserId, keyId)
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not revoke api key")
+		return
+	}
+
+	if !revoked {
+		writeError(w, r, http.StatusNotFound, CodeApiKeyNotFound, "Api key not found")
+		return
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Api key revoked"))
+}
+
+func (service LoginService) authenticateApiKey(r *http.Request, key string, prefix string) (*authclient.Principal, error) {
+	apiKey, err := service.db(r).GetApiKeyByPrefix(prefix)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, storeError{err: err}
+	}
+
+	if err != nil || apiKey.Revoked || !security.ValidateApiKey(key, apiKey.Hash) {
+		return nil, errInvalidApiKey
+	}
+
+	if apiKey.ExpirationDate != nil && apiKey.ExpirationDate.Before(time.Now()) {
+		return nil, errInvalidApiKey
+	}
+
+	acc, err := service.db(r).GetAccountById(apiKey.AccountId)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errInvalidApiKey
+	}
+
+	if err != nil {
+		return nil, storeError{err: err}
+	}
+
+	if err := checkAccountStatus(acc); err != nil {
+		return nil, err
+	}
+
+	if err := service.db(r).UpdateApiKeyLastUsed(apiKey.Id, time.Now()); err != nil {
+		return nil, storeError{err: err}
+	}
+
+	scopes := apiKey.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	return &authclient.Principal{
+		UserId:   acc.Id,
+		Username: acc.Username,
+		ApiKeyId: apiKey.Id,
+		Scopes:   scopes,
+	}, nil
+}
+
+// RequireScope must be wrapped by Authenticated.
+func RequireScope(scope string, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal, _ := authclient.FromContext(r.Context())
+
+		if !principal.HasScope(scope) {
+			writeError(w, r, http.StatusForbidden, CodeInsufficientScope, fmt.Sprintf("Missing scope %s", scope))
+			return
+		}
+
+		handler(w, r, p)
+	}
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/security"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func testUserToken(t *testing.T) string {
+	acc, err := loginService.Database.GetAccountByUsername("testuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := auth.GenerateToken(acc.Id, acc.Username, jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func doRequest(t *testing.T, method string, url string, token string, body interface{}) (*http.Response, map[string]interface{}) {
+	var reqBody bytes.Buffer
+
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	if token != "" {
+		req.Header.Add("Authorization", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+
+	return resp, res
+}
+
+func createApiKey(t *testing.T, scopes []string) (string, int) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/keys", testUserToken(t), CreateApiKeyRequest{
+		Name:   "ci",
+		Scopes: scopes,
+	})
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not create api key: %v", res)
+	}
+
+	apiKey := res["apiKey"].(map[string]interface{})
+	return fmt.Sprintf("%v", res["key"]), int(apiKey["id"].(float64))
+}
+
+// insertApiKey creates a key of the account, which may read it.
+func insertApiKey(t *testing.T, accountId int) string {
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	key, prefix, err := rng.GenerateApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loginService.Database.InsertApiKey(database.ApiKey{
+		AccountId: accountId,
+		Name:      "ci",
+		Prefix:    prefix,
+		Hash:      security.HashApiKey(key),
+		Scopes:    []string{auth.ScopeAccountRead},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return "Bearer " + key
+}
+
+func TestCreateApiKey(t *testing.T) {
+	key, _ := createApiKey(t, []string{auth.ScopeKeysManage})
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/keys", "Bearer "+key, nil)
+	apiKeys := res["apiKeys"].([]interface{})
+	lastKey := apiKeys[len(apiKeys)-1].(map[string]interface{})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "ci", lastKey["name"])
+	assert.Nil(t, lastKey["key"])
+	assert.Nil(t, lastKey["hash"])
+	assert.NotNil(t, lastKey["lastUsedDate"])
+}
+
+func TestCreateApiKeyInvalidScope(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/keys", testUserToken(t), CreateApiKeyRequest{
+		Name:   "ci",
+		Scopes: []string{"everything"},
+	})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeValidationFailed, res["code"])
+}
+
+func TestCreateApiKeyExpired(t *testing.T) {
+	expirationDate := time.Now().Add(-time.Hour)
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/keys", testUserToken(t), CreateApiKeyRequest{
+		Name:           "ci",
+		ExpirationDate: &expirationDate,
+	})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestApiKeyMissingScope(t *testing.T) {
+	key, _ := createApiKey(t, []string{auth.ScopeAccountRead})
+
+	resp, _ := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/keys", key, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodDelete, "http://localhost:8080/api/auth/delete", key, nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestRevokeApiKey(t *testing.T) {
+	key, id := createApiKey(t, []string{auth.ScopeKeysManage})
+
+	resp, _ := doRequest(t, http.MethodDelete, fmt.Sprintf("http://localhost:8080/api/auth/keys/%d", id), testUserToken(t), nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/keys", key, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestRevokeApiKeyNotFound(t *testing.T) {
+	resp, _ := doRequest(t, http.MethodDelete, "http://localhost:8080/api/auth/keys/999999", testUserToken(t), nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodDelete, "http://localhost:8080/api/auth/keys/abc", testUserToken(t), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestApiKeyInvalid(t *testing.T) {
+	resp, _ := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/keys", "amk_000000000000_"+string(bytes.Repeat([]byte("0"), 64)), nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"errors"
+	"flhansen/application-manager/login-service/src/database"
+	"net/http"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+// AvailabilityHandler checks usernames and emails with the rules of the
+// registration, so forms can report problems before submitting. Only the
+// given parameters are checked and included in the response.
+func (service *LoginService) AvailabilityHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	query := r.URL.Query()
+	_, hasUsername := query["username"]
+	_, hasEmail := query["email"]
+
+	if !hasUsername && !hasEmail {
+		writeValidationError(w, r, "The request is invalid",
+			FieldError{Field: "username", Message: "username or email is required"},
+			FieldError{Field: "email", Message: "username or email is required"})
+		return
+	}
+
+	availabilities := map[string]interface{}{}
+
+	if hasUsername {
+		availability, err := checkAvailability(service.RegistrationValidator.validateUsername(query.Get("username")), func() (database.Account, error) {
+			return service.db(r).GetAccountByUsername(query.Get("username"))
+		})
+
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not check the availability")
+			return
+		}
+
+		availabilities["username"] = availability
+	}
+
+	if hasEmail {
+		email := normalizeEmail(query.Get("email"))
+		availability, err := checkAvailability(validateEmail(email), func() (database.Account, error) {
+			return service.db(r).GetAccountByEmail(email)
+		})
+
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not check the availability")
+			return
+		}
+
+		availabilities["email"] = availability
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Availability checked", availabilities))
+}
+
+// checkAvailability only looks up valid values, invalid ones are reported with
+// their validation message.
+func checkAvailability(validationMessage string, lookup func() (database.Account, error)) (Availability, error) {
+	if validationMessage != "" {
+		return Availability{Message: validationMessage}, nil
+	}
+
+	_, err := lookup()
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Availability{Available: true}, nil
+	}
+
+	if err != nil {
+		return Availability{}, err
+	}
+
+	return Availability{Message: "is already taken"}, nil
+}
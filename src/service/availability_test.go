@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkAvailabilityRequest(s *LoginService, query string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/availability?"+query, nil)
+	recorder := httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(recorder, req)
+
+	var res map[string]interface{}
+	json.NewDecoder(recorder.Body).Decode(&res)
+	return recorder, res
+}
+
+func TestAvailability(t *testing.T) {
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/availability?username=testuser&email=nobody@test.com", "", nil)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"available": false, "message": "is already taken"}, res["username"])
+	assert.Equal(t, map[string]interface{}{"available": true}, res["email"])
+
+	// Emails are compared ignoring case
+	resp, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/availability?email=TestUser@test.com", "", nil)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]interface{}{"available": false, "message": "is already taken"}, res["email"])
+}
+
+func TestAvailabilityInvalid(t *testing.T) {
+	s := New(ServiceConfig{Jwt: JwtConfig{SignKey: "supersecretsigningkey"}})
+
+	// Invalid values are reported without looking them up
+	recorder, res := checkAvailabilityRequest(s, "username=a&email=nobody")
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "no-store", recorder.Header().Get("Cache-Control"))
+	assert.Equal(t, map[string]interface{}{"available": false, "message": "must be at least 3 characters long"}, res["username"])
+	assert.Equal(t, map[string]interface{}{"available": false, "message": "is no valid email address"}, res["email"])
+
+	_, res = checkAvailabilityRequest(s, "email=nobody")
+	assert.Nil(t, res["username"])
+	assert.NotNil(t, res["email"])
+}
+
+func TestAvailabilityMissingParameters(t *testing.T) {
+	s := New(ServiceConfig{Jwt: JwtConfig{SignKey: "supersecretsigningkey"}})
+
+	recorder, res := checkAvailabilityRequest(s, "")
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+}
+
+func TestAvailabilityRateLimited(t *testing.T) {
+	s := New(ServiceConfig{
+		Jwt:          JwtConfig{SignKey: "supersecretsigningkey"},
+		Availability: RateLimitConfig{Requests: 2},
+	})
+
+	for i := 0; i < 2; i++ {
+		recorder, _ := checkAvailabilityRequest(s, "username=a")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+	}
+
+	recorder, res := checkAvailabilityRequest(s, "username=a")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, CodeRateLimited, res["code"])
+}
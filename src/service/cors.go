@@ -0,0 +1,224 @@
+package service
+
+import (
+	"errors"
+	"flhansen/application-manager/login-service/src/logging"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CorsConfig allows browser clients of other origins to call the service.
+// CORS is disabled unless AllowedOrigins is set.
+type CorsConfig struct {
+	// AllowedOrigins are origins like https://app.example.com. A leading
+	// wildcard label like https://*.example.com matches every subdomain, a
+	// single * matches every origin.
+	AllowedOrigins []string `yaml:"allowedOrigins"`
+	// AllowedMethods default to the methods routed for the requested path
+	AllowedMethods []string `yaml:"allowedMethods"`
+	// AllowedHeaders default to Authorization, Content-Type and X-Request-ID
+	AllowedHeaders   []string `yaml:"allowedHeaders"`
+	AllowCredentials bool     `yaml:"allowCredentials"`
+	// MaxAge is the number of seconds browsers may cache a preflight response
+	MaxAge int `yaml:"maxAge"`
+}
+
+func (config CorsConfig) Enabled() bool {
+	return len(config.AllowedOrigins) > 0
+}
+
+type originPattern struct {
+	prefix string
+	suffix string
+}
+
+func (pattern originPattern) matches(origin string) bool {
+	if len(origin) <= len(pattern.prefix)+len(pattern.suffix) {
+		return false
+	}
+
+	if !strings.HasPrefix(origin, pattern.prefix) || !strings.HasSuffix(origin, pattern.suffix) {
+		return false
+	}
+
+	// The wildcard only stands for subdomains, not for ports or paths
+	subdomain := origin[len(pattern.prefix) : len(origin)-len(pattern.suffix)]
+	return !strings.ContainsAny(subdomain, ":/")
+}
+
+type Cors struct {
+	anyOrigin        bool
+	origins          map[string]bool
+	patterns         []originPattern
+	methods          []string
+	headers          []string
+	allowCredentials bool
+	maxAge           int
+}
+
+func NewCors(config CorsConfig) (*Cors, error) {
+	c := &Cors{
+		origins:          map[string]bool{},
+		allowCredentials: config.AllowCredentials,
+		maxAge:           config.MaxAge,
+	}
+
+	for _, origin := range config.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimRight(strings.TrimSpace(origin), "/"))
+
+		switch {
+		case origin == "*":
+			c.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme := origin[:strings.Index(origin, "*")]
+			c.patterns = append(c.patterns, originPattern{prefix: scheme, suffix: origin[len(scheme)+1:]})
+		case strings.Contains(origin, "*"):
+			return nil, fmt.Errorf("invalid allowed origin %s, wildcards are only allowed for subdomains", origin)
+		case !strings.Contains(origin, "://"):
+			return nil, fmt.Errorf("invalid allowed origin %s, the scheme is missing", origin)
+		default:
+			c.origins[origin] = true
+		}
+	}
+
+	// Browsers refuse credentials for the wildcard origin anyway
+	if c.anyOrigin && c.allowCredentials {
+		return nil, errors.New("credentials can't be allowed for every origin")
+	}
+
+	if c.maxAge < 0 {
+		return nil, errors.New("max age must not be negative")
+	}
+
+	for _, method := range config.AllowedMethods {
+		c.methods = append(c.methods, strings.ToUpper(strings.TrimSpace(method)))
+	}
+
+	c.headers = config.AllowedHeaders
+	if len(c.headers) == 0 {
+		c.headers = []string{"Authorization", "Content-Type", logging.RequestIdHeader}
+	}
+
+	return c, nil
+}
+
+func (c *Cors) allowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+
+	if c.anyOrigin {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+
+	for _, pattern := range c.patterns {
+		if pattern.matches(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Cors) allowsMethod(method string, routed string) bool {
+	methods := c.methods
+	if len(methods) == 0 {
+		methods = strings.Split(routed, ", ")
+	}
+
+	for _, allowed := range methods {
+		if allowed == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Cors) allowsHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+
+		allowed := false
+		for _, h := range c.headers {
+			if strings.EqualFold(h, header) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *Cors) writeOrigin(w http.ResponseWriter, origin string) {
+	// The wildcard is only sent without credentials, otherwise the origin is
+	// reflected
+	if c.anyOrigin && !c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.allowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// Middleware adds the CORS headers to actual requests of allowed origins.
+// Preflight requests are answered by Preflight.
+func (c *Cors) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		if origin := r.Header.Get("Origin"); c.allowsOrigin(origin) {
+			c.writeOrigin(w, origin)
+			w.Header().Set("Access-Control-Expose-Headers", logging.RequestIdHeader)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Preflight answers OPTIONS requests of routed paths. The router sets the
+// Allow header to the routed methods before calling it.
+func (c *Cors) Preflight(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	// Without the CORS headers the browser rejects the actual request
+	if method == "" || !c.allowsOrigin(origin) || !c.allowsMethod(method, w.Header().Get("Allow")) || !c.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+		w.Header().Del("Access-Control-Allow-Origin")
+		w.Header().Del("Access-Control-Allow-Credentials")
+		w.Header().Del("Access-Control-Expose-Headers")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Methods", method)
+	w.Header().Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+
+	if c.maxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.maxAge))
+	}
+
+	c.writeOrigin(w, origin)
+	w.WriteHeader(http.StatusNoContent)
+}
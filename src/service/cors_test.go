@@ -0,0 +1,117 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func corsService(config CorsConfig) *LoginService {
+	return New(ServiceConfig{
+		Jwt:  JwtConfig{SignKey: "supersecretsigningkey"},
+		Cors: config,
+	})
+}
+
+func preflight(s *LoginService, path string, origin string, method string, headers string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodOptions, path, nil)
+	req.Header.Set("Origin", origin)
+	req.Header.Set("Access-Control-Request-Method", method)
+
+	if headers != "" {
+		req.Header.Set("Access-Control-Request-Headers", headers)
+	}
+
+	recorder := httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestNewCorsInvalidConfig(t *testing.T) {
+	for _, config := range []CorsConfig{
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedOrigins: []string{"https://app.*.com"}},
+		{AllowedOrigins: []string{"app.example.com"}},
+		{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: -1},
+	} {
+		_, err := NewCors(config)
+		assert.NotNil(t, err, config)
+	}
+}
+
+func TestCorsOrigins(t *testing.T) {
+	c, err := NewCors(CorsConfig{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, origin := range []string{"https://app.example.com", "https://APP.example.com", "https://a.example.org", "https://a.b.example.org"} {
+		assert.True(t, c.allowsOrigin(origin), origin)
+	}
+
+	for _, origin := range []string{"", "http://app.example.com", "https://example.org", "https://evil.com/.example.org", "https://a.example.org:8443", "https://evilexample.org", "null"} {
+		assert.False(t, c.allowsOrigin(origin), origin)
+	}
+}
+
+func TestCorsPreflight(t *testing.T) {
+	s := corsService(CorsConfig{AllowedOrigins: []string{"https://*.example.com"}, AllowCredentials: true, MaxAge: 600})
+
+	recorder := preflight(s, "/api/auth/login", "https://app.example.com", http.MethodPost, "content-type, authorization")
+
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.Equal(t, "https://app.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", recorder.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, http.MethodPost, recorder.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "600", recorder.Header().Get("Access-Control-Max-Age"))
+	assert.Contains(t, recorder.Header().Values("Vary"), "Origin")
+}
+
+func TestCorsPreflightRejected(t *testing.T) {
+	s := corsService(CorsConfig{AllowedOrigins: []string{"https://app.example.com"}})
+
+	// Unknown origin, method not routed for the path and header not allowed
+	for _, recorder := range []*httptest.ResponseRecorder{
+		preflight(s, "/api/auth/login", "https://evil.com", http.MethodPost, ""),
+		preflight(s, "/api/auth/login", "https://app.example.com", http.MethodDelete, ""),
+		preflight(s, "/api/auth/login", "https://app.example.com", http.MethodPost, "X-Custom"),
+	} {
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+		assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Methods"))
+	}
+}
+
+func TestCorsConfiguredMethods(t *testing.T) {
+	s := corsService(CorsConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"get"}})
+
+	recorder := preflight(s, "/api/auth/keys", "https://app.example.com", http.MethodGet, "")
+	assert.Equal(t, "*", recorder.Header().Get("Access-Control-Allow-Origin"))
+
+	recorder = preflight(s, "/api/auth/keys", "https://app.example.com", http.MethodPost, "")
+	assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+}
+
+func TestCorsActualRequest(t *testing.T) {
+	s := corsService(CorsConfig{AllowedOrigins: []string{"https://app.example.com"}})
+
+	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+
+	recorder := httptest.NewRecorder()
+	s.Server.Handler.ServeHTTP(recorder, req)
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "https://app.example.com", recorder.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "X-Request-ID", recorder.Header().Get("Access-Control-Expose-Headers"))
+	assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Credentials"))
+}
+
+func TestCorsDisabled(t *testing.T) {
+	s := corsService(CorsConfig{})
+
+	recorder := preflight(s, "/api/auth/login", "https://app.example.com", http.MethodPost, "")
+	assert.Empty(t, recorder.Header().Get("Access-Control-Allow-Origin"))
+}
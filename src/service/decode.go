@@ -0,0 +1,102 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const defaultMaxBodyBytes = 1 << 20
+
+// isJsonRequest reports whether the request declares a JSON body. Parameters
+// like the charset are ignored.
+func isJsonRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// limitBody cuts off request bodies larger than MaxBodyBytes, reading beyond
+// the limit fails with a *http.MaxBytesError.
+func (service *LoginService) limitBody(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, service.MaxBodyBytes)
+		}
+
+		handler(w, r, p)
+	}
+}
+
+// writeBodyTooLarge answers with 413 if err is caused by the body limit and
+// reports whether it did.
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+
+	writeError(w, r, http.StatusRequestEntityTooLarge, CodeBodyTooLarge, fmt.Sprintf("The request body must not exceed %d bytes", maxBytesErr.Limit))
+	return true
+}
+
+// decodeJson decodes the body into v. Unlike a plain json.Decoder it rejects
+// other content types, unknown fields and trailing values. On failure the
+// problem is written and false is returned.
+func decodeJson(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if !isJsonRequest(r) {
+		writeError(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "The request body must be application/json")
+		return false
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err == nil {
+		// A second value, even a valid one, means the body is not a single
+		// JSON document
+		if err = decoder.Decode(&struct{}{}); err == io.EOF {
+			return true
+		}
+
+		if !writeBodyTooLarge(w, r, err) {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidJson, "The request body must only contain a single JSON value")
+		}
+
+		return false
+	}
+
+	if writeBodyTooLarge(w, r, err) {
+		return false
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &typeErr):
+		writeValidationError(w, r, "The request body contains an invalid value", FieldError{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be of type %s", typeErr.Type),
+		})
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json has no error type for unknown fields
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		writeValidationError(w, r, "The request body contains an unknown field", FieldError{
+			Field:   field,
+			Message: "unknown field",
+		})
+	case errors.As(err, &syntaxErr):
+		writeError(w, r, http.StatusBadRequest, CodeInvalidJson, fmt.Sprintf("The request body is no valid JSON (at offset %d)", syntaxErr.Offset))
+	default:
+		writeError(w, r, http.StatusBadRequest, CodeInvalidJson, "The request body is no valid JSON")
+	}
+
+	return false
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeLoginRequest(contentType string, body string) (int, Problem, bool) {
+	service := &LoginService{MaxBodyBytes: 64}
+	decoded := false
+
+	handler := service.limitBody(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var req LoginRequest
+		decoded = decodeJson(w, r, &req)
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", contentType)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req, nil)
+
+	var problem Problem
+	json.NewDecoder(recorder.Body).Decode(&problem)
+
+	return recorder.Code, problem, decoded
+}
+
+func TestDecodeJson(t *testing.T) {
+	_, _, decoded := decodeLoginRequest("application/json", `{"username": "testuser", "password": "testpass"}`)
+	assert.True(t, decoded)
+
+	_, _, decoded = decodeLoginRequest("application/json; charset=utf-8", `{"username": "testuser"}`)
+	assert.True(t, decoded)
+}
+
+func TestDecodeJsonContentType(t *testing.T) {
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded"} {
+		status, problem, decoded := decodeLoginRequest(contentType, `{"username": "testuser"}`)
+
+		assert.False(t, decoded, contentType)
+		assert.Equal(t, http.StatusUnsupportedMediaType, status, contentType)
+		assert.Equal(t, CodeUnsupportedMediaType, problem.Code, contentType)
+	}
+}
+
+func TestDecodeJsonTooLarge(t *testing.T) {
+	status, problem, decoded := decodeLoginRequest("application/json", `{"username": "`+strings.Repeat("a", 64)+`"}`)
+
+	assert.False(t, decoded)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, CodeBodyTooLarge, problem.Code)
+}
+
+func TestDecodeJsonUnknownField(t *testing.T) {
+	status, problem, decoded := decodeLoginRequest("application/json", `{"username": "testuser", "admin": true}`)
+
+	assert.False(t, decoded)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, CodeValidationFailed, problem.Code)
+	assert.Equal(t, []FieldError{{Field: "admin", Message: "unknown field"}}, problem.Errors)
+}
+
+func TestDecodeJsonInvalidType(t *testing.T) {
+	status, problem, decoded := decodeLoginRequest("application/json", `{"username": 1}`)
+
+	assert.False(t, decoded)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, CodeValidationFailed, problem.Code)
+	assert.Equal(t, "username", problem.Errors[0].Field)
+}
+
+func TestDecodeJsonMultipleValues(t *testing.T) {
+	for _, body := range []string{`{"username": "testuser"} {}`, `{"username": "testuser"} garbage`, `{} []`} {
+		status, problem, decoded := decodeLoginRequest("application/json", body)
+
+		assert.False(t, decoded, body)
+		assert.Equal(t, http.StatusBadRequest, status, body)
+		assert.Equal(t, CodeInvalidJson, problem.Code, body)
+	}
+}
+
+func TestDecodeJsonInvalid(t *testing.T) {
+	for _, body := range []string{``, `{"username": `, `{"username" "testuser"}`} {
+		status, problem, decoded := decodeLoginRequest("application/json", body)
+
+		assert.False(t, decoded, body)
+		assert.Equal(t, http.StatusBadRequest, status, body)
+		assert.Equal(t, CodeInvalidJson, problem.Code, body)
+	}
+}
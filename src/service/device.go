@@ -0,0 +1,261 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/security"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+const DeviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+type DeviceConfig struct {
+	VerificationUri string `yaml:"verificationUri"`
+	// Lifetime and interval are given in seconds
+	CodeLifetime int `yaml:"codeLifetime"`
+	PollInterval int `yaml:"pollInterval"`
+}
+
+// writeOAuthResponse writes responses in the format of RFC 6749, which OAuth
+// client libraries expect instead of the usual api response.
+func writeOAuthResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string, description string) {
+	writeOAuthResponse(w, status, OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+func (service *LoginService) verificationUri() string {
+	return service.serviceUri(service.DeviceVerificationUri, "/device")
+}
+
+func (service *LoginService) DeviceCodeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The request body could not be parsed")
+		return
+	}
+
+	clientId := r.PostForm.Get("client_id")
+	if clientId == "" || len(clientId) > 80 {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The client_id parameter is missing")
+		return
+	}
+
+	// Devices get the unrestricted token of a login, so no scopes can be
+	// requested
+	if r.PostForm.Get("scope") != "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_scope", "Scopes are not supported")
+		return
+	}
+
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	deviceCode, err := rng.GenerateToken(32)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create device code")
+		return
+	}
+
+	userCode, err := rng.GenerateUserCode()
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create user code")
+		return
+	}
+
+	authorization := database.DeviceAuthorization{
+		DeviceCodeHash: security.HashToken(deviceCode),
+		UserCode:       userCode,
+		ClientId:       clientId,
+		PollInterval:   int(service.DevicePollInterval.Seconds()),
+		ExpirationDate: time.Now().Add(service.DeviceCodeLifetime),
+	}
+
+	if _, err := service.db(r).InsertDeviceAuthorization(authorization); err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not store device authorization")
+		return
+	}
+
+	verificationUri := service.verificationUri()
+
+	writeOAuthResponse(w, http.StatusOK, DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: verificationUri + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(service.DeviceCodeLifetime.Seconds()),
+		Interval:                authorization.PollInterval,
+	})
+}
+
+// DeviceVerifyHandler is called by the verification page, where the logged in
+// user enters the code shown on the device.
+func (service *LoginService) DeviceVerifyHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req DeviceVerifyRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	principal, _ := authclient.FromContext(r.Context())
+
+	authorization, err := service.db(r).GetDeviceAuthorizationByUserCode(security.NormalizeUserCode(req.UserCode))
+
+	if err != nil || authorization.Status != database.DeviceAuthorizationPending || authorization.ExpirationDate.Before(time.Now()) {
+		writeError(w, r, http.StatusNotFound, CodeInvalidUserCode, "Invalid or expired code")
+		return
+	}
+
+	status := database.DeviceAuthorizationApproved
+	message := "Device approved"
+
+	if req.Deny {
+		status = database.DeviceAuthorizationDenied
+		message = "Device denied"
+	}
+
+	decided, err := service.db(r).DecideDeviceAuthorization(authorization.Id, principal.UserId, status)
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not update device authorization")
+		return
+	}
+
+	if !decided {
+		writeError(w, r, http.StatusNotFound, CodeInvalidUserCode, "Invalid or expired code")
+		return
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, message, map[string]interface{}{"clientId": authorization.ClientId}))
+}
+
+func (service *LoginService) TokenHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "The request body could not be parsed")
+		return
+	}
+
+	if r.PostForm.Get("grant_type") != DeviceCodeGrantType {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only the device code grant is supported")
+		return
+	}
+
+	authorization, err := service.db(r).GetDeviceAuthorizationByDeviceCode(security.HashToken(r.PostForm.Get("device_code")))
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Unknown device code")
+		return
+	}
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not look up device code", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not look up device code")
+		return
+	}
+
+	if authorization.ClientId != r.PostForm.Get("client_id") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The device code was issued to another client")
+		return
+	}
+
+	now := time.Now()
+
+	if authorization.ExpirationDate.Before(now) {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "The device code has expired")
+		return
+	}
+
+	switch authorization.Status {
+	case database.DeviceAuthorizationDenied:
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "The user denied the authorization")
+		return
+	case database.DeviceAuthorizationRedeemed:
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The device code has already been used")
+		return
+	case database.DeviceAuthorizationPending:
+		interval := authorization.PollInterval
+		tooFast := authorization.LastPollDate != nil && now.Sub(*authorization.LastPollDate) < time.Duration(interval)*time.Second
+
+		// Clients polling too fast have to wait 5 seconds longer from now on
+		if tooFast {
+			interval += 5
+		}
+
+		if err := service.db(r).UpdateDeviceAuthorizationPoll(authorization.Id, now, interval); err != nil {
+			writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not update device authorization")
+			return
+		}
+
+		if tooFast {
+			writeOAuthError(w, http.StatusBadRequest, "slow_down", "Polling too frequently")
+		} else {
+			writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "The user has not yet approved the device")
+		}
+
+		return
+	}
+
+	redeemed, err := service.db(r).RedeemDeviceAuthorization(authorization.Id)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not redeem device code")
+		return
+	}
+
+	if !redeemed {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The device code has already been used")
+		return
+	}
+
+	acc, err := service.db(r).GetAccountById(authorization.AccountId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The account does not exist anymore")
+		return
+	}
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not look up device account", "accountId", authorization.AccountId, "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not look up account")
+		return
+	}
+
+	if checkAccountStatus(acc) != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "The account is not active")
+		return
+	}
+
+	claims := auth.NewClaims(acc.Id, acc.Username)
+	claims.Role = acc.Role
+	claims.EmailVerified = acc.EmailVerified
+
+	// The token is requested by the device, so the session describes it
+	if err := service.startSession(r, &claims); err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create session")
+		return
+	}
+
+	signedToken, err := service.signToken(claims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "Could not create token")
+		return
+	}
+
+	// The device logs in like using the password, so it is part of the login
+	// history and new devices are reported
+	service.recordSuccessfulLogin(r, acc)
+
+	writeOAuthResponse(w, http.StatusOK, TokenResponse{
+		AccessToken: signedToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(auth.TokenLifetime.Seconds()),
+	})
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/controller"
+	"flhansen/application-manager/login-service/src/database"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func postForm(t *testing.T, path string, values url.Values) (*http.Response, map[string]interface{}) {
+	resp, err := http.PostForm("http://localhost:8080"+path, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+
+	return resp, res
+}
+
+func requestDeviceCode(t *testing.T) DeviceCodeResponse {
+	resp, err := http.PostForm("http://localhost:8080/api/auth/device/code", url.Values{"client_id": {"cli"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res DeviceCodeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func pollToken(t *testing.T, deviceCode string) (*http.Response, map[string]interface{}) {
+	return postForm(t, "/api/auth/token", url.Values{
+		"grant_type":  {DeviceCodeGrantType},
+		"device_code": {deviceCode},
+		"client_id":   {"cli"},
+	})
+}
+
+func TestDeviceCode(t *testing.T) {
+	res := requestDeviceCode(t)
+
+	assert.NotEmpty(t, res.DeviceCode)
+	assert.Regexp(t, "^[A-Z]{4}-[A-Z]{4}$", res.UserCode)
+	assert.Equal(t, "http://localhost:8080/device", res.VerificationUri)
+	assert.Equal(t, 600, res.ExpiresIn)
+	assert.Equal(t, 5, res.Interval)
+}
+
+func TestDeviceCodeMissingClientId(t *testing.T) {
+	resp, res := postForm(t, "/api/auth/device/code", url.Values{})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid_request", res["error"])
+}
+
+func TestDeviceCodeScope(t *testing.T) {
+	resp, res := postForm(t, "/api/auth/device/code", url.Values{"client_id": {"cli"}, "scope": {"account:read"}})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid_scope", res["error"])
+}
+
+func TestDeviceFlow(t *testing.T) {
+	code := requestDeviceCode(t)
+
+	resp, res := pollToken(t, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "authorization_pending", res["error"])
+
+	resp, res = pollToken(t, code.DeviceCode)
+	assert.Equal(t, "slow_down", res["error"])
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/device/verify", testUserToken(t), DeviceVerifyRequest{UserCode: code.UserCode})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res = pollToken(t, code.DeviceCode)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Bearer", res["token_type"])
+
+	claims, err := loginService.Verifier.Verify(context.Background(), res["access_token"].(string))
+	assert.Nil(t, err)
+	assert.Equal(t, "testuser", claims.Username)
+
+	// Logins using the device grant are part of the login history
+	events, _ := loginService.Database.GetLoginEvents(claims.UserId, 1)
+	assert.Len(t, events, 1)
+	assert.Equal(t, database.LoginSucceeded, events[0].Outcome)
+
+	resp, res = pollToken(t, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid_grant", res["error"])
+}
+
+func TestDeviceFlowDenied(t *testing.T) {
+	code := requestDeviceCode(t)
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/device/verify", testUserToken(t), DeviceVerifyRequest{UserCode: code.UserCode, Deny: true})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res := pollToken(t, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "access_denied", res["error"])
+}
+
+func TestDeviceVerifyUnknownCode(t *testing.T) {
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/device/verify", testUserToken(t), DeviceVerifyRequest{UserCode: "BBBB-BBBB"})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestDeviceVerifyWithApiKey(t *testing.T) {
+	code := requestDeviceCode(t)
+	key, _ := createApiKey(t, []string{auth.ScopeAccountRead})
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/device/verify", key, DeviceVerifyRequest{UserCode: code.UserCode})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeApiKeyNotAllowed, res["code"])
+}
+
+func TestTokenUnsupportedGrantType(t *testing.T) {
+	resp, res := postForm(t, "/api/auth/token", url.Values{"grant_type": {"password"}})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "unsupported_grant_type", res["error"])
+}
+
+func TestTokenUnknownDeviceCode(t *testing.T) {
+	resp, res := pollToken(t, "unknown")
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "invalid_grant", res["error"])
+}
+
+func TestTokenDatabaseUnavailable(t *testing.T) {
+	s := New(ServiceConfig{
+		Jwt: JwtConfig{SignKey: "supersecretsigningkey"},
+		Database: controller.DbConfig{
+			Host:     "localhost",
+			Port:     5432,
+			Username: "test",
+			Password: "wrongpassword",
+			Database: "test",
+		},
+	})
+
+	form := url.Values{"grant_type": {DeviceCodeGrantType}, "device_code": {"unknown"}, "client_id": {"cli"}}
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	recorder := httptest.NewRecorder()
+	s.Router.ServeHTTP(recorder, req)
+
+	var res map[string]interface{}
+	json.NewDecoder(recorder.Body).Decode(&res)
+
+	// Failing lookups say nothing about the device code, so clients can retry
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, "server_error", res["error"])
+}
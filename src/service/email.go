@@ -0,0 +1,174 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/security"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+type EmailVerificationConfig struct {
+	// VerifyUri is the page which confirms the email. The token is appended
+	// as query parameter.
+	VerifyUri string `yaml:"verifyUri"`
+	// TokenLifetime and ResendInterval are given in seconds
+	TokenLifetime  int `yaml:"tokenLifetime"`
+	ResendInterval int `yaml:"resendInterval"`
+	// Required rejects logins of unverified accounts. Otherwise they can log
+	// in and the email_verified claim of their tokens is false.
+	Required bool `yaml:"required"`
+}
+
+func (service *LoginService) emailVerifyUri() string {
+	return service.serviceUri(service.EmailVerifyUri, "/email/verify")
+}
+
+// sendEmailVerification stores a new verification token for the email of the
+// account and sends the link to confirm it. Nothing is sent, if the last link
+// was sent less than EmailResendInterval ago.
+func (service *LoginService) sendEmailVerification(r *http.Request, acc database.Account) error {
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	token, err := rng.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+
+	verification := database.EmailVerification{
+		AccountId:      acc.Id,
+		Email:          acc.Email,
+		TokenHash:      security.HashToken(token),
+		ExpirationDate: time.Now().Add(service.EmailVerificationLifetime),
+	}
+
+	now := time.Now()
+	stored, err := service.db(r).InsertEmailVerification(verification, now, now.Add(-service.EmailResendInterval))
+	if err != nil {
+		return err
+	}
+
+	if !stored {
+		service.Logger.InfoContext(r.Context(), "email verification not resent", "userId", acc.Id, "reason", "rate_limited")
+		return nil
+	}
+
+	link := service.emailVerifyUri() + "?token=" + url.QueryEscape(token)
+
+	service.sendMail(r.Context(), mail.Message{
+		To:      acc.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hello %s,\n\nopen the following link to verify your email:\n\n%s\n\nThe link expires in %s.\n",
+			acc.Username, link, service.EmailVerificationLifetime),
+	})
+
+	return nil
+}
+
+func (service *LoginService) VerifyEmailHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req VerifyEmailRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	// The token is only spent, if the email is verified and the account
+	// activated as well, so failures can be retried using the same link
+	var accountId int
+	err := service.db(r).Transaction(func(tx *database.PostgresContext) error {
+		verification, err := tx.RedeemEmailVerification(security.HashToken(req.Token), time.Now())
+		if err != nil {
+			return err
+		}
+
+		accountId = verification.AccountId
+
+		// The email might have been changed after the link was sent
+		verified, err := tx.VerifyEmail(verification.AccountId, verification.Email)
+		if err != nil {
+			return err
+		}
+
+		if !verified {
+			return pgx.ErrNoRows
+		}
+
+		acc, err := tx.GetAccountById(verification.AccountId)
+		if err != nil {
+			return err
+		}
+
+		// Accounts registered while verification was required are activated.
+		// The status might have changed concurrently, which doesn't undo the
+		// verification.
+		if acc.Status == database.AccountPending {
+			if err := service.transitionAccount(r, tx, acc, database.AccountActive, "email verified"); err != nil && !errors.Is(err, errInvalidTransition) {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidVerificationToken, "The verification token is invalid or expired")
+		return
+	}
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not verify email", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not verify the email")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "email verified", "userId", accountId)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Email verified"))
+}
+
+// ResendVerificationHandler doesn't need a token, because unverified accounts
+// may not be able to log in. Like the password reset, it answers the same way
+// whether an email was sent or not. Emails are sent at most once per
+// ResendInterval per account and never to disabled or deleted accounts.
+func (service *LoginService) ResendVerificationHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req ResendVerificationRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	if message := validateEmail(req.Email); message != "" {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "email", Message: message})
+		return
+	}
+
+	if err := service.resendEmailVerification(r, req.Email); err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not resend email verification", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not send the verification email")
+		return
+	}
+
+	writeResponse(w, http.StatusAccepted, NewApiResponse(http.StatusAccepted, "If the email is registered and not verified, a verification link has been sent"))
+}
+
+func (service *LoginService) resendEmailVerification(r *http.Request, email string) error {
+	acc, err := service.db(r).GetAccountByEmailWithStatus(email, mailableStatuses)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+
+	if err != nil || acc.EmailVerified {
+		return err
+	}
+
+	return service.sendEmailVerification(r, acc)
+}
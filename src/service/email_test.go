@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"flhansen/application-manager/login-service/src/database"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func registerVerificationUser(t *testing.T, mailer *recordingMailer) string {
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/register", "", RegisterRequest{Username: "verifyuser", Password: "verifypass", Email: "verifyuser@test.com"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not register the user: %d", resp.StatusCode)
+	}
+
+	t.Cleanup(func() {
+		acc, _ := loginService.Database.GetAccountByUsername("verifyuser")
+		loginService.Database.DeleteAccount(acc.Id)
+	})
+
+	message := mailer.receive(t)
+	assert.Equal(t, "verifyuser@test.com", message.To)
+
+	match := resetTokenPattern.FindStringSubmatch(message.Body)
+	if match == nil {
+		t.Fatalf("No verification link in email: %s", message.Body)
+	}
+
+	return match[1]
+}
+
+func TestEmailVerification(t *testing.T) {
+	mailer := recordMails(t)
+	token := registerVerificationUser(t, mailer)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "verifypass"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	claims, err := loginService.Verifier.Verify(context.Background(), fmt.Sprintf("%v", res["token"]))
+	assert.Nil(t, err)
+	assert.False(t, claims.EmailVerified)
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/verify", "", VerifyEmailRequest{Token: token})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The token is single-use
+	resp, res = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/verify", "", VerifyEmailRequest{Token: token})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidVerificationToken, res["code"])
+
+	resp, res = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "verifypass"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	claims, err = loginService.Verifier.Verify(context.Background(), fmt.Sprintf("%v", res["token"]))
+	assert.Nil(t, err)
+	assert.True(t, claims.EmailVerified)
+
+	_, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", fmt.Sprintf("%v", res["token"]), nil)
+	assert.Equal(t, true, res["account"].(map[string]interface{})["emailVerified"])
+}
+
+func TestEmailVerificationRequired(t *testing.T) {
+	mailer := recordMails(t)
+	token := registerVerificationUser(t, mailer)
+
+	loginService.EmailVerificationRequired = true
+	defer func() {
+		loginService.EmailVerificationRequired = false
+	}()
+
+	// Wrong passwords don't reveal whether the email is verified
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "wrongpass"})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeInvalidCredentials, res["code"])
+
+	resp, res = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "verifypass"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeEmailNotVerified, res["code"])
+
+	doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/verify", "", VerifyEmailRequest{Token: token})
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "verifypass"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestResendEmailVerification(t *testing.T) {
+	mailer := recordMails(t)
+	registerVerificationUser(t, mailer)
+
+	// The registration email was sent just now
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/resend", "", ResendVerificationRequest{Email: "verifyuser@test.com"})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "If the email is registered and not verified, a verification link has been sent", res["message"])
+
+	select {
+	case <-mailer.messages:
+		t.Fatal("The resend interval has been ignored")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	oldInterval := loginService.EmailResendInterval
+	loginService.EmailResendInterval = 0
+	defer func() {
+		loginService.EmailResendInterval = oldInterval
+	}()
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/resend", "", ResendVerificationRequest{Email: "verifyuser@test.com"})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	token := resetTokenPattern.FindStringSubmatch(mailer.receive(t).Body)[1]
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/verify", "", VerifyEmailRequest{Token: token})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Verified accounts don't get any more emails
+	doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/resend", "", ResendVerificationRequest{Email: "verifyuser@test.com"})
+
+	select {
+	case <-mailer.messages:
+		t.Fatal("An email has been sent to a verified account")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResendEmailVerificationUnknownEmail(t *testing.T) {
+	mailer := recordMails(t)
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/resend", "", ResendVerificationRequest{Email: "nobody@test.com"})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	select {
+	case <-mailer.messages:
+		t.Fatal("An email has been sent to an unknown address")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResendEmailVerificationInactiveAccount(t *testing.T) {
+	mailer := recordMails(t)
+
+	for _, status := range []string{database.AccountDisabled, database.AccountDeleted} {
+		accountId, err := loginService.Database.InsertAccountWithStatus("inactiveuser", "inactivepass", "inactiveuser@test.com", status, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/resend", "", ResendVerificationRequest{Email: "inactiveuser@test.com"})
+		loginService.Database.DeleteAccount(accountId)
+
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, status)
+
+		select {
+		case <-mailer.messages:
+			t.Fatalf("An email has been sent to a %s account", status)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestVerifyEmailInvalidToken(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/verify", "", VerifyEmailRequest{Token: "invalid"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidVerificationToken, res["code"])
+}
+
+func TestEmailVerifyUri(t *testing.T) {
+	s := &LoginService{PublicUrl: "https://login.test.com"}
+
+	assert.Equal(t, "https://login.test.com/email/verify", s.emailVerifyUri())
+
+	s.EmailVerifyUri = "https://app.test.com/verify"
+	assert.Equal(t, "https://app.test.com/verify", s.emailVerifyUri())
+}
@@ -0,0 +1,215 @@
+package service
+
+import (
+	"crypto/rand"
+	"errors"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/security"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+type EmailChangeConfig struct {
+	// ConfirmUri is the page which confirms the new email, CancelUri the one
+	// which cancels the change. The token is appended as query parameter.
+	ConfirmUri string `yaml:"confirmUri"`
+	CancelUri  string `yaml:"cancelUri"`
+	// TokenLifetime and CancelLifetime are given in seconds
+	TokenLifetime  int `yaml:"tokenLifetime"`
+	CancelLifetime int `yaml:"cancelLifetime"`
+}
+
+// ChangeEmailHandler only stores the new email. It replaces the current one
+// once confirmed through the link sent to the new email, while the old email
+// is told how to cancel the change. This way a stolen session can't take over
+// the password reset of an account.
+func (service *LoginService) ChangeEmailHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req ChangeEmailRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	principal, _ := authclient.FromContext(r.Context())
+
+	acc, err := service.db(r).GetAccountById(principal.UserId)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not change the email")
+		return
+	}
+
+	if !validPasswordLength(req.Password) || !security.ValidatePasswordContext(r.Context(), req.Password, acc.Password) {
+		service.Logger.InfoContext(r.Context(), "email change failed", "userId", acc.Id, "reason", "wrong_password")
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "password", Message: "is wrong"})
+		return
+	}
+
+	if message := validateEmail(req.Email); message != "" {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "email", Message: message})
+		return
+	}
+
+	if req.Email == acc.Email {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "email", Message: "is the current email"})
+		return
+	}
+
+	if _, err := service.db(r).GetAccountByEmail(req.Email); err == nil {
+		writeError(w, r, http.StatusBadRequest, CodeUserExists, "The email is used by another account")
+		return
+	} else if !errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not change the email")
+		return
+	}
+
+	if err := service.requestEmailChange(r, acc, req.Email); err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not request email change", "userId", acc.Id, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not change the email")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "email change requested", "userId", acc.Id)
+
+	writeResponse(w, http.StatusAccepted, NewApiResponse(http.StatusAccepted, "A confirmation link has been sent to the new email"))
+}
+
+func (service *LoginService) requestEmailChange(r *http.Request, acc database.Account, email string) error {
+	rng := security.RandomGenerator{Reader: rand.Reader}
+
+	token, err := rng.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+
+	cancelToken, err := rng.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	change := database.EmailChange{
+		AccountId:            acc.Id,
+		OldEmail:             acc.Email,
+		NewEmail:             email,
+		TokenHash:            security.HashToken(token),
+		CancelTokenHash:      security.HashToken(cancelToken),
+		ExpirationDate:       now.Add(service.EmailChangeLifetime),
+		CancelExpirationDate: now.Add(service.EmailChangeCancelLifetime),
+	}
+
+	if _, err := service.db(r).InsertEmailChange(change); err != nil {
+		return err
+	}
+
+	confirmLink := service.serviceUri(service.EmailChangeConfirmUri, "/email/change/confirm") + "?token=" + url.QueryEscape(token)
+	cancelLink := service.serviceUri(service.EmailChangeCancelUri, "/email/change/cancel") + "?token=" + url.QueryEscape(cancelToken)
+
+	service.sendMail(r.Context(), mail.Message{
+		To:      email,
+		Subject: "Confirm your new email",
+		Body: fmt.Sprintf("Hello %s,\n\nopen the following link to use this email for your account:\n\n%s\n\nThe link expires in %s.\n",
+			acc.Username, confirmLink, service.EmailChangeLifetime),
+	})
+
+	service.sendMail(r.Context(), mail.Message{
+		To:      acc.Email,
+		Subject: "Your email is about to change",
+		Body: fmt.Sprintf("Hello %s,\n\nsomeone requested to change the email of your account to %s.\n\nIf this wasn't you, open the following link to keep this email and log out all sessions:\n\n%s\n\nThe link expires in %s.\n",
+			acc.Username, email, cancelLink, service.EmailChangeCancelLifetime),
+	})
+
+	return nil
+}
+
+func (service *LoginService) ConfirmEmailChangeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req EmailChangeTokenRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	accountId, err := service.db(r).ConfirmEmailChange(security.HashToken(req.Token), time.Now())
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidEmailChangeToken, "The email change token is invalid or expired")
+		return
+	}
+
+	if errors.Is(err, database.ErrAccountExists) {
+		writeError(w, r, http.StatusBadRequest, CodeUserExists, "The email is used by another account")
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not change the email")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "email changed", "userId", accountId)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Email changed"))
+}
+
+// CancelEmailChangeHandler keeps or restores the old email. Since the change
+// wasn't requested by the owner of the old email, every session is logged out,
+// api keys are revoked and links sent in the meantime, like password resets,
+// are invalidated.
+func (service *LoginService) CancelEmailChangeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req EmailChangeTokenRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	var accountId int
+	err := service.db(r).Transaction(func(tx *database.PostgresContext) error {
+		now := time.Now()
+
+		var err error
+		if accountId, err = tx.CancelEmailChange(security.HashToken(req.Token), now); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeSessions(accountId, now); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeApiKeys(accountId); err != nil {
+			return err
+		}
+
+		if err := tx.DeletePasswordResets(accountId); err != nil {
+			return err
+		}
+
+		return tx.DeleteEmailVerifications(accountId)
+	})
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidEmailChangeToken, "The email change token is invalid or expired")
+		return
+	}
+
+	if errors.Is(err, database.ErrAccountExists) {
+		writeError(w, r, http.StatusBadRequest, CodeUserExists, "The old email is used by another account by now")
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not cancel the email change")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "email change cancelled", "userId", accountId)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Email change cancelled"))
+}
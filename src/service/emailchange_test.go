@@ -0,0 +1,168 @@
+package service
+
+import (
+	"flhansen/application-manager/login-service/src/auth"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func createEmailChangeUser(t *testing.T) (int, string) {
+	accountId, err := loginService.Database.InsertAccount("changeuser", "changepass", "changeuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		loginService.Database.DeleteAccount(accountId)
+	})
+
+	// Issued before the change, so it can be revoked by a cancellation
+	claims := auth.NewClaims(accountId, "changeuser")
+	claims.IssuedAt = time.Now().Add(-time.Minute).Unix()
+	token, _ := auth.GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsigningkey"), "")
+
+	return accountId, token
+}
+
+// requestEmailChange returns the tokens of the confirmation and the
+// cancellation link.
+func requestEmailChange(t *testing.T, mailer *recordingMailer, token string, email string) (string, string) {
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change", token, ChangeEmailRequest{Password: "changepass", Email: email})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Could not request the email change: %d", resp.StatusCode)
+	}
+
+	var confirmToken, cancelToken string
+
+	for i := 0; i < 2; i++ {
+		message := mailer.receive(t)
+		match := resetTokenPattern.FindStringSubmatch(message.Body)
+		if match == nil {
+			t.Fatalf("No link in email: %s", message.Body)
+		}
+
+		if message.To == email {
+			confirmToken = match[1]
+		} else {
+			assert.Equal(t, "changeuser@test.com", message.To)
+			cancelToken = match[1]
+		}
+	}
+
+	return confirmToken, cancelToken
+}
+
+func TestChangeEmail(t *testing.T) {
+	mailer := recordMails(t)
+	accountId, token := createEmailChangeUser(t)
+
+	confirmToken, _ := requestEmailChange(t, mailer, token, "changed@test.com")
+
+	// The email is only changed after the confirmation
+	acc, _ := loginService.Database.GetAccountById(accountId)
+	assert.Equal(t, "changeuser@test.com", acc.Email)
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/confirm", "", EmailChangeTokenRequest{Token: confirmToken})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	acc, _ = loginService.Database.GetAccountById(accountId)
+	assert.Equal(t, "changed@test.com", acc.Email)
+	assert.True(t, acc.EmailVerified)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/confirm", "", EmailChangeTokenRequest{Token: confirmToken})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidEmailChangeToken, res["code"])
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestCancelEmailChange(t *testing.T) {
+	mailer := recordMails(t)
+	accountId, token := createEmailChangeUser(t)
+	apiKey := insertApiKey(t, accountId)
+
+	confirmToken, cancelToken := requestEmailChange(t, mailer, token, "changed@test.com")
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/confirm", "", EmailChangeTokenRequest{Token: confirmToken})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Confirmed changes can still be cancelled by the owner of the old email
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/cancel", "", EmailChangeTokenRequest{Token: cancelToken})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	acc, _ := loginService.Database.GetAccountById(accountId)
+	assert.Equal(t, "changeuser@test.com", acc.Email)
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeSessionRevoked, res["code"])
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", apiKey, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, res = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/cancel", "", EmailChangeTokenRequest{Token: cancelToken})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidEmailChangeToken, res["code"])
+}
+
+func TestChangeEmailReplacesPendingChange(t *testing.T) {
+	mailer := recordMails(t)
+	accountId, token := createEmailChangeUser(t)
+
+	firstToken, _ := requestEmailChange(t, mailer, token, "first@test.com")
+	secondToken, _ := requestEmailChange(t, mailer, token, "second@test.com")
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/confirm", "", EmailChangeTokenRequest{Token: firstToken})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change/confirm", "", EmailChangeTokenRequest{Token: secondToken})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	acc, _ := loginService.Database.GetAccountById(accountId)
+	assert.Equal(t, "second@test.com", acc.Email)
+}
+
+func TestChangeEmailWrongPassword(t *testing.T) {
+	mailer := recordMails(t)
+	_, token := createEmailChangeUser(t)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change", token, ChangeEmailRequest{Password: "wrongpass", Email: "changed@test.com"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+
+	select {
+	case <-mailer.messages:
+		t.Fatal("An email has been sent without the password")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestChangeEmailTaken(t *testing.T) {
+	_, token := createEmailChangeUser(t)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change", token, ChangeEmailRequest{Password: "changepass", Email: "testuser@test.com"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeUserExists, res["code"])
+}
+
+func TestChangeEmailApiKey(t *testing.T) {
+	key, _ := createApiKey(t, []string{auth.ScopeAccountRead})
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change", key, ChangeEmailRequest{Password: "testpass", Email: "changed@test.com"})
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeApiKeyNotAllowed, res["code"])
+}
+
+func TestChangeEmailUnauthenticated(t *testing.T) {
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/change", "", ChangeEmailRequest{Password: "changepass", Email: "changed@test.com"})
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"flhansen/application-manager/login-service/src/database"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	HealthOk   = "ok"
+	HealthFail = "fail"
+)
+
+// Probes must answer before the orchestrator gives up, even when the database
+// hangs.
+const readinessTimeout = 2 * time.Second
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func newHealthCheck(err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: HealthFail, Error: err.Error()}
+	}
+
+	return HealthCheck{Status: HealthOk}
+}
+
+// HealthzHandler only reports that the process is able to serve requests.
+func (service *LoginService) HealthzHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Service is alive"))
+}
+
+// ReadyzHandler reports whether all dependencies needed to serve requests are
+// available, with the result of every single check.
+func (service *LoginService) ReadyzHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	db := service.Database.WithContext(ctx)
+	checks := map[string]HealthCheck{
+		"database": newHealthCheck(db.Ping()),
+	}
+
+	// The schema can't be checked without a database connection
+	if checks["database"].Status == HealthOk {
+		checks["migrations"] = newHealthCheck(checkSchemaVersion(db))
+	} else {
+		checks["migrations"] = newHealthCheck(errors.New("database not reachable"))
+	}
+
+	checks["signingKeys"] = newHealthCheck(service.checkSigningKey())
+
+	status := http.StatusOK
+	message := "Service is ready"
+
+	for _, check := range checks {
+		if check.Status != HealthOk {
+			status = http.StatusServiceUnavailable
+			message = "Service is not ready"
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, status, NewApiResponseObject(status, message, map[string]interface{}{"checks": checks}))
+}
+
+func checkSchemaVersion(db *database.PostgresContext) error {
+	version, err := db.GetSchemaVersion()
+
+	if err != nil {
+		return err
+	}
+
+	if version != database.SchemaVersion {
+		return fmt.Errorf("schema version is %d, expected %d, run the migrate command", version, database.SchemaVersion)
+	}
+
+	return nil
+}
+
+func (service *LoginService) checkSigningKey() error {
+	switch key := service.JwtSignKey.(type) {
+	case []byte:
+		if len(key) == 0 {
+			return errors.New("no signing key configured")
+		}
+	case *rsa.PrivateKey:
+		return key.Validate()
+	default:
+		return errors.New("no signing key configured")
+	}
+
+	return nil
+}
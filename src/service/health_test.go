@@ -0,0 +1,67 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/controller"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthz(t *testing.T) {
+	resp, _ := doRequest(t, http.MethodGet, "http://localhost:8080/healthz", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestReadyz(t *testing.T) {
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/readyz", "", nil)
+	checks := res["checks"].(map[string]interface{})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, HealthOk, checks["database"].(map[string]interface{})["status"])
+	assert.Equal(t, HealthOk, checks["migrations"].(map[string]interface{})["status"])
+	assert.Equal(t, HealthOk, checks["signingKeys"].(map[string]interface{})["status"])
+}
+
+func TestReadyzWrongDatabaseCredentials(t *testing.T) {
+	s := New(ServiceConfig{
+		Jwt: JwtConfig{SignKey: "supersecretsigningkey"},
+		Database: controller.DbConfig{
+			Host:     "localhost",
+			Port:     5432,
+			Username: "test",
+			Password: "wrongpassword",
+			Database: "test",
+		},
+	})
+
+	recorder := httptest.NewRecorder()
+	s.Router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var res struct {
+		Checks map[string]HealthCheck `json:"checks"`
+	}
+
+	json.NewDecoder(recorder.Body).Decode(&res)
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+	assert.Equal(t, HealthFail, res.Checks["database"].Status)
+	assert.Equal(t, HealthFail, res.Checks["migrations"].Status)
+	assert.Equal(t, HealthOk, res.Checks["signingKeys"].Status)
+}
+
+func TestCheckSigningKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.NotNil(t, New(ServiceConfig{}).checkSigningKey())
+	assert.NotNil(t, New(ServiceConfig{Jwt: JwtConfig{SignKey: ""}}).checkSigningKey())
+	assert.Nil(t, New(ServiceConfig{Jwt: JwtConfig{SignKey: "secret"}}).checkSigningKey())
+	assert.Nil(t, New(ServiceConfig{Jwt: JwtConfig{SignKey: privateKey}}).checkSigningKey())
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	defaultActivityPageSize = 20
+	maxActivityPageSize     = 100
+)
+
+// LoginHistoryConfig values are given in seconds. Events older than
+// Retention are deleted every PruneInterval.
+type LoginHistoryConfig struct {
+	Retention     int `yaml:"retention"`
+	PruneInterval int `yaml:"pruneInterval"`
+}
+
+// recordLogin adds an attempt to the login history of the account. An empty
+// reason records a successful login.
+func (service *LoginService) recordLogin(r *http.Request, accountId int, reason string) {
+	service.insertLoginEvent(r, newLoginEvent(r, accountId, reason))
+}
+
+// recordSuccessfulLogin checks the device of the login as well, logins from
+// new devices are flagged in the history.
+func (service *LoginService) recordSuccessfulLogin(r *http.Request, acc database.Account) {
+	event := newLoginEvent(r, acc.Id, "")
+	event.NewDevice = service.checkNewDevice(r, acc)
+
+	service.insertLoginEvent(r, event)
+}
+
+func newLoginEvent(r *http.Request, accountId int, reason string) database.LoginEvent {
+	event := database.LoginEvent{
+		AccountId:     accountId,
+		Outcome:       database.LoginSucceeded,
+		FailureReason: reason,
+		IpAddress:     clientAddress(r),
+		UserAgent:     userAgent(r),
+		CreationDate:  time.Now(),
+	}
+
+	if reason != "" {
+		event.Outcome = database.LoginFailed
+	}
+
+	return event
+}
+
+// insertLoginEvent only logs failures, since the history is informational.
+func (service *LoginService) insertLoginEvent(r *http.Request, event database.LoginEvent) {
+	if _, err := service.db(r).InsertLoginEvent(event); err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not record login", "userId", event.AccountId, "error", err)
+	}
+}
+
+// ActivityHandler lists the latest login attempts of the user, so they can
+// spot logins they don't recognize.
+func (service *LoginService) ActivityHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+	limit := defaultActivityPageSize
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+
+		if err != nil || limit < 1 || limit > maxActivityPageSize {
+			writeValidationError(w, r, "The request is invalid", FieldError{Field: "limit", Message: "must be between 1 and " + strconv.Itoa(maxActivityPageSize)})
+			return
+		}
+	}
+
+	events, err := service.db(r).GetLoginEvents(principal.UserId, limit)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the activity")
+		return
+	}
+
+	loginEvents := make([]LoginEventResponse, 0, len(events))
+	for _, event := range events {
+		loginEvents = append(loginEvents, NewLoginEventResponse(event))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Activity loaded", map[string]interface{}{"loginEvents": loginEvents}))
+}
+
+// pruneLoginHistory deletes login events older than LoginHistoryRetention
+// every LoginHistoryPruneInterval until the context is cancelled.
+func (service *LoginService) pruneLoginHistory(ctx context.Context) {
+	ticker := time.NewTicker(service.LoginHistoryPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		service.pruneLoginEvents(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (service *LoginService) pruneLoginEvents(ctx context.Context) {
+	deleted, err := service.Database.WithContext(ctx).DeleteLoginEventsBefore(time.Now().Add(-service.LoginHistoryRetention))
+
+	if err != nil {
+		service.Logger.ErrorContext(ctx, "could not prune login history", "error", err)
+		return
+	}
+
+	if deleted > 0 {
+		service.Logger.InfoContext(ctx, "login history pruned", "deleted", deleted)
+	}
+}
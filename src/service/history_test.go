@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"flhansen/application-manager/login-service/src/database"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivity(t *testing.T) {
+	createManagedAccount(t, "historyuser")
+
+	doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "historyuser", Password: "wrongpass"})
+	token := loginSession(t, "historyuser", "managedpass")
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/activity", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	events := res["loginEvents"].([]interface{})
+	assert.Len(t, events, 2)
+	assert.Equal(t, database.LoginSucceeded, events[0].(map[string]interface{})["outcome"])
+	assert.Equal(t, database.LoginFailed, events[1].(map[string]interface{})["outcome"])
+	assert.Equal(t, "wrong_password", events[1].(map[string]interface{})["failureReason"])
+
+	_, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	assert.NotNil(t, res["account"].(map[string]interface{})["lastLoginDate"])
+
+	_, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/activity?limit=1", token, nil)
+	assert.Len(t, res["loginEvents"], 1)
+}
+
+func TestActivityInvalidLimit(t *testing.T) {
+	resp, res := doRequest(t, http.MethodGet, fmt.Sprintf("http://localhost:8080/api/auth/activity?limit=%d", maxActivityPageSize+1), testUserToken(t), nil)
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+}
+
+func TestPruneLoginEvents(t *testing.T) {
+	accountId := createManagedAccount(t, "historyuser")
+
+	loginService.Database.InsertLoginEvent(database.LoginEvent{AccountId: accountId, Outcome: database.LoginSucceeded, CreationDate: time.Now().Add(-loginService.LoginHistoryRetention - time.Hour)})
+	loginService.Database.InsertLoginEvent(database.LoginEvent{AccountId: accountId, Outcome: database.LoginSucceeded, CreationDate: time.Now()})
+
+	loginService.pruneLoginEvents(context.Background())
+
+	events, err := loginService.Database.GetLoginEvents(accountId, 10)
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+}
@@ -1,138 +1,800 @@
 package service
 
 import (
+	"context"
+	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/authclient"
 	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/logging"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/metrics"
 	"flhansen/application-manager/login-service/src/security"
+	"flhansen/application-manager/login-service/src/tracing"
 	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"github.com/jackc/pgx/v4"
 	"github.com/julienschmidt/httprouter"
 )
 
 type JwtConfig struct {
-	SignKey interface{}
+	SignKey        interface{}
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	KeyId          string `yaml:"keyId"`
+	Issuer         string `yaml:"issuer"`
+	Audience       string `yaml:"audience"`
 }
 
 type LoginService struct {
-	Port       int
-	Host       string
-	Router     *httprouter.Router
-	JwtSignKey interface{}
-	Database   *database.PostgresContext
+	Port             int
+	Host             string
+	Router           *httprouter.Router
+	JwtSignKey       interface{}
+	JwtSigningMethod jwt.SigningMethod
+	JwtKeyId         string
+	JwtIssuer        string
+	JwtAudience      string
+	Verifier         *authclient.Verifier
+	Database         *database.PostgresContext
+	Logger           *slog.Logger
+
+	RegistrationValidator *RegistrationValidator
+	Mailer                mail.Mailer
+
+	// PublicUrl is where users reach the service, links in emails point to it
+	PublicUrl string
+
+	PasswordResetUri            string
+	PasswordResetLifetime       time.Duration
+	PasswordResetResendInterval time.Duration
+
+	EmailVerifyUri            string
+	EmailVerificationLifetime time.Duration
+	EmailResendInterval       time.Duration
+	EmailVerificationRequired bool
+
+	EmailChangeConfirmUri     string
+	EmailChangeCancelUri      string
+	EmailChangeLifetime       time.Duration
+	EmailChangeCancelLifetime time.Duration
+
+	AvailabilityLimiter *RateLimiter
+
+	LoginHistoryRetention     time.Duration
+	LoginHistoryPruneInterval time.Duration
+
+	DeviceNotifier          DeviceNotifier
+	NewDeviceReportUri      string
+	NewDeviceReportLifetime time.Duration
+
+	DeviceVerificationUri string
+	DeviceCodeLifetime    time.Duration
+	DevicePollInterval    time.Duration
+
+	Server *http.Server
+	// MetricsServer serves /metrics on its own listener or is nil, if the
+	// metrics are disabled
+	MetricsServer   *http.Server
+	ShutdownTimeout time.Duration
+	MaxBodyBytes    int64
+	Tls             TlsConfig
+
+	// background is cancelled on shutdown to stop background jobs
+	background     context.Context
+	stopBackground context.CancelFunc
 }
 
 func (service *LoginService) LoginHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	var req LoginRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, NewApiResponse(http.StatusInternalServerError, "An error occured while parsing the request body"))
+	if !decodeJson(w, r, &req) {
+		metrics.Logins.WithLabelValues("failure", "invalid_request").Inc()
 		return
 	}
 
-	acc, err := service.Database.GetAccountByUsername(req.Username)
+	acc, err := service.db(r).GetAccountByUsername(req.Username)
 
-	if err != nil || !security.ValidatePassword(req.Password, acc.Password) || acc.Id == 0 {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, NewApiResponse(http.StatusUnauthorized, "Wrong credentials"))
+	if err != nil || acc.Id == 0 {
+		service.Logger.InfoContext(r.Context(), "login failed", "username", req.Username, "reason", "unknown_user")
+		metrics.Logins.WithLabelValues("failure", "unknown_user").Inc()
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Wrong credentials")
 		return
 	}
 
-	signedToken, err := auth.GenerateToken(acc.Id, acc.Username, jwt.SigningMethodHS256, service.JwtSignKey)
+	if !validPasswordLength(req.Password) || !security.ValidatePasswordContext(r.Context(), req.Password, acc.Password) {
+		service.Logger.InfoContext(r.Context(), "login failed", "username", req.Username, "reason", "wrong_password")
+		metrics.Logins.WithLabelValues("failure", "wrong_password").Inc()
+		service.recordLogin(r, acc.Id, "wrong_password")
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidCredentials, "Wrong credentials")
+		return
+	}
+
+	// Checked after the password, so the response doesn't reveal the state of
+	// an account to someone who doesn't know the password
+	if err := checkAccountStatus(acc); err != nil {
+		service.Logger.InfoContext(r.Context(), "login failed", "username", req.Username, "reason", "account_"+acc.Status)
+		metrics.Logins.WithLabelValues("failure", "account_"+acc.Status).Inc()
+		service.recordLogin(r, acc.Id, "account_"+acc.Status)
+		writeAccountStatusError(w, r, acc.Status)
+		return
+	}
+
+	if service.EmailVerificationRequired && !acc.EmailVerified {
+		service.Logger.InfoContext(r.Context(), "login failed", "username", req.Username, "reason", "email_not_verified")
+		metrics.Logins.WithLabelValues("failure", "email_not_verified").Inc()
+		service.recordLogin(r, acc.Id, "email_not_verified")
+		writeError(w, r, http.StatusForbidden, CodeEmailNotVerified, "The email has not been verified yet")
+		return
+	}
+
+	claims := auth.NewClaims(acc.Id, acc.Username)
+	claims.Role = acc.Role
+	claims.EmailVerified = acc.EmailVerified
+
+	if err := service.startSession(r, &claims); err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not create session", "error", err)
+		metrics.Logins.WithLabelValues("failure", "session_error").Inc()
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not create session")
+		return
+	}
+
+	signedToken, err := service.signToken(claims)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, NewApiResponse(http.StatusInternalServerError, "Could not create token"))
+		service.Logger.ErrorContext(r.Context(), "could not create token", "error", err)
+		metrics.Logins.WithLabelValues("failure", "token_error").Inc()
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not create token")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, NewApiResponseObject(http.StatusOK, "User has been logged in", map[string]interface{}{"token": signedToken}))
+	service.Logger.InfoContext(r.Context(), "login succeeded", "userId", acc.Id)
+	metrics.Logins.WithLabelValues("success", "").Inc()
+	service.recordSuccessfulLogin(r, acc)
+
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "User has been logged in", map[string]interface{}{"token": signedToken}))
 }
 
 func (service *LoginService) RegisterHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	var req RegisterRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, NewApiResponse(http.StatusInternalServerError, "An error occured while parsing the request body"))
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	if errs := service.RegistrationValidator.Validate(req); len(errs) > 0 {
+		metrics.Registrations.WithLabelValues("invalid").Inc()
+		writeValidationError(w, r, "The registration is invalid", errs...)
 		return
 	}
 
-	_, err := service.Database.InsertAccount(req.Username, req.Password, req.Email, time.Now())
+	// Accounts stay pending until their email is verified, if verification is
+	// required
+	status := database.AccountActive
+	if service.EmailVerificationRequired {
+		status = database.AccountPending
+	}
+
+	id, err := service.db(r).InsertAccountWithStatus(req.Username, req.Password, req.Email, status, time.Now())
+	metrics.Registrations.WithLabelValues(metrics.Outcome(err)).Inc()
+
+	if errors.Is(err, database.ErrAccountExists) {
+		service.Logger.InfoContext(r.Context(), "registration failed", "username", req.Username, "error", err)
+		writeError(w, r, http.StatusBadRequest, CodeUserExists, "User already exists")
+		return
+	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, NewApiResponse(http.StatusBadRequest, "User already exists"))
+		service.Logger.ErrorContext(r.Context(), "could not register user", "username", req.Username, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Error while trying to register the user")
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, NewApiResponse(http.StatusOK, "User registered"))
+	service.Logger.InfoContext(r.Context(), "user registered", "userId", id)
+
+	// The account exists already, so a failed email only gets logged. The user
+	// can request a new one.
+	acc := database.Account{Id: id, Username: req.Username, Email: req.Email, Status: status}
+	if err := service.sendEmailVerification(r, acc); err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not send email verification", "userId", id, "error", err)
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "User registered"))
 }
 
+// DeleteHandler deletes the account of the principal. The account is kept as
+// deleted, so it can't be used anymore while its history stays.
 func (service *LoginService) DeleteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	username := r.Header.Get("username")
+	principal, _ := authclient.FromContext(r.Context())
+
+	acc, err := service.db(r).GetAccountById(principal.UserId)
+	if err == nil {
+		err = service.transitionAccount(r, service.db(r), acc, database.AccountDeleted, "deleted by the owner")
+	}
+
+	metrics.Deletions.WithLabelValues(metrics.Outcome(err)).Inc()
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not delete user", "userId", principal.UserId, "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Error while trying to delete the user")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "user deleted", "userId", principal.UserId)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "User deleted"))
+}
+
+// MeHandler returns the account of the principal as stored, so changes after
+// the token was issued are visible.
+func (service *LoginService) MeHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+	acc, err := service.db(r).GetAccountById(principal.UserId)
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the account")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Account loaded", map[string]interface{}{"account": NewAccountResponse(acc)}))
+}
+
+func (service *LoginService) ImpersonateHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req ImpersonateRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	principal, _ := authclient.FromContext(r.Context())
+	acc, err := service.db(r).GetAccountByUsername(req.Username)
 
-	if err := service.Database.DeleteAccountByUsername(username); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprint(w, NewApiResponse(http.StatusUnauthorized, "Error while trying to delete the user"))
+	if err != nil || acc.Id == 0 {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "User not found")
 		return
 	}
 
+	if acc.Id == principal.UserId {
+		writeError(w, r, http.StatusBadRequest, CodeSelfImpersonation, "You cannot impersonate yourself")
+		return
+	}
+
+	// The token would pass AdminOnly, so admins could act as each other
+	if acc.Role == database.RoleAdmin {
+		writeError(w, r, http.StatusForbidden, CodeImpersonationNotAllowed, "Admins cannot be impersonated")
+		return
+	}
+
+	claims := auth.NewImpersonationClaims(acc.Id, acc.Username, principal.UserId, principal.Username)
+	claims.Role = acc.Role
+	claims.EmailVerified = acc.EmailVerified
+
+	signedToken, err := service.signToken(claims)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not create token")
+		return
+	}
+
+	// Without an audit record no impersonation token must be handed out
+	event := database.AuditEvent{
+		ActorId:       principal.UserId,
+		AccountId:     acc.Id,
+		Action:        "impersonate",
+		Impersonation: true,
+	}
+
+	if err := service.db(r).InsertAuditEvent(event); err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not record audit event", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not record audit event")
+		return
+	}
+
+	service.Logger.WarnContext(r.Context(), "impersonation token created", "actorId", principal.UserId, "userId", acc.Id, "impersonation", true)
+
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Impersonation token created", map[string]interface{}{"token": signedToken}))
+}
+
+func (service *LoginService) JwksHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	keys := auth.JSONWebKeySet{Keys: []auth.JSONWebKey{}}
+
+	// Shared HMAC secrets must never be published, so only asymmetric keys are listed
+	if privateKey, ok := service.JwtSignKey.(*rsa.PrivateKey); ok {
+		keys.Keys = append(keys.Keys, auth.NewRSAJSONWebKey(service.JwtKeyId, service.JwtSigningMethod.Alg(), &privateKey.PublicKey))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
 	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, NewApiResponse(http.StatusOK, "User deleted"))
+	json.NewEncoder(w).Encode(keys)
+}
+
+// db returns the database context bound to the request, so queries are
+// cancelled with the request and logged with its request id.
+func (service LoginService) db(r *http.Request) *database.PostgresContext {
+	return service.Database.WithContext(r.Context())
+}
+
+func (service *LoginService) signToken(claims auth.JwtClaims) (string, error) {
+	claims.Issuer = service.JwtIssuer
+	claims.Audience = service.JwtAudience
+
+	return auth.GenerateTokenWithClaims(claims, service.JwtSigningMethod, service.JwtSignKey, service.JwtKeyId)
 }
 
 func Authenticated(service LoginService, handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-		tokenString := r.Header.Get("Authorization")
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		tokenString := authclient.TokenFromRequest(r)
+
+		var principal *authclient.Principal
+		var err error
+		tokenType := "jwt"
+
+		if prefix, ok := security.ParseApiKeyPrefix(tokenString); ok {
+			tokenType = "api_key"
+			principal, err = service.authenticateApiKey(r, tokenString, prefix)
+		} else {
+			var claims *auth.JwtClaims
+			claims, err = service.Verifier.Verify(r.Context(), tokenString)
+
+			if err == nil {
+				err = service.checkSessionRevoked(r, claims)
 			}
 
-			return service.JwtSignKey, nil
-		})
+			if err == nil {
+				err = service.checkSession(r, claims)
+			}
+
+			if err == nil {
+				principal = &authclient.Principal{
+					UserId:   claims.UserId,
+					Username: claims.Username,
+					Claims:   claims,
+				}
+			}
+		}
+
+		outcome := validationOutcome(err)
+		metrics.TokenValidations.WithLabelValues(tokenType, outcome).Inc()
 
 		if err != nil {
+			service.Logger.DebugContext(r.Context(), "authentication failed", "error", err)
+
+			// The credentials can't be checked, which says nothing about them
+			if errors.As(err, &storeError{}) {
+				service.Logger.ErrorContext(r.Context(), "could not authenticate", "error", err)
+				writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not authenticate")
+				return
+			}
+
+			// The credentials are valid, but the account must not be used
+			var statusErr accountStatusError
+			if errors.As(err, &statusErr) {
+				writeAccountStatusError(w, r, statusErr.status)
+				return
+			}
+
+			code := CodeUnauthenticated
+			switch outcome {
+			case "expired":
+				code = CodeTokenExpired
+			case "revoked":
+				code = CodeSessionRevoked
+			}
+
 			w.Header().Set("WWW-Authenticate", "Basic realm=Restricted")
-			http.Error(w, NewApiResponse(http.StatusUnauthorized, "You are not allowed"), http.StatusUnauthorized)
+			writeError(w, r, http.StatusUnauthorized, code, "You are not allowed")
+			return
+		}
+
+		// Requests of impersonation tokens are traced back to the admin in the
+		// logs and metrics
+		if principal.IsImpersonation() {
+			logging.SetActor(r.Context(), principal.Claims.Actor.Subject)
+		}
+
+		handler(w, r.WithContext(authclient.NewContext(r.Context(), principal)), p)
+	}
+}
+
+var errSessionRevoked = errors.New("session has been revoked")
+
+// storeError wraps failed queries of the authentication. Unlike missing rows
+// they don't tell anything about the credentials, so they must not log out
+// clients.
+type storeError struct {
+	err error
+}
+
+func (err storeError) Error() string {
+	return "could not check credentials: " + err.err.Error()
+}
+
+func (err storeError) Unwrap() error {
+	return err.err
+}
+
+// checkSessionRevoked rejects tokens of deleted or inactive accounts and
+// tokens issued before the sessions of the account were revoked, e.g. by a
+// password reset.
+func (service LoginService) checkSessionRevoked(r *http.Request, claims *auth.JwtClaims) error {
+	acc, err := service.db(r).GetAccountById(claims.UserId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	if err != nil {
+		return storeError{err: err}
+	}
+
+	if err := checkAccountStatus(acc); err != nil {
+		return err
+	}
+
+	// Tokens only carry seconds, so tokens issued within the second of the
+	// revocation stay valid
+	if acc.SessionsRevokedDate != nil && time.Unix(claims.IssuedAt, 0).Before(acc.SessionsRevokedDate.Truncate(time.Second)) {
+		return errSessionRevoked
+	}
+
+	return nil
+}
+
+func validationOutcome(err error) string {
+	var validationErr *jwt.ValidationError
+
+	switch {
+	case err == nil:
+		return "valid"
+	case errors.Is(err, authclient.ErrMissingToken):
+		return "missing"
+	case errors.As(err, &validationErr) && validationErr.Errors&jwt.ValidationErrorExpired != 0:
+		return "expired"
+	case errors.Is(err, errSessionRevoked):
+		return "revoked"
+	case errors.As(err, &accountStatusError{}):
+		return "inactive"
+	case errors.As(err, &storeError{}):
+		return "error"
+	}
+
+	return "invalid"
+}
+
+// AdminOnly must be wrapped by Authenticated. The role is read from the
+// account store, so revoked privileges take effect before the token expires.
+func AdminOnly(service LoginService, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal, _ := authclient.FromContext(r.Context())
+		acc, err := service.db(r).GetAccountById(principal.UserId)
+
+		if err != nil || acc.Role != database.RoleAdmin {
+			writeError(w, r, http.StatusForbidden, CodeAdminRequired, "Admin privileges required")
+			return
+		}
+
+		handler(w, r, p)
+	}
+}
+
+// NotImpersonated protects sensitive endpoints from being used with
+// impersonation tokens. It must be wrapped by Authenticated.
+func NotImpersonated(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal, _ := authclient.FromContext(r.Context())
+
+		if principal.IsImpersonation() {
+			writeError(w, r, http.StatusForbidden, CodeImpersonationNotAllowed, "Not allowed while impersonating")
+			return
+		}
+
+		handler(w, r, p)
+	}
+}
+
+// NotApiKey protects endpoints concerning logins from being used with API
+// keys. It must be wrapped by Authenticated.
+func NotApiKey(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		principal, _ := authclient.FromContext(r.Context())
+
+		if principal.ApiKeyId != 0 {
+			writeError(w, r, http.StatusForbidden, CodeApiKeyNotAllowed, "Not allowed using an api key")
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
-		r.Header.Add("username", claims["username"].(string))
 		handler(w, r, p)
 	}
 }
 
 func New(config ServiceConfig) *LoginService {
-	context := database.NewContext(
+	// main validates the log configuration, so an invalid one only happens
+	// when the service is embedded and falls back to the default logger
+	logger, err := logging.New(config.Log, os.Stdout)
+	if err != nil {
+		logger = slog.Default()
+	}
+
+	db := database.NewContext(
 		config.Database.Host,
 		config.Database.Port,
 		config.Database.Username,
 		config.Database.Password,
 		config.Database.Database)
+	db.Logger = logger
+
+	// main validates the configuration as well, embedding services fall back
+	// to the default rules
+	registrationValidator, err := NewRegistrationValidator(config.Validation)
+	if err != nil {
+		logger.Warn("invalid validation config, using defaults", "error", err)
+		registrationValidator, _ = NewRegistrationValidator(ValidationConfig{})
+	}
+
+	mailer, err := mail.New(config.Mail, logger)
+	if err != nil {
+		logger.Warn("invalid mail config, emails are only logged", "error", err)
+		mailer, _ = mail.New(mail.Config{From: config.Mail.From}, logger)
+	}
+
+	signKey := config.Jwt.SignKey
+
+	// Keys read from configuration files are strings, but HMAC needs bytes
+	if key, ok := signKey.(string); ok {
+		signKey = []byte(key)
+	}
+
+	var signingMethod jwt.SigningMethod = jwt.SigningMethodHS256
+	verifyKey := signKey
+
+	if key, ok := signKey.(*rsa.PrivateKey); ok {
+		signingMethod = jwt.SigningMethodRS256
+		verifyKey = &key.PublicKey
+	}
+
+	availabilityRequests := config.Availability.Requests
+	if availabilityRequests <= 0 {
+		availabilityRequests = 30
+	}
 
 	service := LoginService{
-		Port:       config.Port,
-		Host:       config.Host,
-		Router:     httprouter.New(),
-		JwtSignKey: config.Jwt.SignKey,
-		Database:   context,
+		Port:             config.Port,
+		Host:             config.Host,
+		Router:           httprouter.New(),
+		JwtSignKey:       signKey,
+		JwtSigningMethod: signingMethod,
+		JwtKeyId:         config.Jwt.KeyId,
+		JwtIssuer:        config.Jwt.Issuer,
+		JwtAudience:      config.Jwt.Audience,
+		Database:         db,
+		Logger:           logger,
+
+		RegistrationValidator: registrationValidator,
+		Mailer:                mailer,
+
+		PublicUrl: config.PublicUrl,
+
+		PasswordResetUri:            config.PasswordReset.ResetUri,
+		PasswordResetLifetime:       secondsOrDefault(config.PasswordReset.TokenLifetime, time.Hour),
+		PasswordResetResendInterval: secondsOrDefault(config.PasswordReset.ResendInterval, time.Minute),
+
+		EmailVerifyUri:            config.EmailVerification.VerifyUri,
+		EmailVerificationLifetime: secondsOrDefault(config.EmailVerification.TokenLifetime, 24*time.Hour),
+		EmailResendInterval:       secondsOrDefault(config.EmailVerification.ResendInterval, time.Minute),
+		EmailVerificationRequired: config.EmailVerification.Required,
+
+		EmailChangeConfirmUri:     config.EmailChange.ConfirmUri,
+		EmailChangeCancelUri:      config.EmailChange.CancelUri,
+		EmailChangeLifetime:       secondsOrDefault(config.EmailChange.TokenLifetime, 24*time.Hour),
+		EmailChangeCancelLifetime: secondsOrDefault(config.EmailChange.CancelLifetime, 7*24*time.Hour),
+
+		AvailabilityLimiter: NewRateLimiter(availabilityRequests, secondsOrDefault(config.Availability.Window, time.Minute)),
+
+		LoginHistoryRetention:     secondsOrDefault(config.LoginHistory.Retention, 90*24*time.Hour),
+		LoginHistoryPruneInterval: secondsOrDefault(config.LoginHistory.PruneInterval, time.Hour),
+
+		DeviceNotifier:          MailDeviceNotifier{Mailer: mailer},
+		NewDeviceReportUri:      config.NewDevice.ReportUri,
+		NewDeviceReportLifetime: secondsOrDefault(config.NewDevice.ReportLifetime, 7*24*time.Hour),
+
+		DeviceVerificationUri: config.Device.VerificationUri,
+		DeviceCodeLifetime:    secondsOrDefault(config.Device.CodeLifetime, 10*time.Minute),
+		DevicePollInterval:    secondsOrDefault(config.Device.PollInterval, 5*time.Second),
 	}
 
-	service.Router.POST("/api/auth/login", service.LoginHandler)
-	service.Router.POST("/api/auth/register", service.RegisterHandler)
-	service.Router.DELETE("/api/auth/delete", Authenticated(service, service.DeleteHandler))
+	service.Verifier = authclient.NewVerifier(authclient.StaticKey{Value: verifyKey}, service.JwtIssuer, service.JwtAudience)
+	service.Verifier.Methods = []string{signingMethod.Alg()}
+	service.background, service.stopBackground = context.WithCancel(context.Background())
+
+	service.handle(http.MethodPost, "/api/auth/login", service.LoginHandler)
+	service.handle(http.MethodPost, "/api/auth/register", service.RegisterHandler)
+	service.handleAuthenticated(http.MethodDelete, "/api/auth/delete", RequireScope(auth.ScopeAccountDelete, NotImpersonated(service.DeleteHandler)))
+	service.handle(http.MethodPost, "/api/auth/password/forgot", service.ForgotPasswordHandler)
+	service.handle(http.MethodPost, "/api/auth/password/reset", service.ResetPasswordHandler)
+	service.handle(http.MethodPost, "/api/auth/email/verify", service.VerifyEmailHandler)
+	service.handle(http.MethodPost, "/api/auth/email/resend", service.ResendVerificationHandler)
+	service.handle(http.MethodGet, "/api/auth/availability", RateLimited(service.AvailabilityLimiter, service.AvailabilityHandler))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/email/change", NotApiKey(NotImpersonated(service.ChangeEmailHandler)))
+	service.handle(http.MethodPost, "/api/auth/email/change/confirm", service.ConfirmEmailChangeHandler)
+	service.handle(http.MethodPost, "/api/auth/email/change/cancel", service.CancelEmailChangeHandler)
+	service.handleAuthenticated(http.MethodGet, "/api/auth/me", RequireScope(auth.ScopeAccountRead, service.MeHandler))
+	service.handle(http.MethodPost, "/api/auth/devices/report", service.ReportDeviceHandler)
+	service.handleAuthenticated(http.MethodGet, "/api/auth/activity", RequireScope(auth.ScopeAccountRead, service.ActivityHandler))
+	service.handleAuthenticated(http.MethodGet, "/api/auth/sessions", NotApiKey(service.ListSessionsHandler))
+	service.handleAuthenticated(http.MethodDelete, "/api/auth/sessions", NotApiKey(NotImpersonated(service.RevokeOtherSessionsHandler)))
+	service.handleAuthenticated(http.MethodDelete, "/api/auth/sessions/:id", NotApiKey(NotImpersonated(service.RevokeSessionHandler)))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/admin/impersonate", RequireScope(auth.ScopeAdmin, AdminOnly(service, NotImpersonated(service.ImpersonateHandler))))
+	service.handleAuthenticated(http.MethodGet, "/api/auth/admin/accounts", RequireScope(auth.ScopeAdmin, AdminOnly(service, service.ListAccountsHandler)))
+	service.handleAuthenticated(http.MethodGet, "/api/auth/admin/accounts/:id", RequireScope(auth.ScopeAdmin, AdminOnly(service, service.GetAccountHandler)))
+	service.handleAuthenticated(http.MethodDelete, "/api/auth/admin/accounts/:id", RequireScope(auth.ScopeAdmin, AdminOnly(service, NotImpersonated(service.DeleteAccountHandler))))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/admin/accounts/:id/password-reset", RequireScope(auth.ScopeAdmin, AdminOnly(service, NotImpersonated(service.ForcePasswordResetHandler))))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/admin/accounts/:id/disable", RequireScope(auth.ScopeAdmin, AdminOnly(service, NotImpersonated(service.DisableAccountHandler))))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/admin/accounts/:id/enable", RequireScope(auth.ScopeAdmin, AdminOnly(service, NotImpersonated(service.EnableAccountHandler))))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/admin/accounts/:id/status", RequireScope(auth.ScopeAdmin, AdminOnly(service, NotImpersonated(service.SetAccountStatusHandler))))
+	service.handleAuthenticated(http.MethodPost, "/api/auth/keys", RequireScope(auth.ScopeKeysManage, NotImpersonated(service.CreateApiKeyHandler)))
+	service.handleAuthenticated(http.MethodGet, "/api/auth/keys", RequireScope(auth.ScopeKeysManage, service.ListApiKeysHandler))
+	service.handleAuthenticated(http.MethodDelete, "/api/auth/keys/:id", RequireScope(auth.ScopeKeysManage, NotImpersonated(service.RevokeApiKeyHandler)))
+	service.handle(http.MethodGet, "/api/auth/jwks.json", service.JwksHandler)
+	service.handle(http.MethodGet, "/api/auth/openapi.json", service.OpenApiHandler)
+	service.handle(http.MethodPost, "/api/auth/device/code", service.DeviceCodeHandler)
+	service.handleAuthenticated(http.MethodPost, "/api/auth/device/verify", NotApiKey(NotImpersonated(service.DeviceVerifyHandler)))
+	service.handle(http.MethodPost, "/api/auth/token", service.TokenHandler)
+	// Probes are frequent, so they are neither traced nor measured
+	service.Router.GET("/healthz", service.HealthzHandler)
+	service.Router.GET("/readyz", service.ReadyzHandler)
+
+	service.Router.NotFound = http.HandlerFunc(notFoundHandler)
+	service.Router.MethodNotAllowed = http.HandlerFunc(methodNotAllowedHandler)
+	service.Router.PanicHandler = service.panicHandler
+
+	var handler http.Handler = service.Router
+
+	if config.Cors.Enabled() {
+		// main validates the configuration as well, embedding services run
+		// without CORS if it is invalid
+		cors, err := NewCors(config.Cors)
+		if err != nil {
+			logger.Warn("invalid cors config, cors is disabled", "error", err)
+		} else {
+			service.Router.GlobalOPTIONS = http.HandlerFunc(cors.Preflight)
+			handler = cors.Middleware(handler)
+		}
+	}
+
+	service.Server = &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", service.Host, service.Port),
+		Handler:           logging.Middleware(logger, handler),
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+		ReadHeaderTimeout: secondsOrDefault(config.Server.ReadHeaderTimeout, 5*time.Second),
+		ReadTimeout:       secondsOrDefault(config.Server.ReadTimeout, 10*time.Second),
+		WriteTimeout:      secondsOrDefault(config.Server.WriteTimeout, 10*time.Second),
+		IdleTimeout:       secondsOrDefault(config.Server.IdleTimeout, 120*time.Second),
+		MaxHeaderBytes:    1 << 20,
+	}
+
+	if config.Server.MaxHeaderBytes > 0 {
+		service.Server.MaxHeaderBytes = config.Server.MaxHeaderBytes
+	}
+
+	service.MaxBodyBytes = defaultMaxBodyBytes
+	if config.Server.MaxBodyBytes > 0 {
+		service.MaxBodyBytes = config.Server.MaxBodyBytes
+	}
+
+	// The metrics reveal the pool statistics and failed logins, so they are
+	// only served on a listener, which is reachable for the scraper only
+	if config.Metrics.Address != "" {
+		metricsRouter := httprouter.New()
+		metricsRouter.Handler(http.MethodGet, "/metrics", metrics.Handler(metrics.NewPoolCollector(db.Stat)))
+
+		service.MetricsServer = &http.Server{
+			Addr:              config.Metrics.Address,
+			Handler:           metricsRouter,
+			ErrorLog:          service.Server.ErrorLog,
+			ReadHeaderTimeout: service.Server.ReadHeaderTimeout,
+			ReadTimeout:       service.Server.ReadTimeout,
+			WriteTimeout:      service.Server.WriteTimeout,
+			IdleTimeout:       service.Server.IdleTimeout,
+		}
+	}
+
+	service.ShutdownTimeout = secondsOrDefault(config.Server.ShutdownTimeout, 15*time.Second)
+	service.Tls = config.Tls
 
 	return &service
 }
 
-func (service LoginService) Start() error {
-	return http.ListenAndServe(fmt.Sprintf("%s:%d", service.Host, service.Port), service.Router)
+// handle registers the handler for the route, traces it, records its duration
+// and validates the request body against the OpenAPI document.
+func (service *LoginService) handle(method string, path string, handler httprouter.Handle) {
+	service.route(method, path, ValidateRequestBody(openApiOperation(method, path), handler))
+}
+
+// handleAuthenticated is like handle for routes needing a principal. The body
+// is validated after the authentication, so unauthenticated callers learn
+// nothing about the schema of the route.
+func (service *LoginService) handleAuthenticated(method string, path string, handler httprouter.Handle) {
+	service.route(method, path, Authenticated(*service, ValidateRequestBody(openApiOperation(method, path), handler)))
+}
+
+func (service *LoginService) route(method string, path string, handler httprouter.Handle) {
+	handler = service.limitBody(handler)
+	service.Router.Handle(method, path, metrics.Instrument(path, tracing.Instrument(path, handler)))
+}
+
+func secondsOrDefault(seconds int, defaultValue time.Duration) time.Duration {
+	if seconds <= 0 {
+		return defaultValue
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// Start blocks until the service fails or is shut down. After Shutdown it
+// returns nil.
+func (service *LoginService) Start() error {
+	var err error
+
+	if service.MetricsServer != nil {
+		// Listening first reports a taken address before the service runs
+		listener, err := net.Listen("tcp", service.MetricsServer.Addr)
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			if err := service.MetricsServer.Serve(listener); err != http.ErrServerClosed {
+				service.Logger.Error("metrics server failed", "error", err)
+			}
+		}()
+	}
+
+	go service.pruneLoginHistory(service.background)
+
+	if service.Tls.Enabled() {
+		tlsConfig, tlsErr := newTlsConfig(service.Tls, service.Logger)
+		if tlsErr != nil {
+			return tlsErr
+		}
+
+		service.Server.TLSConfig = tlsConfig
+		err = service.Server.ListenAndServeTLS("", "")
+	} else {
+		err = service.Server.ListenAndServe()
+	}
+
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting connections, waits for running requests to finish
+// and closes the database pool afterwards.
+func (service *LoginService) Shutdown(ctx context.Context) error {
+	service.stopBackground()
+	err := service.Server.Shutdown(ctx)
+
+	if service.MetricsServer != nil {
+		if metricsErr := service.MetricsServer.Shutdown(ctx); err == nil {
+			err = metricsErr
+		}
+	}
+
+	service.Database.Close()
+	return err
 }
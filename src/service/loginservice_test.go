@@ -2,15 +2,23 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/authclient"
 	"flhansen/application-manager/login-service/src/controller"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/logging"
+	"flhansen/application-manager/login-service/src/metrics"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -28,8 +36,9 @@ func TestMain(m *testing.M) {
 func runAllTests(m *testing.M) int {
 	loginService = New(
 		ServiceConfig{
-			Host: "localhost",
-			Port: 8080,
+			Host:      "localhost",
+			Port:      8080,
+			PublicUrl: "http://localhost:8080",
 			Jwt: JwtConfig{
 				SignKey: []byte("supersecretsigningkey"),
 			},
@@ -39,6 +48,9 @@ func runAllTests(m *testing.M) int {
 				Username: "test",
 				Password: "test",
 				Database: "test",
+			},
+			Metrics: metrics.Config{
+				Address: "localhost:9090",
 			}})
 
 	// Make sure the user 'testuser' does not exist and then create it
@@ -141,7 +153,18 @@ func TestLoginWrongPassword(t *testing.T) {
 
 	assert.Equal(t, 401, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeInvalidCredentials, res["code"])
+}
+
+func TestLoginPasswordTooLong(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{
+		Username: "testuser",
+		Password: strings.Repeat("a", maxPasswordLength+1),
+	})
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeInvalidCredentials, res["code"])
 }
 
 func TestLoginWrongUsername(t *testing.T) {
@@ -170,7 +193,8 @@ func TestLoginWrongUsername(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeInvalidCredentials, res["code"])
 }
 
 func TestLoginInvalidJsonRequest(t *testing.T) {
@@ -184,9 +208,10 @@ func TestLoginInvalidJsonRequest(t *testing.T) {
 	var res map[string]interface{}
 	json.NewDecoder(resp.Body).Decode(&res)
 
-	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeInvalidJson, res["code"])
 }
 
 func TestLoginTokenSignError(t *testing.T) {
@@ -218,7 +243,8 @@ func TestLoginTokenSignError(t *testing.T) {
 
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeInternalError, res["code"])
 }
 
 func TestRegisterUsernameAlreadyExists(t *testing.T) {
@@ -250,7 +276,8 @@ func TestRegisterUsernameAlreadyExists(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeUserExists, res["code"])
 }
 
 func TestRegisterEmailAlreadyExists(t *testing.T) {
@@ -282,7 +309,19 @@ func TestRegisterEmailAlreadyExists(t *testing.T) {
 
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeUserExists, res["code"])
+}
+
+func TestRegisterEmailAlreadyExistsIgnoringCase(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/register", "", RegisterRequest{
+		Username: "testuserwithothercase",
+		Password: "testpass",
+		Email:    "TestUser@Test.com",
+	})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeUserExists, res["code"])
 }
 
 func TestRegisterSuccess(t *testing.T) {
@@ -334,9 +373,97 @@ func TestRegisterInvalidJsonRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeInvalidJson, res["code"])
+}
+
+func TestRegisterInvalidInput(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/register", "", RegisterRequest{
+		Username: "a b",
+		Password: "testpass",
+		Email:    "testuser",
+	})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+
+	errs := res["errors"].([]interface{})
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "username", errs[0].(map[string]interface{})["field"])
+	assert.Equal(t, "email", errs[1].(map[string]interface{})["field"])
+}
+
+func TestMe(t *testing.T) {
+	token := testUserToken(t)
+	acc, _ := loginService.Database.GetAccountByUsername("testuser")
+
+	// Changes after the token was issued have to be visible
+	loginService.Database.SetAccountRole(acc.Id, "admin")
+	defer loginService.Database.SetAccountRole(acc.Id, "user")
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	account := res["account"].(map[string]interface{})
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, float64(acc.Id), account["id"])
+	assert.Equal(t, "testuser", account["username"])
+	assert.Equal(t, "testuser@test.com", account["email"])
+	assert.Equal(t, "admin", account["role"])
+	assert.NotNil(t, account["creationDate"])
+	assert.Nil(t, account["password"])
+}
+
+func TestMeDeletedAccount(t *testing.T) {
+	token, err := auth.GenerateToken(999999, "deleteduser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens of deleted accounts are not accepted anymore
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeUnauthenticated, res["code"])
+}
+
+func TestMeDatabaseUnavailable(t *testing.T) {
+	s := New(ServiceConfig{
+		Jwt: JwtConfig{SignKey: "supersecretsigningkey"},
+		Database: controller.DbConfig{
+			Host:     "localhost",
+			Port:     5432,
+			Username: "test",
+			Password: "wrongpassword",
+			Database: "test",
+		},
+	})
+
+	token, err := auth.GenerateToken(1, "testuser", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/me", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	recorder := httptest.NewRecorder()
+	s.Router.ServeHTTP(recorder, req)
+
+	var res map[string]interface{}
+	json.NewDecoder(recorder.Body).Decode(&res)
+
+	// Failing queries say nothing about the token, so clients must not be
+	// logged out
+	assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+	assert.Equal(t, CodeInternalError, res["code"])
+	assert.Empty(t, recorder.Header().Get("WWW-Authenticate"))
+}
+
+func TestMeUnauthenticated(t *testing.T) {
+	resp, _ := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", "", nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 }
 
 func TestDelete(t *testing.T) {
@@ -367,6 +494,10 @@ func TestDelete(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.NotNil(t, res["status"])
 	assert.NotNil(t, res["message"])
+
+	// The account is kept, but can't be used anymore
+	acc, _ = loginService.Database.GetAccountById(acc.Id)
+	assert.Equal(t, database.AccountDeleted, acc.Status)
 }
 
 func TestDeleteWrongSigningMethod(t *testing.T) {
@@ -398,7 +529,8 @@ func TestDeleteWrongSigningMethod(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeUnauthenticated, res["code"])
 }
 
 func TestDeleteInvalidClaims(t *testing.T) {
@@ -437,7 +569,8 @@ func TestDeleteInvalidClaims(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeUnauthenticated, res["code"])
 }
 
 func TestDeleteInvalidQuery(t *testing.T) {
@@ -476,5 +609,233 @@ func TestDeleteInvalidQuery(t *testing.T) {
 
 	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
 	assert.NotNil(t, res["status"])
-	assert.NotNil(t, res["message"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeInternalError, res["code"])
+}
+
+func TestJwksHmacKeyNotPublished(t *testing.T) {
+	resp, err := http.Get("http://localhost:8080/api/auth/jwks.json")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string][]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 0, len(res["keys"]))
+}
+
+func TestJwksRsaKey(t *testing.T) {
+	privateKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaService := New(ServiceConfig{Jwt: JwtConfig{SignKey: privateKey, KeyId: "key-1"}})
+
+	tokenString, err := rsaService.signToken(auth.NewClaims(1, "testuser"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(rsaService.Router)
+	defer server.Close()
+
+	verifier := authclient.NewVerifier(authclient.NewRemoteKeySet(server.URL+"/api/auth/jwks.json"), "", "")
+	claims, err := verifier.Verify(context.Background(), tokenString)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "testuser", claims.Username)
+}
+
+func impersonate(t *testing.T, token string, username string) *http.Response {
+	body, err := json.Marshal(ImpersonateRequest{Username: username})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/api/auth/admin/impersonate", bytes.NewBuffer(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Authorization", token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+func TestImpersonate(t *testing.T) {
+	adminId, _ := loginService.Database.InsertAccount("admin", "admin", "admin@test.com", time.Now())
+	defer loginService.Database.DeleteAccount(adminId)
+	loginService.Database.SetAccountRole(adminId, "admin")
+
+	adminToken, _ := auth.GenerateToken(adminId, "admin", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	resp := impersonate(t, adminToken, "testuser")
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := loginService.Verifier.Verify(context.Background(), fmt.Sprintf("%v", res["token"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "testuser", claims.Username)
+	assert.True(t, claims.IsImpersonation())
+	assert.Equal(t, strconv.Itoa(adminId), claims.Actor.Subject)
+}
+
+func TestImpersonateAdmin(t *testing.T) {
+	adminId, _ := loginService.Database.InsertAccount("admin", "admin", "admin@test.com", time.Now())
+	defer loginService.Database.DeleteAccount(adminId)
+	loginService.Database.SetAccountRole(adminId, "admin")
+
+	otherId, _ := loginService.Database.InsertAccount("otheradmin", "otheradmin", "otheradmin@test.com", time.Now())
+	defer loginService.Database.DeleteAccount(otherId)
+	loginService.Database.SetAccountRole(otherId, "admin")
+
+	adminToken, _ := auth.GenerateToken(adminId, "admin", jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+	resp := impersonate(t, adminToken, "otheradmin")
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeImpersonationNotAllowed, res["code"])
+	assert.Nil(t, res["token"])
+}
+
+func TestImpersonateNotAdmin(t *testing.T) {
+	acc, _ := loginService.Database.GetAccountByUsername("testuser")
+	token, _ := auth.GenerateToken(acc.Id, acc.Username, jwt.SigningMethodHS256, []byte("supersecretsigningkey"))
+
+	resp := impersonate(t, token, "testuser")
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.NotNil(t, res["status"])
+	assert.NotNil(t, res["detail"])
+	assert.Equal(t, CodeAdminRequired, res["code"])
+}
+
+func TestDeleteWithImpersonationToken(t *testing.T) {
+	acc, _ := loginService.Database.GetAccountByUsername("testuser")
+	claims := auth.NewImpersonationClaims(acc.Id, acc.Username, 0, "admin")
+	token, _ := auth.GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsigningkey"), "")
+
+	req, err := http.NewRequest(http.MethodDelete, "http://localhost:8080/api/auth/delete", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Add("Authorization", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	acc, err = loginService.Database.GetAccountByUsername("testuser")
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Nil(t, err)
+	assert.Equal(t, "testuser", acc.Username)
+}
+
+func TestShutdown(t *testing.T) {
+	s := New(ServiceConfig{
+		Host: "localhost",
+		Port: 8081,
+		Jwt:  JwtConfig{SignKey: "supersecretsigningkey"},
+		Server: ServerConfig{
+			ReadTimeout: 3,
+		},
+	})
+
+	assert.Equal(t, 3*time.Second, s.Server.ReadTimeout)
+	assert.Equal(t, 10*time.Second, s.Server.WriteTimeout)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Start()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.Nil(t, s.Shutdown(ctx))
+
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Service is not terminating")
+	case err := <-done:
+		assert.Nil(t, err)
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodDelete, "http://localhost:8080/api/auth/delete", nil)
+	req.Header.Set(logging.RequestIdHeader, "test-request-id")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, "test-request-id", resp.Header.Get(logging.RequestIdHeader))
+	assert.Equal(t, "test-request-id", res["requestId"])
+}
+
+func TestMetrics(t *testing.T) {
+	loginRequestBody := LoginRequest{
+		Username: "testuser",
+		Password: "wrongpass",
+	}
+
+	doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", loginRequestBody)
+
+	// The metrics are not public
+	resp, err := http.Get("http://localhost:8080/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get("http://localhost:9090/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `appman_login_logins_total{outcome="failure",reason="wrong_password"}`)
+	assert.Contains(t, string(body), `appman_login_http_request_duration_seconds_count{method="POST",route="/api/auth/login",status="401"}`)
+	assert.Contains(t, string(body), "appman_login_db_pool_total_connections")
+	assert.Contains(t, string(body), "appman_login_password_hash_duration_seconds_count")
 }
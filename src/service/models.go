@@ -3,6 +3,12 @@ package service
 import (
 	"encoding/json"
 	"flhansen/application-manager/login-service/src/controller"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/logging"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/metrics"
+	"flhansen/application-manager/login-service/src/tracing"
+	"time"
 )
 
 type LoginRequest struct {
@@ -16,11 +22,267 @@ type RegisterRequest struct {
 	Email    string `json:"email"`
 }
 
+// AccountResponse is the public part of an account, the password hash is
+// never included.
+type AccountResponse struct {
+	Id            int        `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"emailVerified"`
+	Role          string     `json:"role"`
+	Status        string     `json:"status"`
+	LastLoginDate *time.Time `json:"lastLoginDate"`
+	CreationDate  time.Time  `json:"creationDate"`
+}
+
+func NewAccountResponse(acc database.Account) AccountResponse {
+	return AccountResponse{
+		Id:            acc.Id,
+		Username:      acc.Username,
+		Email:         acc.Email,
+		EmailVerified: acc.EmailVerified,
+		Role:          acc.Role,
+		Status:        acc.Status,
+		LastLoginDate: acc.LastLoginDate,
+		CreationDate:  acc.CreationDate,
+	}
+}
+
+type AuditEventResponse struct {
+	Id            int       `json:"id"`
+	ActorId       int       `json:"actorId"`
+	Action        string    `json:"action"`
+	Impersonation bool      `json:"impersonation"`
+	CreationDate  time.Time `json:"creationDate"`
+}
+
+func NewAuditEventResponse(event database.AuditEvent) AuditEventResponse {
+	return AuditEventResponse{
+		Id:            event.Id,
+		ActorId:       event.ActorId,
+		Action:        event.Action,
+		Impersonation: event.Impersonation,
+		CreationDate:  event.CreationDate,
+	}
+}
+
+type LoginEventResponse struct {
+	Id            int       `json:"id"`
+	Outcome       string    `json:"outcome"`
+	FailureReason string    `json:"failureReason,omitempty"`
+	IpAddress     string    `json:"ipAddress"`
+	UserAgent     string    `json:"userAgent"`
+	NewDevice     bool      `json:"newDevice"`
+	CreationDate  time.Time `json:"creationDate"`
+}
+
+func NewLoginEventResponse(event database.LoginEvent) LoginEventResponse {
+	return LoginEventResponse{
+		Id:            event.Id,
+		Outcome:       event.Outcome,
+		FailureReason: event.FailureReason,
+		IpAddress:     event.IpAddress,
+		UserAgent:     event.UserAgent,
+		NewDevice:     event.NewDevice,
+		CreationDate:  event.CreationDate,
+	}
+}
+
+// SessionResponse describes a session. Current marks the session of the
+// request.
+type SessionResponse struct {
+	Id             int       `json:"id"`
+	UserAgent      string    `json:"userAgent"`
+	IpAddress      string    `json:"ipAddress"`
+	Current        bool      `json:"current"`
+	ExpirationDate time.Time `json:"expirationDate"`
+	LastSeenDate   time.Time `json:"lastSeenDate"`
+	CreationDate   time.Time `json:"creationDate"`
+}
+
+func NewSessionResponse(session database.Session, currentSessionId int) SessionResponse {
+	return SessionResponse{
+		Id:             session.Id,
+		UserAgent:      session.UserAgent,
+		IpAddress:      session.IpAddress,
+		Current:        session.Id == currentSessionId,
+		ExpirationDate: session.ExpirationDate,
+		LastSeenDate:   session.LastSeenDate,
+		CreationDate:   session.CreationDate,
+	}
+}
+
+type AccountStatusChangeResponse struct {
+	Id           int       `json:"id"`
+	OldStatus    string    `json:"oldStatus"`
+	NewStatus    string    `json:"newStatus"`
+	Reason       string    `json:"reason"`
+	ActorId      int       `json:"actorId,omitempty"`
+	CreationDate time.Time `json:"creationDate"`
+}
+
+func NewAccountStatusChangeResponse(change database.AccountStatusChange) AccountStatusChangeResponse {
+	return AccountStatusChangeResponse{
+		Id:           change.Id,
+		OldStatus:    change.OldStatus,
+		NewStatus:    change.NewStatus,
+		Reason:       change.Reason,
+		ActorId:      change.ActorId,
+		CreationDate: change.CreationDate,
+	}
+}
+
+type AccountStatusRequest struct {
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// Availability of a username or email. Message explains why it is not
+// available.
+type Availability struct {
+	Available bool   `json:"available"`
+	Message   string `json:"message,omitempty"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type ChangeEmailRequest struct {
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// EmailChangeTokenRequest is used to confirm and to cancel an email change.
+type EmailChangeTokenRequest struct {
+	Token string `json:"token"`
+}
+
+type ReportDeviceRequest struct {
+	Token string `json:"token"`
+}
+
+type ImpersonateRequest struct {
+	Username string `json:"username"`
+}
+
+type CreateApiKeyRequest struct {
+	Name           string     `json:"name"`
+	Scopes         []string   `json:"scopes"`
+	ExpirationDate *time.Time `json:"expirationDate"`
+}
+
+type ApiKeyResponse struct {
+	Id             int        `json:"id"`
+	Name           string     `json:"name"`
+	Prefix         string     `json:"prefix"`
+	Scopes         []string   `json:"scopes"`
+	ExpirationDate *time.Time `json:"expirationDate"`
+	LastUsedDate   *time.Time `json:"lastUsedDate"`
+	Revoked        bool       `json:"revoked"`
+	CreationDate   time.Time  `json:"creationDate"`
+}
+
+func NewApiKeyResponse(key database.ApiKey) ApiKeyResponse {
+	scopes := key.Scopes
+	if scopes == nil {
+		scopes = []string{}
+	}
+
+	return ApiKeyResponse{
+		Id:             key.Id,
+		Name:           key.Name,
+		Prefix:         key.Prefix,
+		Scopes:         scopes,
+		ExpirationDate: key.ExpirationDate,
+		LastUsedDate:   key.LastUsedDate,
+		Revoked:        key.Revoked,
+		CreationDate:   key.CreationDate,
+	}
+}
+
+type DeviceVerifyRequest struct {
+	UserCode string `json:"userCode"`
+	Deny     bool   `json:"deny"`
+}
+
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// ServerConfig values are given in seconds, except for MaxHeaderBytes and
+// MaxBodyBytes.
+// Unset values fall back to safe defaults.
+type ServerConfig struct {
+	ReadHeaderTimeout int   `yaml:"readHeaderTimeout"`
+	ReadTimeout       int   `yaml:"readTimeout"`
+	WriteTimeout      int   `yaml:"writeTimeout"`
+	IdleTimeout       int   `yaml:"idleTimeout"`
+	ShutdownTimeout   int   `yaml:"shutdownTimeout"`
+	MaxHeaderBytes    int   `yaml:"maxHeaderBytes"`
+	MaxBodyBytes      int64 `yaml:"maxBodyBytes"`
+}
+
 type ServiceConfig struct {
 	Host     string              `yaml:"host"`
 	Port     int                 `yaml:"port"`
 	Jwt      JwtConfig           `yaml:"jwt"`
 	Database controller.DbConfig `yaml:"database"`
+	Device   DeviceConfig        `yaml:"device"`
+	Server   ServerConfig        `yaml:"server"`
+	Tls      TlsConfig           `yaml:"tls"`
+	Log      logging.Config      `yaml:"log"`
+	Tracing  tracing.Config      `yaml:"tracing"`
+	Metrics  metrics.Config      `yaml:"metrics"`
+
+	// PublicUrl is the base url users reach the service at, like
+	// https://login.example.com. Links in emails are built from it, unless
+	// their page is configured.
+	PublicUrl string `yaml:"publicUrl"`
+
+	Validation ValidationConfig `yaml:"validation"`
+	Cors       CorsConfig       `yaml:"cors"`
+
+	Mail              mail.Config             `yaml:"mail"`
+	PasswordReset     PasswordResetConfig     `yaml:"passwordReset"`
+	EmailVerification EmailVerificationConfig `yaml:"emailVerification"`
+	EmailChange       EmailChangeConfig       `yaml:"emailChange"`
+
+	// Availability limits the availability checks, which would otherwise
+	// allow to enumerate accounts quickly
+	Availability RateLimitConfig `yaml:"availability"`
+
+	LoginHistory LoginHistoryConfig `yaml:"loginHistory"`
+	NewDevice    NewDeviceConfig    `yaml:"newDevice"`
 }
 
 func NewApiResponse(status int, message string) string {
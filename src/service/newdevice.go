@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/security"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+type NewDeviceConfig struct {
+	// ReportUri is the page where users report logins they didn't make. The
+	// token is appended as query parameter.
+	ReportUri string `yaml:"reportUri"`
+	// ReportLifetime is given in seconds
+	ReportLifetime int `yaml:"reportLifetime"`
+}
+
+// NewDeviceLogin is a successful login from a device unknown to the account.
+type NewDeviceLogin struct {
+	Account   database.Account
+	Device    string
+	IpAddress string
+	Date      time.Time
+	// ReportUri logs out every session of the account, if the owner didn't
+	// log in
+	ReportUri string
+	// ReportLifetime is the time until the ReportUri expires
+	ReportLifetime time.Duration
+}
+
+// DeviceNotifier tells users about logins from new devices.
+type DeviceNotifier interface {
+	NotifyNewDevice(ctx context.Context, login NewDeviceLogin) error
+}
+
+// MailDeviceNotifier sends an email to the account.
+type MailDeviceNotifier struct {
+	Mailer mail.Mailer
+}
+
+func (notifier MailDeviceNotifier) NotifyNewDevice(ctx context.Context, login NewDeviceLogin) error {
+	return notifier.Mailer.Send(ctx, mail.Message{
+		To:      login.Account.Email,
+		Subject: "New login to your account",
+		Body: fmt.Sprintf("Hello %s,\n\nyour account has been used to log in from a new device:\n\n%s\n%s\n%s\n\nIf this was you, you can ignore this email. Otherwise open the following link to log out everywhere and change your password afterwards:\n\n%s\n\nThe link expires in %s.\n",
+			login.Account.Username, login.Device, login.IpAddress, login.Date.UTC().Format(time.RFC1123), login.ReportUri, login.ReportLifetime),
+	})
+}
+
+// Families are checked in order, since user agents name other browsers as
+// well, e.g. every Chrome user agent contains Safari.
+var (
+	browserFamilies = []struct{ token, family string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+
+	osFamilies = []struct{ token, family string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// userAgentFamily reduces the user agent to the browser and the operating
+// system, so updates don't make a device look new.
+func userAgentFamily(userAgent string) string {
+	browser := "Unknown browser"
+	for _, family := range browserFamilies {
+		if strings.Contains(userAgent, family.token) {
+			browser = family.family
+			break
+		}
+	}
+
+	for _, family := range osFamilies {
+		if strings.Contains(userAgent, family.token) {
+			return browser + " on " + family.family
+		}
+	}
+
+	return browser
+}
+
+// ipPrefix returns the /24 network of IPv4 and the /48 network of IPv6
+// addresses, which usually stay the same when a device reconnects.
+func ipPrefix(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return (&net.IPNet{IP: ipv4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+func (service *LoginService) newDeviceReportUri() string {
+	return service.serviceUri(service.NewDeviceReportUri, "/devices/report")
+}
+
+// checkNewDevice remembers the device of a successful login and notifies the
+// owner, if the device is new to the account. The login succeeds anyway, so
+// failures are only logged.
+func (service *LoginService) checkNewDevice(r *http.Request, acc database.Account) bool {
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	token, err := rng.GenerateToken(32)
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not create report token", "error", err)
+		return false
+	}
+
+	now := time.Now()
+	family := userAgentFamily(r.UserAgent())
+	prefix := ipPrefix(clientAddress(r))
+
+	newDevice, err := service.db(r).RememberDevice(database.KnownDevice{
+		AccountId:            acc.Id,
+		Fingerprint:          security.HashToken(family + "|" + prefix),
+		Description:          family,
+		IpPrefix:             prefix,
+		ReportTokenHash:      security.HashToken(token),
+		ReportExpirationDate: now.Add(service.NewDeviceReportLifetime),
+		LastSeenDate:         now,
+	})
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not remember device", "userId", acc.Id, "error", err)
+		return false
+	}
+
+	if !newDevice {
+		return false
+	}
+
+	service.Logger.InfoContext(r.Context(), "login from new device", "userId", acc.Id, "device", family, "ipPrefix", prefix)
+
+	login := NewDeviceLogin{
+		Account:        acc,
+		Device:         family,
+		IpAddress:      clientAddress(r),
+		Date:           now,
+		ReportUri:      service.newDeviceReportUri() + "?token=" + url.QueryEscape(token),
+		ReportLifetime: service.NewDeviceReportLifetime,
+	}
+
+	// Like emails, notifications are sent in the background
+	ctx := context.WithoutCancel(r.Context())
+	go func() {
+		if err := service.DeviceNotifier.NotifyNewDevice(ctx, login); err != nil {
+			service.Logger.ErrorContext(ctx, "could not notify about new device", "userId", acc.Id, "error", err)
+		}
+	}()
+
+	return true
+}
+
+// ReportDeviceHandler handles the "this wasn't me" link of a new device
+// notification. It logs out every session of the account, revokes its api keys
+// and forgets the device, so its next login is reported again.
+func (service *LoginService) ReportDeviceHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req ReportDeviceRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	// The link is only spent, if the sessions and api keys are revoked as well
+	var accountId int
+	err := service.db(r).Transaction(func(tx *database.PostgresContext) error {
+		now := time.Now()
+
+		var err error
+		if accountId, err = tx.ForgetDevice(security.HashToken(req.Token), now); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeSessions(accountId, now); err != nil {
+			return err
+		}
+
+		return tx.RevokeApiKeys(accountId)
+	})
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidReportToken, "The report token is invalid or expired")
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not report the device")
+		return
+	}
+
+	service.Logger.WarnContext(r.Context(), "new device reported", "userId", accountId)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "All sessions have been revoked, please change your password"))
+}
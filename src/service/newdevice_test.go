@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingNotifier struct {
+	logins chan NewDeviceLogin
+}
+
+func (notifier *recordingNotifier) NotifyNewDevice(ctx context.Context, login NewDeviceLogin) error {
+	notifier.logins <- login
+	return nil
+}
+
+func recordNotifications(t *testing.T) *recordingNotifier {
+	notifier := &recordingNotifier{logins: make(chan NewDeviceLogin, 10)}
+
+	oldNotifier := loginService.DeviceNotifier
+	loginService.DeviceNotifier = notifier
+	t.Cleanup(func() {
+		loginService.DeviceNotifier = oldNotifier
+	})
+
+	return notifier
+}
+
+func loginWithUserAgent(t *testing.T, username string, password string, userAgent string) string {
+	body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/api/auth/login", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&res)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not log in: %v", res)
+	}
+
+	return fmt.Sprintf("%v", res["token"])
+}
+
+const (
+	firefoxUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:128.0) Gecko/20100101 Firefox/128.0"
+	chromeUserAgent  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0.0.0 Safari/537.36"
+)
+
+func TestUserAgentFamily(t *testing.T) {
+	assert.Equal(t, "Firefox on Linux", userAgentFamily(firefoxUserAgent))
+	assert.Equal(t, "Firefox on Linux", userAgentFamily(strings.Replace(firefoxUserAgent, "128.0", "129.0", -1)))
+	assert.Equal(t, "Chrome on Windows", userAgentFamily(chromeUserAgent))
+	assert.Equal(t, "Edge on Windows", userAgentFamily(chromeUserAgent+" Edg/126.0.0.0"))
+	assert.Equal(t, "Safari on iOS", userAgentFamily("Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"))
+	assert.Equal(t, "curl", userAgentFamily("curl/8.5.0"))
+	assert.Equal(t, "Unknown browser", userAgentFamily(""))
+}
+
+func TestIpPrefix(t *testing.T) {
+	assert.Equal(t, "203.0.113.0/24", ipPrefix("203.0.113.42"))
+	assert.Equal(t, "2001:db8:1234::/48", ipPrefix("2001:db8:1234:5678::1"))
+	assert.Equal(t, "unknown", ipPrefix("unknown"))
+}
+
+func TestMailDeviceNotifier(t *testing.T) {
+	mailer := &recordingMailer{messages: make(chan mail.Message, 1)}
+	notifier := MailDeviceNotifier{Mailer: mailer}
+
+	err := notifier.NotifyNewDevice(context.Background(), NewDeviceLogin{
+		Account:        database.Account{Username: "testuser", Email: "testuser@test.com"},
+		Device:         "Firefox on Linux",
+		IpAddress:      "203.0.113.42",
+		Date:           time.Now(),
+		ReportUri:      "https://example.com/report?token=abc",
+		ReportLifetime: time.Hour,
+	})
+
+	message := mailer.receive(t)
+	assert.Nil(t, err)
+	assert.Equal(t, "testuser@test.com", message.To)
+	assert.Contains(t, message.Body, "Firefox on Linux")
+	assert.Contains(t, message.Body, "https://example.com/report?token=abc")
+}
+
+func TestNewDeviceLogin(t *testing.T) {
+	notifier := recordNotifications(t)
+	accountId := createManagedAccount(t, "deviceuser")
+	apiKey := insertApiKey(t, accountId)
+
+	// The first device of an account is not reported
+	loginWithUserAgent(t, "deviceuser", "managedpass", firefoxUserAgent)
+	token := loginWithUserAgent(t, "deviceuser", "managedpass", firefoxUserAgent)
+	loginWithUserAgent(t, "deviceuser", "managedpass", chromeUserAgent)
+
+	var login NewDeviceLogin
+	select {
+	case login = <-notifier.logins:
+	case <-time.After(time.Second):
+		t.Fatal("No notification has been sent")
+	}
+
+	assert.Equal(t, "Chrome on Windows", login.Device)
+	assert.Empty(t, notifier.logins)
+
+	_, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/activity", token, nil)
+	events := res["loginEvents"].([]interface{})
+
+	assert.Len(t, events, 3)
+	assert.Equal(t, true, events[0].(map[string]interface{})["newDevice"])
+	assert.Equal(t, false, events[1].(map[string]interface{})["newDevice"])
+
+	reportUri, _ := url.Parse(login.ReportUri)
+	reportToken := reportUri.Query().Get("token")
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/devices/report", "", ReportDeviceRequest{Token: reportToken})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeSessionRevoked, res["code"])
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", apiKey, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	// The token is single-use
+	resp, res = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/devices/report", "", ReportDeviceRequest{Token: reportToken})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidReportToken, res["code"])
+}
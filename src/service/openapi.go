@@ -0,0 +1,150 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/julienschmidt/httprouter"
+)
+
+//go:embed openapi.json
+var openApiDocument []byte
+
+var openApi = mustLoadOpenApi(openApiDocument)
+
+func mustLoadOpenApi(document []byte) *openapi3.T {
+	spec, err := openapi3.NewLoader().LoadFromData(document)
+	if err != nil {
+		panic(fmt.Sprintf("invalid openapi document: %v", err))
+	}
+
+	if err := spec.Validate(context.Background()); err != nil {
+		panic(fmt.Sprintf("invalid openapi document: %v", err))
+	}
+
+	return spec
+}
+
+// openApiPath converts a httprouter path like /keys/:id to /keys/{id}.
+func openApiPath(path string) string {
+	segments := strings.Split(path, "/")
+
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
+
+// openApiOperation returns the documented operation of the route or nil.
+func openApiOperation(method string, path string) *openapi3.Operation {
+	pathItem := openApi.Paths.Find(openApiPath(path))
+	if pathItem == nil {
+		return nil
+	}
+
+	return pathItem.GetOperation(method)
+}
+
+func (service *LoginService) OpenApiHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openApiDocument)
+}
+
+// ValidateRequestBody rejects JSON bodies not matching the schema of the
+// operation, before the handler runs. Form encoded OAuth requests are left to
+// their handlers, because they have to answer with OAuth errors.
+func ValidateRequestBody(operation *openapi3.Operation, handler httprouter.Handle) httprouter.Handle {
+	if operation == nil || operation.RequestBody == nil || operation.RequestBody.Value == nil {
+		return handler
+	}
+
+	requestBody := operation.RequestBody.Value
+	mediaType := requestBody.Content.Get("application/json")
+
+	if mediaType == nil || mediaType.Schema == nil {
+		return handler
+	}
+
+	schema := mediaType.Schema.Value
+
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			if !writeBodyTooLarge(w, r, err) {
+				writeError(w, r, http.StatusBadRequest, CodeInvalidJson, "Could not read the request body")
+			}
+			return
+		}
+
+		// The handlers decode the body again
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if len(bytes.TrimSpace(body)) == 0 {
+			if requestBody.Required {
+				writeError(w, r, http.StatusBadRequest, CodeValidationFailed, "The request body is missing")
+				return
+			}
+
+			handler(w, r, p)
+			return
+		}
+
+		if !isJsonRequest(r) {
+			writeError(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "The request body must be application/json")
+			return
+		}
+
+		var value interface{}
+		if err := json.Unmarshal(body, &value); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeInvalidJson, "The request body is no valid JSON")
+			return
+		}
+
+		if err := schema.VisitJSON(value, openapi3.MultiErrors()); err != nil {
+			writeValidationError(w, r, "The request body does not match the schema", fieldErrors(err)...)
+			return
+		}
+
+		handler(w, r, p)
+	}
+}
+
+// fieldErrors converts the schema errors to field errors without dumping the
+// whole schema.
+func fieldErrors(err error) []FieldError {
+	var multiErr openapi3.MultiError
+	errs := []error{err}
+
+	if errors.As(err, &multiErr) {
+		errs = multiErr
+	}
+
+	fieldErrors := make([]FieldError, 0, len(errs))
+
+	for _, err := range errs {
+		var schemaErr *openapi3.SchemaError
+
+		if errors.As(err, &schemaErr) {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   strings.Join(schemaErr.JSONPointer(), "."),
+				Message: schemaErr.Reason,
+			})
+		} else {
+			fieldErrors = append(fieldErrors, FieldError{Message: err.Error()})
+		}
+	}
+
+	return fieldErrors
+}
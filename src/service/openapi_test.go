@@ -0,0 +1,118 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenApiDocument(t *testing.T) {
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/openapi.json", "", nil)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "3.0.3", res["openapi"])
+}
+
+var pathParameter = regexp.MustCompile(`\{[^}]+\}`)
+
+func TestOpenApiDocumentsRoutes(t *testing.T) {
+	s := New(ServiceConfig{Jwt: JwtConfig{SignKey: "supersecretsigningkey"}})
+
+	for path, pathItem := range openApi.Paths {
+		requestPath := pathParameter.ReplaceAllString(path, "1")
+
+		for method := range pathItem.Operations() {
+			handle, _, _ := s.Router.Lookup(method, requestPath)
+			assert.NotNil(t, handle, "%s %s is documented but not routed", method, path)
+		}
+	}
+}
+
+func TestOpenApiPath(t *testing.T) {
+	assert.Equal(t, "/api/auth/keys/{id}", openApiPath("/api/auth/keys/:id"))
+	assert.Equal(t, "/api/auth/login", openApiPath("/api/auth/login"))
+}
+
+func validateLoginRequest(t *testing.T, body string) (*httptest.ResponseRecorder, bool) {
+	called := false
+	handler := ValidateRequestBody(openApiOperation(http.MethodPost, "/api/auth/login"), func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		var req LoginRequest
+		called = json.NewDecoder(r.Body).Decode(&req) == nil
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/login", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req, nil)
+
+	return recorder, called
+}
+
+func TestValidateRequestBody(t *testing.T) {
+	recorder, called := validateLoginRequest(t, `{"username": "testuser", "password": "testpass"}`)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.True(t, called)
+
+	for _, body := range []string{``, `{"username": "testuser"`, `{"username": "testuser"}`, `{"username": 1, "password": "testpass"}`, `[]`} {
+		recorder, called := validateLoginRequest(t, body)
+		message, _ := ioutil.ReadAll(recorder.Body)
+
+		assert.Equal(t, http.StatusBadRequest, recorder.Code, body)
+		assert.False(t, called, body)
+		assert.NotContains(t, string(message), "Schema:", body)
+	}
+}
+
+func TestValidateRequestBodyFieldErrors(t *testing.T) {
+	recorder, _ := validateLoginRequest(t, `{"username": 1}`)
+
+	var problem Problem
+	json.NewDecoder(recorder.Body).Decode(&problem)
+
+	assert.Equal(t, CodeValidationFailed, problem.Code)
+	assert.Contains(t, problem.Errors, FieldError{Field: "username", Message: "value must be a string"})
+	assert.Len(t, problem.Errors, 2)
+}
+
+func TestValidateRequestBodyInvalidJson(t *testing.T) {
+	recorder, _ := validateLoginRequest(t, `{"username": "testuser"`)
+
+	var problem Problem
+	json.NewDecoder(recorder.Body).Decode(&problem)
+
+	assert.Equal(t, ProblemContentType, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, CodeInvalidJson, problem.Code)
+}
+
+func TestValidateRequestBodyWithoutSchema(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {}
+
+	assert.NotNil(t, ValidateRequestBody(nil, handler))
+	assert.NotNil(t, ValidateRequestBody(openApiOperation(http.MethodPost, "/api/auth/token"), handler))
+}
+
+func TestValidateRequestBodyAfterAuthentication(t *testing.T) {
+	s := New(ServiceConfig{Jwt: JwtConfig{SignKey: "supersecretsigningkey"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/keys", bytes.NewBufferString(`{"name": 1}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	recorder := httptest.NewRecorder()
+	s.Router.ServeHTTP(recorder, req)
+
+	var problem Problem
+	json.NewDecoder(recorder.Body).Decode(&problem)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, CodeUnauthenticated, problem.Code)
+	assert.Empty(t, problem.Errors)
+}
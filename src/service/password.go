@@ -0,0 +1,223 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"flhansen/application-manager/login-service/src/security"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+type PasswordResetConfig struct {
+	// ResetUri is the page where users enter their new password. The token is
+	// appended as query parameter.
+	ResetUri string `yaml:"resetUri"`
+	// TokenLifetime and ResendInterval are given in seconds
+	TokenLifetime  int `yaml:"tokenLifetime"`
+	ResendInterval int `yaml:"resendInterval"`
+}
+
+func (service *LoginService) passwordResetUri() string {
+	return service.serviceUri(service.PasswordResetUri, "/password/reset")
+}
+
+// serviceUri returns the configured uri or, if it is empty, path below the
+// public url. The host of the request is never used, since clients choose it
+// and could point the links in emails to their own host.
+func (service *LoginService) serviceUri(configured string, path string) string {
+	if configured != "" {
+		return configured
+	}
+
+	return strings.TrimSuffix(service.PublicUrl, "/") + path
+}
+
+// ValidatePublicUrl requires an absolute http or https url, since links
+// built from it are opened from emails.
+func ValidatePublicUrl(publicUrl string) error {
+	if publicUrl == "" {
+		return errors.New("the public url is required")
+	}
+
+	u, err := url.Parse(publicUrl)
+	if err != nil {
+		return fmt.Errorf("invalid public url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("the public url %q must be an absolute http or https url", publicUrl)
+	}
+
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("the public url %q must not have a query or fragment", publicUrl)
+	}
+
+	return nil
+}
+
+// sendMail sends the message in the background, so the response time doesn't
+// reveal whether a message was sent at all.
+func (service *LoginService) sendMail(ctx context.Context, message mail.Message) {
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		if err := service.Mailer.Send(ctx, message); err != nil {
+			service.Logger.ErrorContext(ctx, "could not send email", "subject", message.Subject, "error", err)
+		}
+	}()
+}
+
+// ForgotPasswordHandler answers the same way whether the email is registered
+// or not, so it can't be used to find out who has an account. Disabled and
+// deleted accounts are treated like unknown emails.
+func (service *LoginService) ForgotPasswordHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req ForgotPasswordRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	req.Email = normalizeEmail(req.Email)
+
+	if message := validateEmail(req.Email); message != "" {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "email", Message: message})
+		return
+	}
+
+	acc, err := service.db(r).GetAccountByEmailWithStatus(req.Email, mailableStatuses)
+
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not request a password reset")
+		return
+	}
+
+	if err == nil {
+		if err := service.requestPasswordReset(r, acc); err != nil {
+			service.Logger.ErrorContext(r.Context(), "could not request password reset", "userId", acc.Id, "error", err)
+			writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not request a password reset")
+			return
+		}
+
+		service.Logger.InfoContext(r.Context(), "password reset requested", "userId", acc.Id)
+	}
+
+	writeResponse(w, http.StatusAccepted, NewApiResponse(http.StatusAccepted, "If the email is registered, a reset link has been sent"))
+}
+
+// requestPasswordReset sends a reset link, unless the last one was sent less
+// than PasswordResetResendInterval ago, so the inbox of a victim can't be
+// flooded.
+func (service *LoginService) requestPasswordReset(r *http.Request, acc database.Account) error {
+	message, stored, err := service.insertPasswordReset(service.db(r), acc, service.PasswordResetResendInterval)
+	if err != nil {
+		return err
+	}
+
+	if !stored {
+		service.Logger.InfoContext(r.Context(), "password reset not resent", "userId", acc.Id, "reason", "rate_limited")
+		return nil
+	}
+
+	service.sendMail(r.Context(), message)
+	return nil
+}
+
+// insertPasswordReset stores a new reset token using db and returns the email
+// with the reset link. It is sent by the caller, once the token is committed.
+// Nothing is stored, if the last token was stored less than interval ago.
+func (service *LoginService) insertPasswordReset(db *database.PostgresContext, acc database.Account, interval time.Duration) (mail.Message, bool, error) {
+	rng := security.RandomGenerator{Reader: rand.Reader}
+	token, err := rng.GenerateToken(32)
+	if err != nil {
+		return mail.Message{}, false, err
+	}
+
+	now := time.Now()
+	reset := database.PasswordReset{
+		AccountId:      acc.Id,
+		TokenHash:      security.HashToken(token),
+		ExpirationDate: now.Add(service.PasswordResetLifetime),
+	}
+
+	stored, err := db.InsertPasswordReset(reset, now, now.Add(-interval))
+	if err != nil || !stored {
+		return mail.Message{}, false, err
+	}
+
+	link := service.passwordResetUri() + "?token=" + url.QueryEscape(token)
+
+	return mail.Message{
+		To:      acc.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nopen the following link to choose a new password:\n\n%s\n\nThe link expires in %s. If you didn't request a new password, you can ignore this email.\n",
+			acc.Username, link, service.PasswordResetLifetime),
+	}, true, nil
+}
+
+// ResetPasswordHandler sets the new password and logs out every session of
+// the account, since an attacker might have known the old password.
+func (service *LoginService) ResetPasswordHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req ResetPasswordRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	if message := service.RegistrationValidator.validatePassword(req.Password); message != "" {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "password", Message: message})
+		return
+	}
+
+	// Redeeming the token, revoking the sessions and api keys and invalidating
+	// other links
+	// either happen together or not at all, so a failed reset can be retried
+	var accountId int
+	err := service.db(r).Transaction(func(tx *database.PostgresContext) error {
+		now := time.Now()
+
+		var err error
+		if accountId, err = tx.RedeemPasswordReset(security.HashToken(req.Token), now); err != nil {
+			return err
+		}
+
+		if err := tx.UpdateAccountPassword(accountId, req.Password); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeSessions(accountId, now); err != nil {
+			return err
+		}
+
+		if err := tx.RevokeApiKeys(accountId); err != nil {
+			return err
+		}
+
+		// Other links sent before must not work anymore, the password is
+		// reset already
+		return tx.DeletePasswordResets(accountId)
+	})
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusBadRequest, CodeInvalidResetToken, "The reset token is invalid or expired")
+		return
+	}
+
+	if err != nil {
+		service.Logger.ErrorContext(r.Context(), "could not reset password", "error", err)
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not reset the password")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "password reset", "userId", accountId)
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Password has been reset"))
+}
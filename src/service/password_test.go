@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/database"
+	"flhansen/application-manager/login-service/src/mail"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingMailer struct {
+	messages chan mail.Message
+}
+
+func (mailer *recordingMailer) Send(ctx context.Context, message mail.Message) error {
+	mailer.messages <- message
+	return nil
+}
+
+func recordMails(t *testing.T) *recordingMailer {
+	mailer := &recordingMailer{messages: make(chan mail.Message, 10)}
+
+	oldMailer := loginService.Mailer
+	loginService.Mailer = mailer
+	t.Cleanup(func() {
+		loginService.Mailer = oldMailer
+	})
+
+	return mailer
+}
+
+func (mailer *recordingMailer) receive(t *testing.T) mail.Message {
+	select {
+	case message := <-mailer.messages:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("No email has been sent")
+	}
+
+	return mail.Message{}
+}
+
+var resetTokenPattern = regexp.MustCompile(`token=([0-9a-f]+)`)
+
+func TestForgotPasswordUnknownEmail(t *testing.T) {
+	mailer := recordMails(t)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/forgot", "", ForgotPasswordRequest{Email: "nobody@test.com"})
+
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "If the email is registered, a reset link has been sent", res["message"])
+
+	select {
+	case <-mailer.messages:
+		t.Fatal("An email has been sent to an unknown address")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestForgotPasswordInactiveAccount(t *testing.T) {
+	mailer := recordMails(t)
+
+	for _, status := range []string{database.AccountDisabled, database.AccountDeleted} {
+		accountId, err := loginService.Database.InsertAccountWithStatus("inactiveuser", "inactivepass", "inactiveuser@test.com", status, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/forgot", "", ForgotPasswordRequest{Email: "inactiveuser@test.com"})
+		loginService.Database.DeleteAccount(accountId)
+
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode, status)
+		assert.Equal(t, "If the email is registered, a reset link has been sent", res["message"], status)
+
+		select {
+		case <-mailer.messages:
+			t.Fatalf("An email has been sent to a %s account", status)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func TestForgotPasswordInvalidEmail(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/forgot", "", ForgotPasswordRequest{Email: "nobody"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+}
+
+func TestPasswordReset(t *testing.T) {
+	mailer := recordMails(t)
+
+	accountId, err := loginService.Database.InsertAccount("resetuser", "oldpass", "resetuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer loginService.Database.DeleteAccount(accountId)
+
+	// Issued before the reset, so it has to be revoked by it
+	claims := auth.NewClaims(accountId, "resetuser")
+	claims.IssuedAt = time.Now().Add(-time.Minute).Unix()
+	oldToken, _ := auth.GenerateTokenWithClaims(claims, jwt.SigningMethodHS256, []byte("supersecretsigningkey"), "")
+	apiKey := insertApiKey(t, accountId)
+
+	resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/forgot", "", ForgotPasswordRequest{Email: "resetuser@test.com"})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	message := mailer.receive(t)
+	assert.Equal(t, "resetuser@test.com", message.To)
+
+	match := resetTokenPattern.FindStringSubmatch(message.Body)
+	if match == nil {
+		t.Fatalf("No reset link in email: %s", message.Body)
+	}
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/reset", "", ResetPasswordRequest{Token: match[1], Password: "newpass"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The token is single-use
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/reset", "", ResetPasswordRequest{Token: match[1], Password: "otherpass"})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidResetToken, res["code"])
+
+	resp, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", oldToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeSessionRevoked, res["code"])
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", apiKey, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "resetuser", Password: "oldpass"})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "resetuser", Password: "newpass"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestForgotPasswordThrottled(t *testing.T) {
+	mailer := recordMails(t)
+
+	accountId, err := loginService.Database.InsertAccount("resetuser", "oldpass", "resetuser@test.com", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer loginService.Database.DeleteAccount(accountId)
+
+	for i := 0; i < 3; i++ {
+		resp, _ := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/forgot", "", ForgotPasswordRequest{Email: "resetuser@test.com"})
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+
+	// Only the first request within the interval sends a link
+	assert.Equal(t, "resetuser@test.com", mailer.receive(t).To)
+
+	select {
+	case <-mailer.messages:
+		t.Fatal("The resend interval has been ignored")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestResetPasswordInvalidToken(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/reset", "", ResetPasswordRequest{Token: "invalid", Password: "newpass"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeInvalidResetToken, res["code"])
+}
+
+func TestResetPasswordEmptyPassword(t *testing.T) {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/password/reset", "", ResetPasswordRequest{Token: "invalid"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+}
+
+func TestPasswordResetUri(t *testing.T) {
+	s := &LoginService{PublicUrl: "https://login.test.com/"}
+
+	assert.Equal(t, "https://login.test.com/password/reset", s.passwordResetUri())
+
+	s.PasswordResetUri = "https://app.test.com/reset"
+	assert.Equal(t, "https://app.test.com/reset", s.passwordResetUri())
+}
+
+func TestValidatePublicUrl(t *testing.T) {
+	assert.Nil(t, ValidatePublicUrl("https://login.test.com"))
+	assert.Nil(t, ValidatePublicUrl("http://localhost:8080/auth/"))
+
+	for _, publicUrl := range []string{"", "login.test.com", "/auth", "ftp://login.test.com", "https://login.test.com?x=1", "https://login.test.com#x", "https://%zz"} {
+		assert.NotNil(t, ValidatePublicUrl(publicUrl), publicUrl)
+	}
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/logging"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+const ProblemContentType = "application/problem+json"
+
+// ProblemTypePrefix is prepended to the code to get the type of a problem.
+const ProblemTypePrefix = "urn:appman:problem:"
+
+// Error codes are part of the api. Clients rely on them, so existing codes must
+// never be renamed.
+const (
+	CodeInternalError            = "internal_error"
+	CodeInvalidJson              = "invalid_json"
+	CodeValidationFailed         = "validation_failed"
+	CodeInvalidCredentials       = "invalid_credentials"
+	CodeUnauthenticated          = "unauthenticated"
+	CodeTokenExpired             = "token_expired"
+	CodeSessionRevoked           = "session_revoked"
+	CodeInsufficientScope        = "insufficient_scope"
+	CodeAdminRequired            = "admin_required"
+	CodeImpersonationNotAllowed  = "impersonation_not_allowed"
+	CodeApiKeyNotAllowed         = "api_key_not_allowed"
+	CodeUserExists               = "user_exists"
+	CodeUserNotFound             = "user_not_found"
+	CodeSelfImpersonation        = "self_impersonation"
+	CodeApiKeyNotFound           = "api_key_not_found"
+	CodeInvalidUserCode          = "invalid_user_code"
+	CodeUnsupportedMediaType     = "unsupported_media_type"
+	CodeBodyTooLarge             = "body_too_large"
+	CodeInvalidResetToken        = "invalid_reset_token"
+	CodeInvalidVerificationToken = "invalid_verification_token"
+	CodeEmailNotVerified         = "email_not_verified"
+	CodeInvalidEmailChangeToken  = "invalid_email_change_token"
+	CodeRateLimited              = "rate_limited"
+	CodeAccountPending           = "account_pending"
+	CodeAccountLocked            = "account_locked"
+	CodeAccountDisabled          = "account_disabled"
+	CodeAccountDeleted           = "account_deleted"
+	CodeInvalidStatusTransition  = "invalid_status_transition"
+	CodeSessionNotFound          = "session_not_found"
+	CodeSessionRequired          = "session_required"
+	CodeInvalidReportToken       = "invalid_report_token"
+	CodeOwnAccount               = "own_account"
+	CodeNotFound                 = "not_found"
+	CodeMethodNotAllowed         = "method_not_allowed"
+)
+
+type FieldError struct {
+	// Field is the path of the field like scopes.0
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is an error response as described in RFC 7807.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestId string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+func NewProblem(status int, code string, detail string) Problem {
+	return Problem{
+		Type:   ProblemTypePrefix + code,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// writeProblem writes the problem including the request id, which helps to
+// find the log lines of the failed request.
+func writeProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.Instance = r.URL.Path
+	problem.RequestId = logging.RequestId(r.Context())
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	writeProblem(w, r, NewProblem(status, code, detail))
+}
+
+func writeValidationError(w http.ResponseWriter, r *http.Request, detail string, fieldErrors ...FieldError) {
+	problem := NewProblem(http.StatusBadRequest, CodeValidationFailed, detail)
+	problem.Errors = fieldErrors
+
+	writeProblem(w, r, problem)
+}
+
+// notFoundHandler answers requests of unknown routes.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, CodeNotFound, "The resource does not exist")
+}
+
+// methodNotAllowedHandler answers requests of known routes using another
+// method. The router sets the Allow header before.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "The method is not allowed for the resource")
+}
+
+// panicHandler answers requests whose handler panicked. The panic is only
+// logged, since it may reveal internals.
+func (service *LoginService) panicHandler(w http.ResponseWriter, r *http.Request, v interface{}) {
+	service.Logger.ErrorContext(r.Context(), "handler panicked", "panic", v, "stack", string(debug.Stack()))
+	writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Unexpected error")
+}
+
+// writeResponse writes an api response created by NewApiResponse or
+// NewApiResponseObject.
+func writeResponse(w http.ResponseWriter, status int, response string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprint(w, response)
+}
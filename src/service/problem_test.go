@@ -0,0 +1,75 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProblem(t *testing.T) {
+	problem := NewProblem(http.StatusNotFound, CodeUserNotFound, "User not found")
+
+	assert.Equal(t, "urn:appman:problem:user_not_found", problem.Type)
+	assert.Equal(t, "Not Found", problem.Title)
+	assert.Equal(t, http.StatusNotFound, problem.Status)
+	assert.Equal(t, CodeUserNotFound, problem.Code)
+}
+
+func TestWriteError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeError(recorder, httptest.NewRequest(http.MethodGet, "/api/auth/keys", nil), http.StatusUnauthorized, CodeTokenExpired, "Token expired")
+
+	var res map[string]interface{}
+	json.NewDecoder(recorder.Body).Decode(&res)
+
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, ProblemContentType, recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "/api/auth/keys", res["instance"])
+	assert.Equal(t, CodeTokenExpired, res["code"])
+	assert.Equal(t, float64(http.StatusUnauthorized), res["status"])
+	assert.Nil(t, res["errors"])
+}
+
+func TestWriteValidationError(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writeValidationError(recorder, httptest.NewRequest(http.MethodPost, "/api/auth/keys", nil), "Invalid api key", FieldError{Field: "name", Message: "must not be empty"})
+
+	var problem Problem
+	json.NewDecoder(recorder.Body).Decode(&problem)
+
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, CodeValidationFailed, problem.Code)
+	assert.Equal(t, []FieldError{{Field: "name", Message: "must not be empty"}}, problem.Errors)
+}
+
+func TestRouterProblems(t *testing.T) {
+	s := New(ServiceConfig{Jwt: JwtConfig{SignKey: "supersecretsigningkey"}})
+	s.Router.GET("/panic", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		panic("broken handler")
+	})
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+		code   string
+	}{
+		{http.MethodGet, "/api/auth/unknown", http.StatusNotFound, CodeNotFound},
+		{http.MethodPut, "/api/auth/login", http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+		{http.MethodGet, "/panic", http.StatusInternalServerError, CodeInternalError},
+	} {
+		recorder := httptest.NewRecorder()
+		s.Router.ServeHTTP(recorder, httptest.NewRequest(test.method, test.path, nil))
+
+		var problem Problem
+		json.NewDecoder(recorder.Body).Decode(&problem)
+
+		assert.Equal(t, test.status, recorder.Code, test.path)
+		assert.Equal(t, ProblemContentType, recorder.Header().Get("Content-Type"), test.path)
+		assert.Equal(t, test.code, problem.Code, test.path)
+	}
+}
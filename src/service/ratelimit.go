@@ -0,0 +1,107 @@
+package service
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// RateLimitConfig allows Requests per Window seconds and client.
+type RateLimitConfig struct {
+	Requests int `yaml:"requests"`
+	Window   int `yaml:"window"`
+}
+
+// RateLimiter counts the requests of every client in fixed windows. The
+// counts are kept in memory, so every instance limits on its own.
+type RateLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mutex     sync.Mutex
+	clients   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		limit:   limit,
+		window:  window,
+		now:     time.Now,
+		clients: map[string]*rateWindow{},
+	}
+}
+
+// Allow counts a request of the client. If the limit is exceeded, it returns
+// false and how long the client has to wait.
+func (limiter *RateLimiter) Allow(client string) (bool, time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	limiter.sweep(now)
+
+	current, ok := limiter.clients[client]
+	if !ok || now.Sub(current.start) >= limiter.window {
+		current = &rateWindow{start: now}
+		limiter.clients[client] = current
+	}
+
+	if current.count >= limiter.limit {
+		return false, current.start.Add(limiter.window).Sub(now)
+	}
+
+	current.count++
+	return true, 0
+}
+
+// sweep forgets clients whose window has ended, at most once per window.
+func (limiter *RateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < limiter.window {
+		return
+	}
+
+	for client, current := range limiter.clients {
+		if now.Sub(current.start) >= limiter.window {
+			delete(limiter.clients, client)
+		}
+	}
+
+	limiter.lastSweep = now
+}
+
+// clientAddress is the IP address the request was sent from. Forwarding
+// headers are ignored, because clients can set them to anything.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// RateLimited answers with 429 Too Many Requests once the client exceeded the
+// limit.
+func RateLimited(limiter *RateLimiter, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if ok, retryAfter := limiter.Allow(clientAddress(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "Too many requests, try again later")
+			return
+		}
+
+		handler(w, r, p)
+	}
+}
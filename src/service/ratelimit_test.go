@@ -0,0 +1,68 @@
+package service
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	ok, _ := limiter.Allow("10.0.0.1")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("10.0.0.1")
+	assert.True(t, ok)
+
+	ok, retryAfter := limiter.Allow("10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Minute, retryAfter)
+
+	// Clients are limited independently
+	ok, _ = limiter.Allow("10.0.0.2")
+	assert.True(t, ok)
+
+	now = now.Add(time.Minute)
+	ok, _ = limiter.Allow("10.0.0.1")
+	assert.True(t, ok)
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	now := time.Now()
+	limiter := NewRateLimiter(1, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	limiter.Allow("10.0.0.1")
+	now = now.Add(2 * time.Minute)
+	limiter.Allow("10.0.0.2")
+
+	assert.Len(t, limiter.clients, 1)
+}
+
+func TestRateLimited(t *testing.T) {
+	handler := RateLimited(NewRateLimiter(1, time.Minute), func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/availability", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, req, nil)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+	// Other ports of the same address share the limit
+	req.RemoteAddr = "10.0.0.1:5678"
+	recorder = httptest.NewRecorder()
+	handler(recorder, req, nil)
+
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "60", recorder.Header().Get("Retry-After"))
+	assert.Contains(t, recorder.Body.String(), CodeRateLimited)
+}
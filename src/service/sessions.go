@@ -0,0 +1,155 @@
+package service
+
+import (
+	"errors"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/julienschmidt/httprouter"
+)
+
+// sessionTouchInterval limits how often the last use of a session is written,
+// so not every request writes to the database.
+const sessionTouchInterval = time.Minute
+
+const maxUserAgentLength = 255
+
+// userAgent truncates the user agent to the length stored in the database.
+func userAgent(r *http.Request) string {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		return userAgent[:maxUserAgentLength]
+	}
+
+	return userAgent
+}
+
+// startSession records the session of a login and links the claims to it, so
+// the token can be revoked on its own.
+func (service *LoginService) startSession(r *http.Request, claims *auth.JwtClaims) error {
+	now := time.Now()
+	sessionId, err := service.db(r).InsertSession(database.Session{
+		AccountId:      claims.UserId,
+		UserAgent:      userAgent(r),
+		IpAddress:      clientAddress(r),
+		ExpirationDate: time.Unix(claims.ExpiresAt, 0),
+		CreationDate:   now,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	claims.SessionId = sessionId
+	return nil
+}
+
+// checkSession rejects tokens of revoked sessions and records the use of the
+// session. Tokens without a session, like impersonation tokens, are only
+// revoked with all sessions of the account.
+func (service LoginService) checkSession(r *http.Request, claims *auth.JwtClaims) error {
+	if claims.SessionId == 0 {
+		return nil
+	}
+
+	session, err := service.db(r).GetSessionById(claims.SessionId)
+
+	if errors.Is(err, pgx.ErrNoRows) || err == nil && (session.AccountId != claims.UserId || session.RevokedDate != nil) {
+		return errSessionRevoked
+	}
+
+	if err != nil {
+		return storeError{err: err}
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenDate) >= sessionTouchInterval {
+		// The request doesn't depend on the last use, so failures are only logged
+		if err := service.db(r).TouchSession(session.Id, now); err != nil {
+			service.Logger.WarnContext(r.Context(), "could not update session", "sessionId", session.Id, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// currentSession returns the session id of the token, which is 0 for API keys
+// and tokens without a session.
+func currentSession(principal *authclient.Principal) int {
+	if principal.Claims == nil {
+		return 0
+	}
+
+	return principal.Claims.SessionId
+}
+
+// ListSessionsHandler lists the active sessions of the user. The session of
+// the request is marked as current.
+func (service *LoginService) ListSessionsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+
+	sessions, err := service.db(r).GetActiveSessions(principal.UserId, time.Now())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not load the sessions")
+		return
+	}
+
+	sessionResponses := make([]SessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		sessionResponses = append(sessionResponses, NewSessionResponse(session, currentSession(principal)))
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeResponse(w, http.StatusOK, NewApiResponseObject(http.StatusOK, "Sessions loaded", map[string]interface{}{"sessions": sessionResponses}))
+}
+
+// RevokeSessionHandler logs out a single session of the user. Revoking the
+// session of the request logs out.
+func (service *LoginService) RevokeSessionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+
+	sessionId, err := strconv.Atoi(p.ByName("id"))
+	if err != nil {
+		writeValidationError(w, r, "The request is invalid", FieldError{Field: "id", Message: "Invalid session id"})
+		return
+	}
+
+	revoked, err := service.db(r).RevokeSession(principal.UserId, sessionId, time.Now())
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not revoke the session")
+		return
+	}
+
+	if !revoked {
+		writeError(w, r, http.StatusNotFound, CodeSessionNotFound, "Session not found")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "session revoked", "userId", principal.UserId, "sessionId", sessionId)
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Session revoked"))
+}
+
+// RevokeOtherSessionsHandler logs out everywhere except the session of the
+// request. It requires a token of a login, which has a session to keep.
+func (service *LoginService) RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	principal, _ := authclient.FromContext(r.Context())
+
+	sessionId := currentSession(principal)
+	if sessionId == 0 {
+		writeError(w, r, http.StatusForbidden, CodeSessionRequired, "The request must be authenticated by the token of a login")
+		return
+	}
+
+	if err := service.db(r).RevokeOtherSessions(principal.UserId, sessionId, time.Now()); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not revoke the sessions")
+		return
+	}
+
+	service.Logger.InfoContext(r.Context(), "other sessions revoked", "userId", principal.UserId, "sessionId", sessionId)
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "All other sessions revoked"))
+}
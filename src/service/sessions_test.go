@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"flhansen/application-manager/login-service/src/auth"
+	"flhansen/application-manager/login-service/src/authclient"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+)
+
+func loginSession(t *testing.T, username string, password string) string {
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: username, Password: password})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Could not log in: %v", res)
+	}
+
+	return fmt.Sprintf("%v", res["token"])
+}
+
+func TestCurrentSession(t *testing.T) {
+	assert.Equal(t, 0, currentSession(&authclient.Principal{ApiKeyId: 1}))
+	assert.Equal(t, 3, currentSession(&authclient.Principal{Claims: &auth.JwtClaims{SessionId: 3}}))
+}
+
+func TestNotApiKey(t *testing.T) {
+	handler := NotApiKey(func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for apiKeyId, status := range map[int]int{0: http.StatusNoContent, 1: http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/sessions", nil)
+		req = req.WithContext(authclient.NewContext(context.Background(), &authclient.Principal{UserId: 1, ApiKeyId: apiKeyId}))
+
+		recorder := httptest.NewRecorder()
+		handler(recorder, req, nil)
+
+		assert.Equal(t, status, recorder.Code)
+	}
+}
+
+func TestListSessions(t *testing.T) {
+	createManagedAccount(t, "sessionuser")
+	token := loginSession(t, "sessionuser", "managedpass")
+	loginSession(t, "sessionuser", "managedpass")
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/sessions", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	sessions := res["sessions"].([]interface{})
+	assert.Len(t, sessions, 2)
+
+	current := 0
+	for _, session := range sessions {
+		if session.(map[string]interface{})["current"] == true {
+			current++
+		}
+
+		assert.NotEmpty(t, session.(map[string]interface{})["ipAddress"])
+	}
+
+	assert.Equal(t, 1, current)
+}
+
+func TestRevokeSession(t *testing.T) {
+	createManagedAccount(t, "sessionuser")
+	token := loginSession(t, "sessionuser", "managedpass")
+
+	claims, err := loginService.Verifier.Verify(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, _ := doRequest(t, http.MethodDelete, fmt.Sprintf("http://localhost:8080/api/auth/sessions/%d", claims.SessionId), token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeSessionRevoked, res["code"])
+}
+
+func TestRevokeSessionOfOtherAccount(t *testing.T) {
+	createManagedAccount(t, "sessionuser")
+	token := loginSession(t, "sessionuser", "managedpass")
+	otherToken := loginSession(t, "testuser", "testpass")
+
+	claims, _ := loginService.Verifier.Verify(context.Background(), otherToken)
+
+	resp, res := doRequest(t, http.MethodDelete, fmt.Sprintf("http://localhost:8080/api/auth/sessions/%d", claims.SessionId), token, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, CodeSessionNotFound, res["code"])
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", otherToken, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestRevokeOtherSessions(t *testing.T) {
+	createManagedAccount(t, "sessionuser")
+	token := loginSession(t, "sessionuser", "managedpass")
+	otherToken := loginSession(t, "sessionuser", "managedpass")
+
+	resp, _ := doRequest(t, http.MethodDelete, "http://localhost:8080/api/auth/sessions", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", token, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/me", otherToken, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Equal(t, CodeSessionRevoked, res["code"])
+
+	_, res = doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/sessions", token, nil)
+	assert.Len(t, res["sessions"], 1)
+}
+
+func TestRevokeOtherSessionsWithoutSession(t *testing.T) {
+	resp, res := doRequest(t, http.MethodDelete, "http://localhost:8080/api/auth/sessions", testUserToken(t), nil)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeSessionRequired, res["code"])
+}
+
+func TestSessionsApiKey(t *testing.T) {
+	key, _ := createApiKey(t, []string{auth.ScopeAccountRead})
+
+	resp, res := doRequest(t, http.MethodGet, "http://localhost:8080/api/auth/sessions", key, nil)
+
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeApiKeyNotAllowed, res["code"])
+}
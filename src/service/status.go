@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"flhansen/application-manager/login-service/src/authclient"
+	"flhansen/application-manager/login-service/src/database"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const accountStatusChanges = 50
+
+// accountStatusError is returned for valid credentials of accounts, which must
+// not be used.
+type accountStatusError struct {
+	status string
+}
+
+func (err accountStatusError) Error() string {
+	return "account is " + err.status
+}
+
+var errInvalidTransition = errors.New("invalid account status transition")
+
+// accountStatusProblems describes why an account of the status can't be used.
+var accountStatusProblems = map[string]struct {
+	code   string
+	detail string
+}{
+	database.AccountPending:  {CodeAccountPending, "The account has not been activated yet"},
+	database.AccountLocked:   {CodeAccountLocked, "The account has been locked"},
+	database.AccountDisabled: {CodeAccountDisabled, "The account has been disabled"},
+	database.AccountDeleted:  {CodeAccountDeleted, "The account has been deleted"},
+}
+
+// mailableStatuses are the statuses of accounts, which receive password reset
+// and verification links. Disabled and deleted accounts can only be made usable
+// by admins, so their links would be of no use.
+var mailableStatuses = []string{database.AccountPending, database.AccountActive, database.AccountLocked}
+
+// checkAccountStatus only accepts active accounts.
+func checkAccountStatus(acc database.Account) error {
+	if acc.Status != database.AccountActive {
+		return accountStatusError{status: acc.Status}
+	}
+
+	return nil
+}
+
+func writeAccountStatusError(w http.ResponseWriter, r *http.Request, status string) {
+	problem, ok := accountStatusProblems[status]
+	if !ok {
+		problem = accountStatusProblems[database.AccountDisabled]
+	}
+
+	writeError(w, r, http.StatusForbidden, problem.code, problem.detail)
+}
+
+// transitionAccount changes the status of the account using db and records the
+// reason. The authenticated user is recorded as actor, if there is one. It
+// fails with errInvalidTransition, if the status can't change to the given one,
+// including changes made concurrently.
+func (service *LoginService) transitionAccount(r *http.Request, db *database.PostgresContext, acc database.Account, status string, reason string) error {
+	if !database.CanTransition(acc.Status, status) {
+		return errInvalidTransition
+	}
+
+	change := database.AccountStatusChange{
+		AccountId: acc.Id,
+		OldStatus: acc.Status,
+		NewStatus: status,
+		Reason:    reason,
+	}
+
+	if principal, ok := authclient.FromContext(r.Context()); ok {
+		change.ActorId = principal.UserId
+	}
+
+	updated, err := db.TransitionAccountStatus(change)
+	if err != nil {
+		return err
+	}
+
+	if !updated {
+		return errInvalidTransition
+	}
+
+	service.Logger.InfoContext(r.Context(), "account status changed", "userId", acc.Id, "from", acc.Status, "to", status, "reason", reason)
+	return nil
+}
+
+// changeAccountStatus is shared by the admin endpoints changing the status,
+// which is audited as action. It answers the request, if the status couldn't
+// be changed.
+func (service *LoginService) changeAccountStatus(w http.ResponseWriter, r *http.Request, acc database.Account, status string, reason string, action string) bool {
+	err := service.audited(r, acc.Id, action, func(tx *database.PostgresContext) error {
+		return service.transitionAccount(r, tx, acc, status, reason)
+	})
+
+	if err != nil {
+		writeTransitionError(w, r, acc, status, err)
+		return false
+	}
+
+	return true
+}
+
+func writeTransitionError(w http.ResponseWriter, r *http.Request, acc database.Account, status string, err error) {
+	if errors.Is(err, errInvalidTransition) {
+		writeError(w, r, http.StatusConflict, CodeInvalidStatusTransition, "The account can't change from "+acc.Status+" to "+status)
+		return
+	}
+
+	writeError(w, r, http.StatusInternalServerError, CodeInternalError, "Could not change the status of the account")
+}
+
+// SetAccountStatusHandler changes the status of another account to any status
+// allowed by the transitions. Deleted accounts are kept, but can't be used
+// anymore.
+func (service *LoginService) SetAccountStatusHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req AccountStatusRequest
+
+	if !decodeJson(w, r, &req) {
+		return
+	}
+
+	var errs []FieldError
+
+	if !containsString(database.AccountStatuses, req.Status) {
+		errs = append(errs, FieldError{Field: "status", Message: "is no account status"})
+	}
+
+	if req.Reason == "" || len(req.Reason) > 255 {
+		errs = append(errs, FieldError{Field: "reason", Message: "must have between 1 and 255 characters"})
+	}
+
+	if len(errs) > 0 {
+		writeValidationError(w, r, "The request is invalid", errs...)
+		return
+	}
+
+	acc, ok := service.accountParam(w, r, p)
+	if !ok || !notOwnAccount(w, r, acc) {
+		return
+	}
+
+	if !service.changeAccountStatus(w, r, acc, req.Status, req.Reason, "status_"+req.Status) {
+		return
+	}
+
+	writeResponse(w, http.StatusOK, NewApiResponse(http.StatusOK, "Account status changed"))
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"encoding/json"
+	"flhansen/application-manager/login-service/src/database"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteAccountStatusError(t *testing.T) {
+	for status, code := range map[string]string{
+		database.AccountPending:  CodeAccountPending,
+		database.AccountLocked:   CodeAccountLocked,
+		database.AccountDisabled: CodeAccountDisabled,
+		database.AccountDeleted:  CodeAccountDeleted,
+		"unknown":                CodeAccountDisabled,
+	} {
+		recorder := httptest.NewRecorder()
+		writeAccountStatusError(recorder, httptest.NewRequest(http.MethodGet, "/api/auth/me", nil), status)
+
+		var problem Problem
+		json.NewDecoder(recorder.Body).Decode(&problem)
+
+		assert.Equal(t, http.StatusForbidden, recorder.Code)
+		assert.Equal(t, code, problem.Code)
+	}
+}
+
+func TestCheckAccountStatus(t *testing.T) {
+	assert.Nil(t, checkAccountStatus(database.Account{Status: database.AccountActive}))
+	assert.Equal(t, accountStatusError{status: database.AccountLocked}, checkAccountStatus(database.Account{Status: database.AccountLocked}))
+	assert.Equal(t, "inactive", validationOutcome(accountStatusError{status: database.AccountLocked}))
+}
+
+func TestSetAccountStatus(t *testing.T) {
+	adminId, token := adminToken(t)
+	accountId := createManagedAccount(t, "statususer")
+
+	resp, _ := doRequest(t, http.MethodPost, accountUrl(accountId, "/status"), token, AccountStatusRequest{Status: database.AccountLocked, Reason: "suspicious logins"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "statususer", Password: "managedpass"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeAccountLocked, res["code"])
+
+	// Locked accounts can't become pending again
+	resp, res = doRequest(t, http.MethodPost, accountUrl(accountId, "/status"), token, AccountStatusRequest{Status: database.AccountPending, Reason: "test"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	assert.Equal(t, CodeInvalidStatusTransition, res["code"])
+
+	resp, _ = doRequest(t, http.MethodPost, accountUrl(accountId, "/status"), token, AccountStatusRequest{Status: database.AccountDeleted, Reason: "requested by the owner"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, res = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "statususer", Password: "managedpass"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeAccountDeleted, res["code"])
+
+	// Deleted accounts stay deleted
+	resp, _ = doRequest(t, http.MethodPost, accountUrl(accountId, "/enable"), token, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	_, res = doRequest(t, http.MethodGet, accountUrl(accountId, ""), token, nil)
+	changes := res["statusChanges"].([]interface{})
+
+	assert.Len(t, changes, 2)
+	assert.Equal(t, database.AccountDeleted, changes[0].(map[string]interface{})["newStatus"])
+	assert.Equal(t, "suspicious logins", changes[1].(map[string]interface{})["reason"])
+	assert.Equal(t, float64(adminId), changes[1].(map[string]interface{})["actorId"])
+}
+
+func TestSetAccountStatusInvalid(t *testing.T) {
+	_, token := adminToken(t)
+	accountId := createManagedAccount(t, "statususer")
+
+	resp, res := doRequest(t, http.MethodPost, accountUrl(accountId, "/status"), token, AccountStatusRequest{Status: "banned"})
+
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, CodeValidationFailed, res["code"])
+	assert.Len(t, res["errors"], 2)
+}
+
+func TestRegisterPendingAccount(t *testing.T) {
+	loginService.EmailVerificationRequired = true
+	defer func() {
+		loginService.EmailVerificationRequired = false
+	}()
+
+	token := registerVerificationUser(t, recordMails(t))
+
+	resp, res := doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "verifypass"})
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, CodeAccountPending, res["code"])
+
+	doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/email/verify", "", VerifyEmailRequest{Token: token})
+
+	resp, _ = doRequest(t, http.MethodPost, "http://localhost:8080/api/auth/login", "", LoginRequest{Username: "verifyuser", Password: "verifypass"})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	acc, _ := loginService.Database.GetAccountByUsername("verifyuser")
+	changes, _ := loginService.Database.GetAccountStatusChanges(acc.Id, 10)
+
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "email verified", changes[0].Reason)
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+type TlsConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// MinVersion is one of "1.2" or "1.3" and defaults to "1.2"
+	MinVersion string `yaml:"minVersion"`
+	// CipherSuites are names like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. They
+	// only apply to TLS 1.2, the suites of TLS 1.3 are not configurable.
+	CipherSuites []string `yaml:"cipherSuites"`
+	// If ClientCaFile is set, clients have to present a certificate signed by
+	// one of its certificate authorities.
+	ClientCaFile string `yaml:"clientCaFile"`
+}
+
+func (config TlsConfig) Enabled() bool {
+	return config.CertFile != "" || config.KeyFile != ""
+}
+
+func parseTlsVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+
+	return 0, fmt.Errorf("unsupported tls version %s", version)
+}
+
+// tlsReloadInterval is the time between checks of the files, since stating
+// them on every handshake is too expensive.
+const tlsReloadInterval = 10 * time.Second
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	available := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported cipher suite %s", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// tlsReloader reloads the certificate and client CAs when one of the files
+// changes, so renewed certificates are used without restarting the service.
+// The files are checked at most once per interval.
+type tlsReloader struct {
+	config       TlsConfig
+	minVersion   uint16
+	cipherSuites []uint16
+	interval     time.Duration
+	logger       *slog.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	current *tls.Config
+}
+
+func newTlsConfig(config TlsConfig, logger *slog.Logger) (*tls.Config, error) {
+	reloader, err := newTlsReloader(config, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	return reloader.tlsConfig(), nil
+}
+
+func newTlsReloader(config TlsConfig, logger *slog.Logger) (*tlsReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls needs both a certificate and a key file")
+	}
+
+	minVersion, err := parseTlsVersion(config.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cipherSuites, err := parseCipherSuites(config.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader := &tlsReloader{
+		config:       config,
+		minVersion:   minVersion,
+		cipherSuites: cipherSuites,
+		interval:     tlsReloadInterval,
+		logger:       logger,
+	}
+
+	// Fail on startup instead of the first handshake
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	reloader.checked = time.Now()
+	return reloader, nil
+}
+
+func (reloader *tlsReloader) files() []string {
+	files := []string{reloader.config.CertFile, reloader.config.KeyFile}
+
+	if reloader.config.ClientCaFile != "" {
+		files = append(files, reloader.config.ClientCaFile)
+	}
+
+	return files
+}
+
+func (reloader *tlsReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range reloader.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+// tlsConfig returns the configuration of the server, which gets the current
+// configuration from the reloader on every handshake.
+func (reloader *tlsReloader) tlsConfig() *tls.Config {
+	config := reloader.newConfig()
+	config.GetCertificate = reloader.GetCertificate
+	config.GetConfigForClient = reloader.GetConfigForClient
+
+	return config
+}
+
+func (reloader *tlsReloader) newConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   reloader.minVersion,
+		CipherSuites: reloader.cipherSuites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+}
+
+func (reloader *tlsReloader) reload() error {
+	modTime, err := reloader.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(reloader.config.CertFile, reloader.config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	config := reloader.newConfig()
+	config.Certificates = []tls.Certificate{certificate}
+
+	if reloader.config.ClientCaFile != "" {
+		caContent, err := ioutil.ReadFile(reloader.config.ClientCaFile)
+		if err != nil {
+			return err
+		}
+
+		clientCas := x509.NewCertPool()
+		if !clientCas.AppendCertsFromPEM(caContent) {
+			return fmt.Errorf("no certificates found in %s", reloader.config.ClientCaFile)
+		}
+
+		config.ClientCAs = clientCas
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	reloader.current = config
+	reloader.modTime = modTime
+	return nil
+}
+
+func (reloader *tlsReloader) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	if time.Since(reloader.checked) < reloader.interval {
+		return reloader.current, nil
+	}
+
+	reloader.checked = time.Now()
+
+	// Files may be replaced one after another, so failed reloads keep the
+	// previous configuration and are retried on the next check
+	if modTime, err := reloader.latestModTime(); err == nil && modTime.After(reloader.modTime) {
+		if err := reloader.reload(); err != nil {
+			reloader.logger.Warn("could not reload tls configuration", "error", err)
+		}
+	}
+
+	return reloader.current, nil
+}
+
+func (reloader *tlsReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	config, err := reloader.GetConfigForClient(hello)
+	if err != nil {
+		return nil, err
+	}
+
+	return &config.Certificates[0], nil
+}
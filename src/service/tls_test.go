@@ -0,0 +1,263 @@
+package service
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	certPem     []byte
+	keyPem      []byte
+}
+
+func newTestCertificate(t *testing.T, commonName string, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	parentCertificate, parentKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parentCertificate, parentKey = parent.certificate, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCertificate, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, _ := x509.ParseCertificate(der)
+
+	return testCertificate{
+		certificate: certificate,
+		key:         key,
+		certPem:     pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPem:      pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+func writeTestCertificate(t *testing.T, dir string, name string, certificate testCertificate) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	if err := ioutil.WriteFile(certFile, certificate.certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, certificate.keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func newTlsTestServer(t *testing.T, config TlsConfig) *httptest.Server {
+	reloader, err := newTlsReloader(config, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Check the files on every handshake
+	reloader.interval = 0
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	server.TLS = reloader.tlsConfig()
+	server.StartTLS()
+
+	return server
+}
+
+func tlsTestClient(ca testCertificate, clientCertificate *testCertificate) *http.Client {
+	rootCas := x509.NewCertPool()
+	rootCas.AddCert(ca.certificate)
+
+	config := &tls.Config{RootCAs: rootCas}
+
+	if clientCertificate != nil {
+		pair, _ := tls.X509KeyPair(clientCertificate.certPem, clientCertificate.keyPem)
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func TestTlsConfigInvalid(t *testing.T) {
+	_, err := newTlsConfig(TlsConfig{CertFile: "server.crt"}, slog.Default())
+	assert.NotNil(t, err)
+
+	_, err = newTlsConfig(TlsConfig{CertFile: "invalid/server.crt", KeyFile: "invalid/server.key"}, slog.Default())
+	assert.NotNil(t, err)
+
+	_, err = parseTlsVersion("1.0")
+	assert.NotNil(t, err)
+
+	_, err = parseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.NotNil(t, err)
+}
+
+func TestTlsCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, ids)
+}
+
+func TestTlsReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", newTestCertificate(t, "server-1", &ca))
+
+	server := newTlsTestServer(t, TlsConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"})
+	defer server.Close()
+
+	client := tlsTestClient(ca, nil)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "server-1", resp.TLS.PeerCertificates[0].Subject.CommonName)
+
+	writeTestCertificate(t, dir, "server", newTestCertificate(t, "server-2", &ca))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	resp, err = client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "server-2", resp.TLS.PeerCertificates[0].Subject.CommonName)
+}
+
+func TestTlsReloadInterval(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", newTestCertificate(t, "server-1", &ca))
+
+	reloader, err := newTlsReloader(TlsConfig{CertFile: certFile, KeyFile: keyFile}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCertificate(t, dir, "server", newTestCertificate(t, "server-2", &ca))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	// The files are not checked again within the interval
+	certificate, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _ := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, "server-1", parsed.Subject.CommonName)
+
+	reloader.checked = reloader.checked.Add(-reloader.interval)
+
+	certificate, err = reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _ = x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, "server-2", parsed.Subject.CommonName)
+}
+
+func TestTlsReloadFailureLogged(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", newTestCertificate(t, "server-1", &ca))
+
+	var logs bytes.Buffer
+	reloader, err := newTlsReloader(TlsConfig{CertFile: certFile, KeyFile: keyFile}, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloader.interval = 0
+
+	// A half written key keeps the previous certificate and is logged
+	if err := ioutil.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+
+	certificate, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _ := x509.ParseCertificate(certificate.Certificate[0])
+	assert.Equal(t, "server-1", parsed.Subject.CommonName)
+	assert.Contains(t, logs.String(), "could not reload tls configuration")
+}
+
+func TestMutualTls(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "ca", nil)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", newTestCertificate(t, "server", &ca))
+	caFile, _ := writeTestCertificate(t, dir, "ca", ca)
+
+	server := newTlsTestServer(t, TlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCaFile: caFile})
+	defer server.Close()
+
+	_, err := tlsTestClient(ca, nil).Get(server.URL)
+	assert.NotNil(t, err)
+
+	otherCa := newTestCertificate(t, "other-ca", nil)
+	foreignClient := newTestCertificate(t, "client", &otherCa)
+	_, err = tlsTestClient(ca, &foreignClient).Get(server.URL)
+	assert.NotNil(t, err)
+
+	client := newTestCertificate(t, "client", &ca)
+	resp, err := tlsTestClient(ca, &client).Get(server.URL)
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
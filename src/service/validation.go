@@ -0,0 +1,189 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxColumnLength is the length of the VARCHAR columns of the account table.
+const maxColumnLength = 80
+
+const (
+	defaultUsernameMinLength = 3
+	defaultUsernamePattern   = `^[a-zA-Z0-9._-]+$`
+	defaultPasswordMinLength = 1
+	defaultPasswordMaxLength = 128
+)
+
+// maxPasswordLength bounds the configurable maximum. Longer passwords are
+// rejected without hashing them, since PBKDF2 hashes the whole password.
+const maxPasswordLength = 1024
+
+// emailPattern is a pragmatic subset of the RFC 5322 addr-spec: a dot-atom
+// local part and a domain with at least two labels.
+var emailPattern = regexp.MustCompile(`^[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+(\.[a-zA-Z0-9!#$%&'*+/=?^_{|}~-]+)*@([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]{2,}$`)
+
+// ValidationConfig restricts the usernames and passwords of new accounts.
+// Lengths are counted in characters, the maximum username length can't exceed
+// the column length of 80, the maximum password length not 1024.
+type ValidationConfig struct {
+	UsernameMinLength int `yaml:"usernameMinLength"`
+	UsernameMaxLength int `yaml:"usernameMaxLength"`
+	// UsernamePattern is a regular expression every username has to match.
+	// It defaults to letters, digits, dots, underscores and hyphens.
+	UsernamePattern   string `yaml:"usernamePattern"`
+	PasswordMinLength int    `yaml:"passwordMinLength"`
+	PasswordMaxLength int    `yaml:"passwordMaxLength"`
+}
+
+type RegistrationValidator struct {
+	usernameMinLength int
+	usernameMaxLength int
+	usernamePattern   *regexp.Regexp
+	passwordMinLength int
+	passwordMaxLength int
+}
+
+func NewRegistrationValidator(config ValidationConfig) (*RegistrationValidator, error) {
+	validator := &RegistrationValidator{
+		usernameMinLength: config.UsernameMinLength,
+		usernameMaxLength: config.UsernameMaxLength,
+		passwordMinLength: config.PasswordMinLength,
+		passwordMaxLength: config.PasswordMaxLength,
+	}
+
+	if validator.usernameMinLength <= 0 {
+		validator.usernameMinLength = defaultUsernameMinLength
+	}
+
+	if validator.usernameMaxLength <= 0 {
+		validator.usernameMaxLength = maxColumnLength
+	}
+
+	if validator.usernameMaxLength > maxColumnLength {
+		return nil, fmt.Errorf("maximum username length must not exceed %d", maxColumnLength)
+	}
+
+	if validator.usernameMinLength > validator.usernameMaxLength {
+		return nil, fmt.Errorf("minimum username length %d exceeds the maximum of %d", validator.usernameMinLength, validator.usernameMaxLength)
+	}
+
+	if validator.passwordMinLength <= 0 {
+		validator.passwordMinLength = defaultPasswordMinLength
+	}
+
+	if validator.passwordMaxLength <= 0 {
+		validator.passwordMaxLength = defaultPasswordMaxLength
+	}
+
+	if validator.passwordMaxLength > maxPasswordLength {
+		return nil, fmt.Errorf("maximum password length must not exceed %d", maxPasswordLength)
+	}
+
+	if validator.passwordMinLength > validator.passwordMaxLength {
+		return nil, fmt.Errorf("minimum password length %d exceeds the maximum of %d", validator.passwordMinLength, validator.passwordMaxLength)
+	}
+
+	pattern := config.UsernamePattern
+	if pattern == "" {
+		pattern = defaultUsernamePattern
+	}
+
+	usernamePattern, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid username pattern: %w", err)
+	}
+
+	validator.usernamePattern = usernamePattern
+	return validator, nil
+}
+
+// Validate returns an error for every invalid field of the request.
+func (validator *RegistrationValidator) Validate(req RegisterRequest) []FieldError {
+	var errs []FieldError
+
+	if message := validator.validateUsername(req.Username); message != "" {
+		errs = append(errs, FieldError{Field: "username", Message: message})
+	}
+
+	if message := validateEmail(req.Email); message != "" {
+		errs = append(errs, FieldError{Field: "email", Message: message})
+	}
+
+	if message := validator.validatePassword(req.Password); message != "" {
+		errs = append(errs, FieldError{Field: "password", Message: message})
+	}
+
+	return errs
+}
+
+func (validator *RegistrationValidator) validatePassword(password string) string {
+	if password == "" {
+		return "must not be empty"
+	}
+
+	length := utf8.RuneCountInString(password)
+
+	if length < validator.passwordMinLength {
+		return fmt.Sprintf("must be at least %d characters long", validator.passwordMinLength)
+	}
+
+	if length > validator.passwordMaxLength {
+		return fmt.Sprintf("must be at most %d characters long", validator.passwordMaxLength)
+	}
+
+	return ""
+}
+
+// validPasswordLength reports whether a password can be checked against a
+// hash. It allows passwords set under a higher configured maximum.
+func validPasswordLength(password string) bool {
+	return utf8.RuneCountInString(password) <= maxPasswordLength
+}
+
+func (validator *RegistrationValidator) validateUsername(username string) string {
+	length := utf8.RuneCountInString(username)
+
+	if length < validator.usernameMinLength {
+		return fmt.Sprintf("must be at least %d characters long", validator.usernameMinLength)
+	}
+
+	if length > validator.usernameMaxLength {
+		return fmt.Sprintf("must be at most %d characters long", validator.usernameMaxLength)
+	}
+
+	if !validator.usernamePattern.MatchString(username) {
+		return "contains invalid characters"
+	}
+
+	return ""
+}
+
+// normalizeEmail lower-cases emails before they are stored or looked up, so
+// an email can't be registered twice with different cases.
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+func validateEmail(email string) string {
+	if strings.TrimSpace(email) == "" {
+		return "must not be empty"
+	}
+
+	if utf8.RuneCountInString(email) > maxColumnLength {
+		return fmt.Sprintf("must be at most %d characters long", maxColumnLength)
+	}
+
+	// The local part is limited to 64 characters by RFC 5321
+	if at := strings.LastIndex(email, "@"); at > 64 {
+		return "is no valid email address"
+	}
+
+	if !emailPattern.MatchString(email) {
+		return "is no valid email address"
+	}
+
+	return ""
+}
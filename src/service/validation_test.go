@@ -0,0 +1,124 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validRegisterRequest() RegisterRequest {
+	return RegisterRequest{
+		Username: "testuser",
+		Password: "testpass",
+		Email:    "testuser@test.com",
+	}
+}
+
+func TestNewRegistrationValidatorInvalidConfig(t *testing.T) {
+	_, err := NewRegistrationValidator(ValidationConfig{UsernameMaxLength: 81})
+	assert.NotNil(t, err)
+
+	_, err = NewRegistrationValidator(ValidationConfig{UsernameMinLength: 10, UsernameMaxLength: 5})
+	assert.NotNil(t, err)
+
+	_, err = NewRegistrationValidator(ValidationConfig{UsernamePattern: "[a-z"})
+	assert.NotNil(t, err)
+
+	_, err = NewRegistrationValidator(ValidationConfig{PasswordMaxLength: 1025})
+	assert.NotNil(t, err)
+
+	_, err = NewRegistrationValidator(ValidationConfig{PasswordMinLength: 20, PasswordMaxLength: 10})
+	assert.NotNil(t, err)
+}
+
+func TestValidateRegistration(t *testing.T) {
+	validator, err := NewRegistrationValidator(ValidationConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, validator.Validate(validRegisterRequest()))
+
+	errs := validator.Validate(RegisterRequest{})
+	assert.Equal(t, []string{"username", "email", "password"}, []string{errs[0].Field, errs[1].Field, errs[2].Field})
+}
+
+func TestValidateUsername(t *testing.T) {
+	validator, err := NewRegistrationValidator(ValidationConfig{UsernameMaxLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, username := range []string{"ab", "abcdefghijk", "test user", "tëstuser", "test/user"} {
+		req := validRegisterRequest()
+		req.Username = username
+
+		errs := validator.Validate(req)
+		assert.Len(t, errs, 1, username)
+		assert.Equal(t, "username", errs[0].Field, username)
+	}
+
+	for _, username := range []string{"abc", "test.user", "test_us-1"} {
+		req := validRegisterRequest()
+		req.Username = username
+
+		assert.Empty(t, validator.Validate(req), username)
+	}
+}
+
+func TestValidateUsernamePattern(t *testing.T) {
+	validator, err := NewRegistrationValidator(ValidationConfig{UsernamePattern: `^\p{L}+$`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := validRegisterRequest()
+	req.Username = "tëstuser"
+	assert.Empty(t, validator.Validate(req))
+
+	req.Username = "testuser1"
+	assert.Len(t, validator.Validate(req), 1)
+}
+
+func TestValidateEmail(t *testing.T) {
+	for _, email := range []string{"", "testuser", "testuser@", "@test.com", "test user@test.com", "testuser@test", "test..user@test.com", "Test <testuser@test.com>", strings.Repeat("a", 65) + "@test.com", strings.Repeat("a", 60) + "@" + strings.Repeat("b", 20) + ".com"} {
+		assert.NotEmpty(t, validateEmail(email), email)
+	}
+
+	for _, email := range []string{"testuser@test.com", "test.user+tag@mail.test.com", "test_user@test-domain.io"} {
+		assert.Empty(t, validateEmail(email), email)
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	validator, err := NewRegistrationValidator(ValidationConfig{PasswordMinLength: 8, PasswordMaxLength: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"", "short", strings.Repeat("a", 17)} {
+		req := validRegisterRequest()
+		req.Password = password
+
+		errs := validator.Validate(req)
+		assert.Len(t, errs, 1, password)
+		assert.Equal(t, "password", errs[0].Field, password)
+	}
+
+	for _, password := range []string{"testpass", strings.Repeat("ä", 16)} {
+		req := validRegisterRequest()
+		req.Password = password
+
+		assert.Empty(t, validator.Validate(req), password)
+	}
+}
+
+func TestValidPasswordLength(t *testing.T) {
+	assert.True(t, validPasswordLength(strings.Repeat("a", maxPasswordLength)))
+	assert.False(t, validPasswordLength(strings.Repeat("a", maxPasswordLength+1)))
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	assert.Equal(t, "testuser@test.com", normalizeEmail("TestUser@Test.COM"))
+}
@@ -0,0 +1,93 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	if _, err := Setup(context.Background(), Config{}, &bytes.Buffer{}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	return recorder
+}
+
+func TestSetupInvalidExporter(t *testing.T) {
+	_, err := Setup(context.Background(), Config{Exporter: "zipkin"}, &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
+
+func TestSetupStdout(t *testing.T) {
+	var buffer bytes.Buffer
+	shutdown, err := Setup(context.Background(), Config{Exporter: "stdout"}, &buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := Start(context.Background(), "test")
+	span.End()
+
+	assert.Nil(t, shutdown(context.Background()))
+	assert.Contains(t, buffer.String(), `"Name":"test"`)
+}
+
+func TestInstrumentContinuesTrace(t *testing.T) {
+	recorder := setupRecorder(t)
+
+	router := httprouter.New()
+	router.GET("/api/auth/keys/:id", Instrument("/api/auth/keys/:id", func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		_, span := Start(r.Context(), "child")
+		span.End()
+
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/keys/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+
+	child, server := spans[0], spans[1]
+
+	assert.Equal(t, "GET /api/auth/keys/:id", server.Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Equal(t, server.SpanContext().SpanID(), child.Parent().SpanID())
+	assert.Equal(t, codes.Error, server.Status().Code)
+	assert.Contains(t, server.Attributes(), semconv.HTTPRoute("/api/auth/keys/:id"))
+	assert.Contains(t, server.Attributes(), semconv.HTTPResponseStatusCode(http.StatusInternalServerError))
+}
+
+func TestEndRecordsError(t *testing.T) {
+	recorder := setupRecorder(t)
+
+	_, span := Start(context.Background(), "query")
+	End(span, errors.New("connection refused"))
+
+	spans := recorder.Ended()
+
+	assert.Equal(t, 1, len(spans))
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, "connection refused", spans[0].Status().Description)
+}